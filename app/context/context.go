@@ -7,9 +7,10 @@ import (
 )
 
 type CustomContext struct {
-	Token    *oidc.IDToken
-	Username string
-	Share    *models.Share
+	Token       *oidc.IDToken
+	Username    string
+	Share       *models.Share
+	FileRequest *models.FileRequest
 	echo.Context
 }
 
@@ -18,10 +19,11 @@ func ExtractContext(next echo.HandlerFunc) echo.HandlerFunc {
 		token := ExtractToken(c.Request())
 
 		cc := CustomContext{
-			Token:    token,
-			Username: ExtractUsername(token),
-			Share:    ExtractShare(c),
-			Context:  c,
+			Token:       token,
+			Username:    ExtractUsername(token),
+			Share:       ExtractShare(c),
+			FileRequest: ExtractFileRequest(c),
+			Context:     c,
 		}
 		return next(cc)
 	}
@@ -0,0 +1,21 @@
+package context
+
+import (
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/labstack/echo/v4"
+	"strings"
+)
+
+func ExtractFileRequest(c echo.Context) *models.FileRequest {
+	if !strings.Contains(c.Path(), "requests") {
+		return nil
+	}
+
+	id := c.Param("id")
+	if id != "" {
+		request, _ := oss.GetFileRequest(c.Request().Context(), id)
+		return request
+	}
+	return nil
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func ExtractShare(c echo.Context) *models.Share {
-	if !strings.Contains(c.Path(), "shares") {
+	if !strings.Contains(c.Path(), "shares") && !strings.HasPrefix(c.Path(), "/s/:name/site/") {
 		return nil
 	}
 
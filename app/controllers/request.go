@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/jingbh/simple-share/internal/notify"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type requestCreateRequest struct {
+	Share       string     `json:"share"` // a directory share of the creator, or a new one is created
+	DisplayName string     `json:"displayName"`
+	Password    string     `json:"password" validate:"max_len:72"`
+	Expiry      *int       `json:"expiry" validate:"range:0,365"`
+	ExpiresIn   *int       `json:"expiresIn" validate:"range:60,31536000"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	MaxFiles    int        `json:"maxFiles" validate:"range:0,10000"`
+	MaxSize     int64      `json:"maxSize" validate:"min:0"` // in bytes
+}
+
+type requestUploadCompleteRequest struct {
+	Path   string `json:"path" validate:"required"`
+	SHA256 string `json:"sha256" validate:"regex:^[0-9a-fA-F]{64}$" message:"regex:invalid SHA-256 checksum"`
+}
+
+// newShareNameLength is the length of the name of shares created along with a file request.
+const newShareNameLength = 8
+
+// requestError maps the errors of uploading through a file request to responses.
+func requestError(err error) error {
+	switch {
+	case errors.Is(err, oss.ErrRequestLimitReached):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "this file request has reached its limit")
+	case errors.Is(err, oss.ErrRequestUploadNotFound), errors.Is(err, oss.ErrUploadNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "upload not found")
+	case errors.Is(err, oss.ErrShareFilePathInvalid):
+		return invalidField("path", "pathValid", "invalid file path")
+	case errors.Is(err, oss.ErrObjectNotFound), errors.Is(err, oss.ErrNotDirectory):
+		return echo.NewHTTPError(http.StatusNotFound, "the share of this file request no longer exists")
+	case errors.Is(err, oss.ErrSharePasswordRequired):
+		return echo.NewHTTPError(http.StatusConflict, "the share of this file request is encrypted with its password")
+	default:
+		return uploadError(err)
+	}
+}
+
+func RequestCreate(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	req := new(requestCreateRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt *time.Time
+	if t, ok, err := resolveShareExpiry(req.Expiry, req.ExpiresIn, req.ExpiresAt); err != nil {
+		return err
+	} else if ok && !t.IsZero() {
+		expiresAt = &t
+	}
+
+	creator := &models.ShareCreator{
+		Subject:  cc.Token.Subject,
+		Username: cc.Username,
+	}
+
+	shareName := req.Share
+	if shareName != "" {
+		share, err := oss.GetShare(c.Request().Context(), shareName)
+		if err != nil {
+			return err
+		}
+		if share == nil || share.Type != "directory" || share.Creator == nil || share.Creator.Subject != creator.Subject {
+			return invalidField("share", "shareValid", "please choose a directory share of yours")
+		}
+		if share.Encrypted && share.Password != "" {
+			// the files cannot be encrypted without the password of the share
+			return invalidField("share", "shareValid", "files cannot be requested into an encrypted share with a password")
+		}
+		shareName = share.Name
+	} else {
+		// an empty directory, which is filled by the uploads
+		shareName, err = oss.GenerateShareName(newShareNameLength)
+		if err != nil {
+			return err
+		}
+		key, err := oss.NewShareKey("")
+		if err != nil {
+			return err
+		}
+		err = oss.CreateShare(c.Request().Context(), oss.CreateShareOptions{
+			Type:        "directory",
+			Text:        "[]",
+			DisplayName: req.DisplayName,
+			Path:        shareName,
+			Creator:     creator,
+			Key:         key,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := oss.CreateFileRequest(c.Request().Context(), oss.CreateFileRequestOptions{
+		Share:       shareName,
+		DisplayName: req.DisplayName,
+		Password:    req.Password,
+		ExpiresAt:   expiresAt,
+		MaxFiles:    req.MaxFiles,
+		MaxSize:     req.MaxSize,
+		Creator:     creator,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"id":    id,
+		"share": shareName,
+	})
+}
+
+func RequestList(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	requests, err := oss.ListFileRequests(c.Request().Context(), cc.Token.Subject)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, requests)
+}
+
+func RequestGet(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	// the ids of the files being uploaded would let anyone with the link cancel them
+	request := *cc.FileRequest
+	request.Uploads = nil
+	return c.JSON(http.StatusOK, &request)
+}
+
+func RequestDelete(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	// the files already received are kept in the share
+	err := oss.DeleteFileRequest(c.Request().Context(), cc.FileRequest)
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func RequestUploadStart(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	fileId, err := oss.StartRequestUpload(c.Request().Context(), cc.FileRequest)
+	if err != nil {
+		return requestError(err)
+	}
+	return c.JSON(http.StatusOK, &UploadStartResponse{
+		FileId:   fileId,
+		PartSize: oss.UploadPartSize,
+	})
+}
+
+func RequestUploadPart(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	fileId := c.Param("file")
+	partNumber, err := strconv.Atoi(c.Param("part"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid part number")
+	}
+	if err = checkPartBody(c); err != nil {
+		return err
+	}
+	checksum, err := partChecksum(c)
+	if err != nil {
+		return err
+	}
+	err = oss.ReserveRequestUpload(c.Request().Context(), cc.FileRequest, fileId, c.Request().ContentLength)
+	if err != nil {
+		return requestError(err)
+	}
+	err = oss.UploadPart(c.Request().Context(), fileId, partNumber, c.Request().Body, c.Request().ContentLength, checksum)
+	if err != nil {
+		return requestError(err)
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+func RequestUploadComplete(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	req := new(requestUploadCompleteRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+
+	request, file, err := oss.CompleteRequestUpload(c.Request().Context(), cc.FileRequest.Id, c.Param("file"), req.Path, req.SHA256)
+	if err != nil {
+		return requestError(err)
+	}
+
+	notify.Send(notify.Event{
+		Type:  "request.upload",
+		Owner: request.Creator,
+		Data: map[string]interface{}{
+			"request": request.Id,
+			"share":   request.Share,
+			"file":    file,
+		},
+	})
+	return c.JSON(http.StatusCreated, file)
+}
+
+func RequestUploadStatus(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	err := oss.CheckRequestUploadOwner(c.Request().Context(), cc.FileRequest.Id, c.Param("file"))
+	if err != nil {
+		return requestError(err)
+	}
+	return uploadStatus(c, c.Param("file"))
+}
+
+func RequestUploadAbort(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	err := oss.AbortRequestUpload(c.Request().Context(), cc.FileRequest.Id, c.Param("file"))
+	if err != nil {
+		return requestError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
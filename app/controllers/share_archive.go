@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/jingbh/simple-share/internal/utils"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// archiveContentTypes The archive formats, by their file extension.
+var archiveContentTypes = map[string]string{
+	"zip":    "application/zip",
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+}
+
+func ShareGetArchive(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	if cc.Share.Type != "directory" {
+		return echo.NewHTTPError(http.StatusConflict, "only directory shares can be downloaded as an archive")
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "zip"
+	}
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "unsupported archive format")
+	}
+
+	// file ids may be given as repeated parameters, or separated by commas
+	var ids []string
+	for _, v := range c.QueryParams()["files"] {
+		for _, id := range strings.Split(v, ",") {
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	files := oss.SelectShareFiles(cc.Share.Files, ids, c.QueryParam("prefix"))
+	if len(files) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "no files selected")
+	}
+
+	var dones []func()
+	if cc.Share.MaxDownloads > 0 {
+		// nothing is counted for archives that cannot be written
+		err := oss.CheckShareFiles(c.Request().Context(), cc.Share, files)
+		if errors.Is(err, oss.ErrObjectNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "file not found")
+		}
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			done, err := countDownload(cc, file.Id)
+			if err != nil {
+				return err
+			}
+			dones = append(dones, done)
+		}
+	}
+	err := writeShareArchive(cc, format, contentType, files)
+	if err == nil {
+		for _, done := range dones {
+			done()
+		}
+	}
+	return err
+}
+
+// writeShareArchive responds with an archive of the files in the format.
+func writeShareArchive(cc context.CustomContext, format string, contentType string, files models.ShareFiles) error {
+	filename := cc.Share.Name
+	if cc.Share.DisplayName != "" {
+		filename = cc.Share.DisplayName
+	}
+	cc.Response().Header().Set("Content-Disposition", utils.AttachmentDisposition(filename+"."+format))
+	cc.Response().Header().Set("Cache-Control", "no-store")
+
+	if format == "tar" {
+		return shareGetTar(cc, files)
+	}
+
+	cc.Response().Header().Set(echo.HeaderContentType, contentType)
+	cc.Response().WriteHeader(http.StatusOK)
+
+	// the response is already started, errors can only abort it
+	if format == "tar.gz" {
+		return oss.WriteShareTarGz(cc.Request().Context(), cc.Response(), cc.Share, files)
+	}
+	return oss.WriteShareZip(cc.Request().Context(), cc.Response(), cc.Share, files)
+}
+
+// shareGetTar responds with a TAR archive, whose size is known ahead, so downloads can be resumed.
+func shareGetTar(cc context.CustomContext, files models.ShareFiles) error {
+	rangeHeader := ""
+	// partial downloads would bypass the download limit
+	if cc.Share.MaxDownloads == 0 {
+		rangeHeader = cc.Request().Header.Get("Range")
+	}
+	res, err := oss.GetShareTar(cc.Request().Context(), cc.Share, files, rangeHeader)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(res.Body)
+
+	for _, key := range []string{"Accept-Ranges", "Content-Length", "Content-Range"} {
+		if v := res.Headers.Get(key); v != "" && (key != "Accept-Ranges" || cc.Share.MaxDownloads == 0) {
+			cc.Response().Header().Set(key, v)
+		}
+	}
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return cc.NoContent(res.StatusCode)
+	}
+	return cc.Stream(res.StatusCode, res.Headers.Get("Content-Type"), res.Body)
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	_context "context"
 	"encoding/json"
+	"errors"
 	"github.com/jingbh/simple-share/app/context"
 	"github.com/jingbh/simple-share/internal/models"
 	"github.com/jingbh/simple-share/internal/oss"
@@ -10,17 +11,24 @@ import (
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 type shareCreateRequest struct {
-	Type             string `json:"type" validate:"required|in:file,text,url"`
-	Name             string `json:"name" validate:"required_if:nameRandom,false|nameValid" message:"required_if:please choose a name for your share|nameValid:invalid share name"`
-	NameRandom       bool   `json:"nameRandom"`
-	NameRandomLength int    `json:"nameRandomLength" validate:"required_if:nameRandom,true|range:4,32"`
-	DisplayName      string `json:"displayName"`
-	Password         string `json:"password" validate:"max_len:72"`
-	Expiry           int    `json:"expiry" validate:"in:0,1,3,7"`
-	Text             string `json:"text" validate:"required_unless:type,file|textIsUrl" message:"textIsUrl:invalid URL"`
+	Type             string     `json:"type" validate:"required|in:file,text,url"`
+	Name             string     `json:"name" validate:"required_if:nameRandom,false|nameValid" message:"required_if:please choose a name for your share|nameValid:invalid share name"`
+	NameRandom       bool       `json:"nameRandom"`
+	NameRandomLength int        `json:"nameRandomLength" validate:"required_if:nameRandom,true|range:4,32"`
+	DisplayName      string     `json:"displayName"`
+	Password         string     `json:"password" validate:"max_len:72"`
+	Expiry           *int       `json:"expiry" validate:"range:0,365"`          // in days, 0 means never
+	ExpiresIn        *int       `json:"expiresIn" validate:"range:60,31536000"` // in seconds
+	ExpiresAt        *time.Time `json:"expiresAt"`
+	MaxDownloads     int        `json:"maxDownloads" validate:"range:0,10000"`
+	BurnAfterRead    bool       `json:"burnAfterRead"` // delete after the first download
+	Extract          bool       `json:"extract"`       // expand the single uploaded archive into a directory
+	Site             bool       `json:"site"`          // serve the directory as a static website
+	Text             string     `json:"text" validate:"required_unless:type,file|textIsUrl" message:"textIsUrl:invalid URL"`
 	Files            []struct {
 		Id   string `json:"id" validate:"required"`
 		Path string `json:"path" validate:"required"`
@@ -42,6 +50,46 @@ func (r shareCreateRequest) TextIsUrl(val string) bool {
 	return true
 }
 
+// invalidField returns a validation error of the field, in the same format as the validator.
+func invalidField(field string, rule string, message string) error {
+	return &echo.HTTPError{
+		Code: http.StatusUnprocessableEntity,
+		Message: map[string]map[string]string{
+			field: {rule: message},
+		},
+	}
+}
+
+// maxShareExpiry is how far in the future a share may expire.
+const maxShareExpiry = 365 * 24 * time.Hour
+
+// resolveShareExpiry returns the expiration time requested by one of `expiry`, `expiresIn` and `expiresAt`.
+// It returns false if none of them is set, and the zero time if the share should never expire.
+func resolveShareExpiry(expiry *int, expiresIn *int, expiresAt *time.Time) (time.Time, bool, error) {
+	now := time.Now()
+	switch {
+	case expiry != nil && (expiresIn != nil || expiresAt != nil), expiresIn != nil && expiresAt != nil:
+		return time.Time{}, false, invalidField("expiry", "expiryValid", "only one of expiry, expiresIn and expiresAt can be set")
+	case expiry != nil:
+		if *expiry == 0 {
+			return time.Time{}, true, nil
+		}
+		return now.Add(time.Duration(*expiry) * 24 * time.Hour), true, nil
+	case expiresIn != nil:
+		return now.Add(time.Duration(*expiresIn) * time.Second), true, nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return time.Time{}, false, invalidField("expiresAt", "expiryValid", "expiration time must be in the future")
+		}
+		if expiresAt.After(now.Add(maxShareExpiry)) {
+			return time.Time{}, false, invalidField("expiresAt", "expiryValid", "expiration time must be within a year")
+		}
+		return *expiresAt, true, nil
+	default:
+		return time.Time{}, false, nil
+	}
+}
+
 func ShareCreate(c echo.Context) error {
 	cc := c.(context.CustomContext)
 	req := new(shareCreateRequest)
@@ -57,6 +105,30 @@ func ShareCreate(c echo.Context) error {
 		return err
 	}
 
+	var expiresAt *time.Time
+	if t, ok, err := resolveShareExpiry(req.Expiry, req.ExpiresIn, req.ExpiresAt); err != nil {
+		return err
+	} else if ok && !t.IsZero() {
+		expiresAt = &t
+	}
+
+	if req.BurnAfterRead {
+		req.MaxDownloads = 1
+	}
+
+	if req.Extract && (req.Type != "file" || len(req.Files) != 1) {
+		return invalidField("files", "archiveValid", "please upload a single archive to extract")
+	}
+	if req.Site {
+		if req.Type != "file" || (!req.Extract && len(req.Files) < 2) {
+			return invalidField("site", "siteValid", "only directory shares can be served as a website")
+		}
+		if req.Password != "" {
+			// the pages of a website cannot pass the password along
+			return invalidField("site", "siteValid", "websites cannot be protected by a password")
+		}
+	}
+
 	if req.NameRandom {
 		req.Name, err = oss.GenerateShareName(req.NameRandomLength)
 		if err != nil {
@@ -72,62 +144,103 @@ func ShareCreate(c echo.Context) error {
 		}
 	}
 
+	key, err := oss.NewShareKey(req.Password)
+	if err != nil {
+		return err
+	}
+
 	if req.Type == "text" || req.Type == "url" {
 		err = oss.CreateShare(cc.Request().Context(), oss.CreateShareOptions{
-			Type:        req.Type,
-			Text:        req.Text,
-			DisplayName: req.DisplayName,
-			Path:        req.Name,
-			Password:    req.Password,
-			Expiry:      req.Expiry,
-			Creator:     creator,
+			Type:          req.Type,
+			Text:          req.Text,
+			DisplayName:   req.DisplayName,
+			Path:          req.Name,
+			Password:      req.Password,
+			ExpiresAt:     expiresAt,
+			Creator:       creator,
+			MaxDownloads:  req.MaxDownloads,
+			BurnAfterRead: req.BurnAfterRead,
+			Key:           key,
 		})
-	} else if len(req.Files) > 1 {
+	} else if req.Extract || len(req.Files) > 1 {
 		// directory
-		var treeJsonBytes []byte
-		treeJsonBytes, err = json.Marshal(req.Files)
-		if err != nil {
-			return err
-		}
-		treeJson := string(treeJsonBytes)
-		for _, file := range req.Files {
-			err = oss.CreateShare(cc.Request().Context(), oss.CreateShareOptions{
-				Type:   "file",
-				Source: file.Id + ".bin",
-				Name:   utils.ExtractFilename(file.Path),
-				Path:   req.Name + ".d/" + file.Id + ".bin",
-				Expiry: req.Expiry,
+		var tree models.ShareFiles
+		if req.Extract {
+			tree, err = oss.ExtractShareArchive(cc.Request().Context(), oss.ExtractShareArchiveOptions{
+				Source:    req.Files[0].Id + ".bin",
+				Name:      req.Name,
+				ExpiresAt: expiresAt,
+				Key:       key,
 			})
-			if err != nil {
-				break
+		} else {
+			for _, file := range req.Files {
+				var sum string
+				sum, err = oss.GetUploadChecksum(cc.Request().Context(), file.Id)
+				if err != nil {
+					break
+				}
+				err = oss.CreateShare(cc.Request().Context(), oss.CreateShareOptions{
+					Type:      "file",
+					Source:    file.Id + ".bin",
+					Name:      utils.ExtractFilename(file.Path),
+					Path:      req.Name + ".d/" + file.Id + ".bin",
+					ExpiresAt: expiresAt,
+					SHA256:    sum,
+					Key:       key,
+				})
+				if err != nil {
+					break
+				}
+				tree = append(tree, models.ShareFile{Id: file.Id, Path: file.Path, SHA256: sum})
 			}
 		}
 		if err != nil {
 			// error while creating files, the directory should be deleted to prevent orphan files.
 			// the background context is used, so even if the request is cancelled, the deletion will still proceed.
 			_ = oss.DeleteShare(_context.Background(), req.Name)
+			if errors.Is(err, oss.ErrArchiveInvalid) || errors.Is(err, oss.ErrArchiveTooLarge) {
+				return invalidField("files", "archiveValid", err.Error())
+			}
+			return err
+		}
+		var treeJsonBytes []byte
+		treeJsonBytes, err = json.Marshal(tree)
+		if err != nil {
 			return err
 		}
 		err = oss.CreateShare(cc.Request().Context(), oss.CreateShareOptions{
-			Type:        "directory",
-			Text:        treeJson,
-			DisplayName: req.DisplayName,
-			Path:        req.Name,
-			Password:    req.Password,
-			Expiry:      req.Expiry,
-			Creator:     creator,
+			Type:          "directory",
+			Text:          string(treeJsonBytes),
+			DisplayName:   req.DisplayName,
+			Path:          req.Name,
+			Password:      req.Password,
+			ExpiresAt:     expiresAt,
+			Creator:       creator,
+			MaxDownloads:  req.MaxDownloads,
+			BurnAfterRead: req.BurnAfterRead,
+			Site:          req.Site,
+			Key:           key,
 		})
 	} else {
 		// single file, copy that file to destination
+		var sum string
+		sum, err = oss.GetUploadChecksum(cc.Request().Context(), req.Files[0].Id)
+		if err != nil {
+			return err
+		}
 		err = oss.CreateShare(cc.Request().Context(), oss.CreateShareOptions{
-			Type:        "file",
-			Source:      req.Files[0].Id + ".bin",
-			Name:        utils.ExtractFilename(req.Files[0].Path),
-			DisplayName: req.DisplayName,
-			Path:        req.Name,
-			Password:    req.Password,
-			Expiry:      req.Expiry,
-			Creator:     creator,
+			Type:          "file",
+			Source:        req.Files[0].Id + ".bin",
+			Name:          utils.ExtractFilename(req.Files[0].Path),
+			DisplayName:   req.DisplayName,
+			Path:          req.Name,
+			Password:      req.Password,
+			ExpiresAt:     expiresAt,
+			Creator:       creator,
+			MaxDownloads:  req.MaxDownloads,
+			BurnAfterRead: req.BurnAfterRead,
+			SHA256:        sum,
+			Key:           key,
 		})
 	}
 	if err != nil {
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+type shareAddFilesRequest struct {
+	Files []struct {
+		Id   string `json:"id" validate:"required"`
+		Path string `json:"path" validate:"required"`
+	} `json:"files" validate:"required|max_len:100" message:"required:please upload at least one file first|max_len:too many files"`
+}
+
+type shareMoveFileRequest struct {
+	Path string `json:"path" validate:"required"`
+}
+
+// shareFilesError converts errors of changing the files of a share into responses.
+func shareFilesError(err error) error {
+	switch {
+	case errors.Is(err, oss.ErrNotDirectory):
+		return echo.NewHTTPError(http.StatusConflict, "only files of directory shares can be changed")
+	case errors.Is(err, oss.ErrShareFileNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "file not found")
+	case errors.Is(err, oss.ErrShareFileLast):
+		return echo.NewHTTPError(http.StatusConflict, "cannot remove the last file, delete the share instead")
+	case errors.Is(err, oss.ErrShareFilePathInvalid):
+		return invalidField("path", "pathValid", "invalid path")
+	case errors.Is(err, oss.ErrShareFilePathTaken):
+		return invalidField("path", "unique", "a file with the same path or id already exists")
+	case errors.Is(err, oss.ErrObjectNotFound):
+		return invalidField("files", "uploaded", "please upload the files first")
+	default:
+		return err
+	}
+}
+
+func ShareAddFiles(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	req := new(shareAddFilesRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+
+	var files []oss.ShareFileOptions
+	for _, file := range req.Files {
+		files = append(files, oss.ShareFileOptions{
+			Id:   file.Id,
+			Path: file.Path,
+		})
+	}
+	err = oss.AddShareFiles(c.Request().Context(), cc.Share.Name, files)
+	if err != nil {
+		return shareFilesError(err)
+	}
+
+	return respondShare(cc, cc.Share.Name)
+}
+
+func ShareMoveFile(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	req := new(shareMoveFileRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+
+	err = oss.MoveShareFile(c.Request().Context(), cc.Share.Name, cc.Param("file"), req.Path)
+	if err != nil {
+		return shareFilesError(err)
+	}
+
+	return respondShare(cc, cc.Share.Name)
+}
+
+func ShareRemoveFile(c echo.Context) error {
+	cc := c.(context.CustomContext)
+
+	err := oss.RemoveShareFile(c.Request().Context(), cc.Share.Name, cc.Param("file"))
+	if err != nil {
+		return shareFilesError(err)
+	}
+
+	return respondShare(cc, cc.Share.Name)
+}
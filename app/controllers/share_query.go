@@ -1,6 +1,11 @@
 package controllers
 
 import (
+	"bufio"
+	_context "context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"github.com/jingbh/simple-share/app/context"
 	"github.com/jingbh/simple-share/internal/models"
 	"github.com/jingbh/simple-share/internal/oss"
@@ -16,14 +21,51 @@ type ShareListResponse struct {
 	NextCursor string          `json:"cursor"`
 }
 
+type shareListRequest struct {
+	Cursor    string `query:"cursor"`
+	Type      string `query:"type" validate:"in:file,directory,text,url"`
+	Status    string `query:"status" validate:"in:active,expired"`
+	Protected string `query:"protected" validate:"in:true,false"`
+	Prefix    string `query:"prefix"`
+	Sort      string `query:"sort" validate:"in:name,createdAt,expiresAt,size"`
+	Order     string `query:"order" validate:"in:asc,desc"`
+}
+
 type ShareGetFileTypeResponse struct {
 	Id   string          `json:"id"`
 	Type models.FileType `json:"type"`
 }
 
 func ShareList(c echo.Context) error {
-	cursor := c.QueryParam("cursor")
-	res, nextCursor, err := oss.ListShares(c.Request().Context(), cursor)
+	cc := c.(context.CustomContext)
+	req := new(shareListRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+
+	options := oss.ListSharesOptions{
+		Creator:    cc.Token.Subject,
+		Type:       req.Type,
+		Status:     req.Status,
+		Prefix:     req.Prefix,
+		Sort:       req.Sort,
+		Descending: req.Order == "desc",
+		Cursor:     req.Cursor,
+	}
+	if req.Protected != "" {
+		protected := req.Protected == "true"
+		options.Protected = &protected
+	}
+
+	res, nextCursor, err := oss.ListShares(c.Request().Context(), options)
 	if err != nil {
 		return err
 	}
@@ -41,12 +83,51 @@ func ShareGet(c echo.Context) error {
 
 func ShareShow(c echo.Context) error {
 	name := c.Param("name")
+	if share, _ := oss.GetShareCached(c.Request().Context(), name); share != nil {
+		// resolve aliases
+		name = share.Name
+	}
 	return c.Redirect(http.StatusFound, utils.Url("/#/shares/"+name))
 }
 
+// countDownload counts a download of a share with limited downloads, once its content is opened,
+// and returns a function to call once the content is sent, which burns the share if exhausted.
+// A download which fails after it starts, like when the client disconnects, still counts,
+// as counting only the downloads sent in full would let concurrent ones exceed the limit.
+// Downloads by the owner, and of the directory tree, are not counted.
+func countDownload(cc context.CustomContext, fileId string) (func(), error) {
+	share := cc.Share
+	isOwner := cc.Token != nil && share.Creator != nil && share.Creator.Subject == cc.Token.Subject
+	if share.MaxDownloads <= 0 || isOwner || cc.Request().Method == http.MethodHead || (share.Type == "directory" && fileId == "") {
+		return func() {}, nil
+	}
+
+	exhausted, err := oss.CountShareDownload(cc.Request().Context(), share, fileId)
+	if errors.Is(err, oss.ErrDownloadLimitReached) {
+		return nil, echo.NewHTTPError(http.StatusGone, "this file has reached its download limit")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !exhausted || !(share.BurnAfterRead || viper.GetBool("share.delete_exhausted")) {
+		return func() {}, nil
+	}
+	return func() {
+		// the background context is used, as the request may be cancelled once the content is sent
+		if err := oss.DeleteShare(_context.Background(), share.Name); err != nil {
+			cc.Logger().Error(err)
+		}
+	}, nil
+}
+
 func ShareGetFile(c echo.Context) error {
 	cc := c.(context.CustomContext)
-	fileId := cc.Param("file")
+	return shareGetFile(cc, cc.Param("file"))
+}
+
+// shareGetFile responds with the content of a share, or of a file of a directory share.
+func shareGetFile(cc context.CustomContext, fileId string) error {
+	limited := cc.Share.MaxDownloads > 0
 
 	contentType := "application/octet-stream"
 	if cc.Share.Type == "directory" && fileId == "" {
@@ -55,23 +136,29 @@ func ShareGetFile(c echo.Context) error {
 		contentType = "text/plain"
 	}
 
-	if viper.GetBool("oss.download_direct") {
-		url, err := oss.GetShareContentLink(c.Request().Context(), oss.GetShareContentLinkOptions{
+	// links and partial downloads would bypass the download limit
+	if viper.GetBool("oss.download_direct") && !limited {
+		url, err := oss.GetShareContentLink(cc.Request().Context(), oss.GetShareContentLinkOptions{
 			Name:        cc.Share.Name,
 			FileId:      fileId,
 			ContentType: contentType,
 		})
-		if err != nil {
+		if err == nil {
+			return cc.Redirect(http.StatusFound, url)
+		}
+		if !errors.Is(err, oss.ErrNotSupported) {
 			return err
 		}
-		return c.Redirect(http.StatusFound, url)
+		// the storage cannot be accessed directly, fall back to proxying
 	}
 
-	c.Response().Header().Add("Accept-Ranges", "bytes")
 	requestHeaders := make(http.Header)
-	requestHeaders.Add("Range", c.Request().Header.Get("Range"))
+	if !limited {
+		cc.Response().Header().Add("Accept-Ranges", "bytes")
+		requestHeaders.Add("Range", cc.Request().Header.Get("Range"))
+	}
 	requestHeaders.Add("Content-Type", contentType)
-	res, err := oss.GetShareContent(c.Request().Context(), oss.GetShareContentOptions{
+	res, err := oss.GetShareContent(cc.Request().Context(), oss.GetShareContentOptions{
 		Name:    cc.Share.Name,
 		FileId:  fileId,
 		Headers: requestHeaders,
@@ -86,23 +173,57 @@ func ShareGetFile(c echo.Context) error {
 		_ = reader.Close()
 	}(res.Body)
 
-	if v := res.Headers.Get("Cache-Control"); v != "" {
-		c.Response().Header().Add("Cache-Control", v)
+	done, err := countDownload(cc, fileId)
+	if err != nil {
+		return err
+	}
+
+	if limited {
+		cc.Response().Header().Add("Cache-Control", "no-store")
+	} else if v := res.Headers.Get("Cache-Control"); v != "" {
+		cc.Response().Header().Add("Cache-Control", v)
 	}
 	if v := res.Headers.Get("Content-Disposition"); v != "" {
-		c.Response().Header().Add("Content-Disposition", v)
+		cc.Response().Header().Add("Content-Disposition", v)
 	}
 	if v := res.Headers.Get("Content-Length"); v != "" {
-		c.Response().Header().Add("Content-Length", v)
+		cc.Response().Header().Add("Content-Length", v)
+	}
+	if v := res.Headers.Get("Content-Range"); v != "" {
+		cc.Response().Header().Add("Content-Range", v)
 	}
 	if v := res.Headers.Get("Content-Type"); v != "" {
 		contentType = v
 	}
+	if v := reprDigest(cc.Share, fileId); v != "" {
+		cc.Response().Header().Add("Repr-Digest", v)
+	}
 
-	if c.Request().Method == http.MethodHead {
-		return c.NoContent(res.StatusCode)
+	if cc.Request().Method == http.MethodHead {
+		return cc.NoContent(res.StatusCode)
+	}
+	if err = cc.Stream(res.StatusCode, contentType, res.Body); err != nil {
+		return err
 	}
-	return c.Stream(res.StatusCode, contentType, res.Body)
+	done()
+	return nil
+}
+
+// reprDigest returns the `Repr-Digest` header of the share content, or one file of a directory,
+// if its checksum is verified, so the downloads can be verified by the recipients.
+func reprDigest(share *models.Share, fileId string) string {
+	var sum string
+	for _, file := range share.Files {
+		if (share.Type == "file" && fileId == "") || (share.Type == "directory" && file.Id == fileId) {
+			sum = file.SHA256
+			break
+		}
+	}
+	data, err := hex.DecodeString(sum)
+	if sum == "" || err != nil {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(data) + ":"
 }
 
 func ShareGetFileType(c echo.Context) error {
@@ -128,6 +249,10 @@ func ShareGetFilePreview(c echo.Context) error {
 	fileId := cc.Param("file")
 
 	filetype, _ := oss.GetShareContentType(c.Request().Context(), cc.Share.Name, fileId)
+	if filetype != models.FileTypeText && filetype != models.FileTypeImage {
+		return echo.NewHTTPError(http.StatusNotFound, "preview not available")
+	}
+
 	switch filetype {
 	case models.FileTypeText:
 		res, _ := oss.GetShareContent(c.Request().Context(), oss.GetShareContentOptions{
@@ -139,23 +264,36 @@ func ShareGetFilePreview(c echo.Context) error {
 			defer func(reader io.ReadCloser) {
 				_ = reader.Close()
 			}(res.Body)
-			return c.Stream(http.StatusOK, echo.MIMETextPlain, res.Body)
+			return streamPreview(cc, fileId, echo.MIMETextPlain, res.Body)
 		}
 		break
 	case models.FileTypeImage:
 		headers := make(http.Header)
 		headers.Add("X-OSS-Process", "image/auto-orient,1/resize,m_lfit,l_2048,s_1536,limit_1/quality,q_90")
-		res, _ := oss.GetShareContent(c.Request().Context(), oss.GetShareContentOptions{
+		res, err := oss.GetShareContent(c.Request().Context(), oss.GetShareContentOptions{
 			Name:    cc.Share.Name,
 			FileId:  fileId,
 			Headers: headers,
 		})
+		if errors.Is(err, oss.ErrNotSupported) {
+			// the storage cannot resize images, the original is sent instead
+			res, err = oss.GetShareContent(c.Request().Context(), oss.GetShareContentOptions{
+				Name:   cc.Share.Name,
+				FileId: fileId,
+			})
+		}
+		if err != nil {
+			return err
+		}
 		if res != nil {
 			defer func(reader io.ReadCloser) {
 				_ = reader.Close()
 			}(res.Body)
-			c.Response().Header().Add("Cache-Control", "private, max-age=86400")
-			return c.Stream(http.StatusOK, "image/webp", res.Body)
+			if cc.Share.MaxDownloads <= 0 {
+				c.Response().Header().Add("Cache-Control", "private, max-age=86400")
+			}
+			body := bufio.NewReader(res.Body)
+			return streamPreview(cc, fileId, imageContentType(res.Headers.Get("Content-Type"), body), body)
 		}
 		break
 	default:
@@ -164,3 +302,26 @@ func ShareGetFilePreview(c echo.Context) error {
 
 	return echo.NewHTTPError(http.StatusNotFound, "preview not available")
 }
+
+// imageContentType returns the stored type of an image, or the one sniffed from its content
+// if it was stored as a generic file.
+func imageContentType(contentType string, body *bufio.Reader) string {
+	if contentType != "" && contentType != "application/octet-stream" {
+		return contentType
+	}
+	head, _ := body.Peek(512)
+	return http.DetectContentType(head)
+}
+
+// streamPreview responds with a preview, which is counted as a download as it discloses the content.
+func streamPreview(cc context.CustomContext, fileId string, contentType string, body io.Reader) error {
+	done, err := countDownload(cc, fileId)
+	if err != nil {
+		return err
+	}
+	if err = cc.Stream(http.StatusOK, contentType, body); err != nil {
+		return err
+	}
+	done()
+	return nil
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/labstack/echo/v4"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// siteContentSecurityPolicy Pages of websites are put into a unique origin,
+// so their scripts cannot reach the cookies, storage and API of this application.
+// They may only load their own files, and cannot send data anywhere, or be framed to trick users.
+const siteContentSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data:; connect-src 'none'; form-action 'none'; frame-ancestors 'none'; base-uri 'none'; " +
+	"sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+
+// ShareSiteRoot redirects to the root of a website, with the trailing slash relative links need.
+func ShareSiteRoot(c echo.Context) error {
+	target := "site/"
+	if c.QueryString() != "" {
+		target += "?" + c.QueryString()
+	}
+	return c.Redirect(http.StatusMovedPermanently, target)
+}
+
+func ShareSite(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	if cc.Share.Type != "directory" || !cc.Share.Site {
+		return echo.NewHTTPError(http.StatusNotFound, "website not found")
+	}
+
+	p := sharePathParam(c)
+	file, redirect, ok := oss.ResolveSiteFile(cc.Share.Files, p)
+	if redirect {
+		target := path.Base(p) + "/"
+		if c.QueryString() != "" {
+			target += "?" + c.QueryString()
+		}
+		return c.Redirect(http.StatusMovedPermanently, target)
+	}
+	if ok {
+		return serveSiteFile(cc, file, http.StatusOK)
+	}
+	if file, ok := oss.FindShareFile(cc.Share.Files, "404.html"); ok {
+		return serveSiteFile(cc, file, http.StatusNotFound)
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "page not found")
+}
+
+// serveSiteFile responds with a file of a website, which is displayed instead of downloaded.
+func serveSiteFile(cc context.CustomContext, file models.ShareFile, status int) error {
+	limited := cc.Share.MaxDownloads > 0
+
+	requestHeaders := make(http.Header)
+	if !limited && status == http.StatusOK {
+		cc.Response().Header().Set("Accept-Ranges", "bytes")
+		requestHeaders.Set("Range", cc.Request().Header.Get("Range"))
+	}
+	res, err := oss.GetShareContent(cc.Request().Context(), oss.GetShareContentOptions{
+		Name:    cc.Share.Name,
+		FileId:  file.Id,
+		Headers: requestHeaders,
+	})
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "page not found")
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	done, err := countDownload(cc, file.Id)
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(file.Path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := cc.Response().Header()
+	header.Set("Content-Security-Policy", siteContentSecurityPolicy)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Disposition", "inline")
+	if limited {
+		header.Set("Cache-Control", "no-store")
+	} else {
+		// pages may change along with the share
+		header.Set("Cache-Control", "no-cache")
+	}
+	if v := res.Headers.Get("Content-Length"); v != "" {
+		header.Set("Content-Length", v)
+	}
+	if v := res.Headers.Get("Content-Range"); v != "" {
+		header.Set("Content-Range", v)
+	}
+	if status == http.StatusOK {
+		status = res.StatusCode
+	}
+
+	if cc.Request().Method == http.MethodHead {
+		return cc.NoContent(status)
+	}
+	if err = cc.Stream(status, contentType, res.Body); err != nil {
+		return err
+	}
+	done()
+	return nil
+}
+
+// IsSitePath reports whether the request path is in a website, whose trailing slashes are meaningful.
+func IsSitePath(p string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 4)
+	return len(parts) == 4 && parts[0] == "s" && parts[2] == "site"
+}
@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/jingbh/simple-share/internal/utils"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+)
+
+func ShareGetTree(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	if cc.Share.Type != "directory" {
+		return echo.NewHTTPError(http.StatusConflict, "only directory shares have a file tree")
+	}
+
+	tree, ok := oss.GetShareTree(cc.Share.Files, c.QueryParam("path"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "directory not found")
+	}
+	return c.JSON(http.StatusOK, tree)
+}
+
+// sharePathParam returns the file path in the wildcard of the route.
+func sharePathParam(c echo.Context) string {
+	p := c.Param("*")
+	if c.Request().URL.RawPath != "" {
+		// the router matches the raw path if it is not the same as the decoded one
+		if unescaped, err := url.PathUnescape(p); err == nil {
+			p = unescaped
+		}
+	}
+	return p
+}
+
+func ShareGetPath(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	if cc.Share.Type != "directory" {
+		return echo.NewHTTPError(http.StatusConflict, "only directory shares have files")
+	}
+
+	file, ok := oss.FindShareFile(cc.Share.Files, sharePathParam(c))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "file not found")
+	}
+	return shareGetFile(cc, file.Id)
+}
+
+// ShareShowPath redirects a link to a file of a directory share, like `/s/<name>/path/<path>`, to the file.
+func ShareShowPath(c echo.Context) error {
+	name := c.Param("name")
+	if share, _ := oss.GetShareCached(c.Request().Context(), name); share != nil {
+		// resolve aliases
+		name = share.Name
+	}
+	target := "/api/shares/" + url.PathEscape(name) + "/path/" + (&url.URL{Path: sharePathParam(c)}).EscapedPath()
+	if c.QueryString() != "" {
+		target += "?" + c.QueryString()
+	}
+	return c.Redirect(http.StatusFound, utils.Url(target))
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// shareUpdateRequest Fields which are absent are left unchanged,
+// while an empty display name or password removes it.
+type shareUpdateRequest struct {
+	DisplayName *string    `json:"displayName"`
+	Password    *string    `json:"password" validate:"max_len:72"`
+	Expiry      *int       `json:"expiry" validate:"range:0,365"`
+	ExpiresIn   *int       `json:"expiresIn" validate:"range:60,31536000"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	Aliases     *[]string  `json:"aliases"`
+	Site        *bool      `json:"site"`
+}
+
+// maxShareAliases is how many aliases a share may have.
+const maxShareAliases = 10
+
+type shareRenameRequest struct {
+	Name string `json:"name" validate:"required|nameValid" message:"nameValid:invalid share name"`
+}
+
+func (r shareRenameRequest) NameValid(val string) bool {
+	return oss.CheckShareName(val)
+}
+
+// respondShare responds with the share after it has been changed.
+func respondShare(cc context.CustomContext, name string) error {
+	share, err := oss.GetShareCached(cc.Request().Context(), name)
+	if err != nil {
+		return err
+	}
+	return cc.JSON(http.StatusOK, share)
+}
+
+func ShareUpdate(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	req := new(shareUpdateRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt *time.Time
+	if t, ok, err := resolveShareExpiry(req.Expiry, req.ExpiresIn, req.ExpiresAt); err != nil {
+		return err
+	} else if ok {
+		expiresAt = &t
+	}
+
+	if req.Aliases != nil {
+		if len(*req.Aliases) > maxShareAliases {
+			return invalidField("aliases", "max_len", "too many aliases")
+		}
+		for i, alias := range *req.Aliases {
+			if slices.Contains((*req.Aliases)[:i], alias) {
+				return invalidField("aliases", "unique", "duplicate alias "+alias)
+			}
+		}
+	}
+
+	site := cc.Share.Site
+	if req.Site != nil {
+		site = *req.Site
+	}
+	hasPassword := cc.Share.Password != ""
+	if req.Password != nil {
+		hasPassword = *req.Password != ""
+	}
+	if site && cc.Share.Type != "directory" {
+		return invalidField("site", "siteValid", "only directory shares can be served as a website")
+	}
+	if site && hasPassword {
+		// the pages of a website cannot pass the password along
+		return invalidField("site", "siteValid", "websites cannot be protected by a password")
+	}
+
+	err = oss.UpdateShare(c.Request().Context(), oss.UpdateShareOptions{
+		Name:        cc.Share.Name,
+		DisplayName: req.DisplayName,
+		Password:    req.Password,
+		ExpiresAt:   expiresAt,
+		Aliases:     req.Aliases,
+		Site:        req.Site,
+	})
+	if errors.Is(err, oss.ErrShareNameUnavailable) {
+		return invalidField("aliases", "nameValid", "invalid or taken alias")
+	}
+	if errors.Is(err, oss.ErrPreconditionFailed) {
+		return echo.NewHTTPError(http.StatusConflict, "the share has been changed meanwhile, try again")
+	}
+	if err != nil {
+		return err
+	}
+
+	return respondShare(cc, cc.Share.Name)
+}
+
+func ShareRename(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	req := new(shareRenameRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+
+	err = oss.RenameShare(c.Request().Context(), cc.Share.Name, req.Name)
+	if errors.Is(err, oss.ErrShareNameUnavailable) {
+		// taken after the validation
+		return invalidField("name", "nameValid", "invalid share name")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"name": req.Name,
+	})
+}
@@ -1,25 +1,122 @@
 package controllers
 
 import (
+	"errors"
+	"github.com/jingbh/simple-share/app/context"
 	"github.com/jingbh/simple-share/internal/oss"
 	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
 	"net/http"
 	"strconv"
+	"time"
 )
 
+type uploadStartRequest struct {
+	Size int64 `json:"size" validate:"min:0"` // in bytes, if known
+}
+
+type uploadPartLinkRequest struct {
+	MD5 string `json:"md5" validate:"required"` // of the part in base64, which it must be uploaded with as `Content-MD5`
+}
+
+type uploadCompleteRequest struct {
+	SHA256 string `json:"sha256" validate:"regex:^[0-9a-fA-F]{64}$" message:"regex:invalid SHA-256 checksum"` // of the whole file in hex
+}
+
 type UploadStartResponse struct {
 	FileId   string `json:"id"`
 	PartSize int64  `json:"partSize"`
+	Direct   bool   `json:"direct,omitempty"` // upload the parts to the storage directly, by the links of `POST /api/upload/<id>/<part>/link`
+}
+
+type UploadPartLinkResponse struct {
+	PartNumber int    `json:"number"`
+	URL        string `json:"url"`
+}
+
+type UploadStatusResponse struct {
+	FileId    string               `json:"id"`
+	PartSize  int64                `json:"partSize"`
+	StartedAt time.Time            `json:"startedAt"`
+	Parts     []UploadPartResponse `json:"parts"`
+}
+
+type UploadPartResponse struct {
+	PartNumber int    `json:"number"`
+	Size       int64  `json:"size"`
+	ETag       string `json:"etag"`
+}
+
+// uploadError maps the errors of uploads to responses.
+func uploadError(err error) error {
+	switch {
+	case errors.Is(err, oss.ErrUploadNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "upload not found")
+	case errors.Is(err, oss.ErrUploadIncomplete):
+		return echo.NewHTTPError(http.StatusConflict, "some parts of the upload are missing")
+	case errors.Is(err, oss.ErrChecksumMismatch):
+		return echo.NewHTTPError(http.StatusBadRequest, "checksum mismatch")
+	default:
+		return err
+	}
+}
+
+// partChecksum returns the checksums of the uploaded part sent along, by `Content-MD5` in base64 or `X-Content-SHA256` in hex.
+func partChecksum(c echo.Context) (oss.PartChecksum, error) {
+	checksum := oss.PartChecksum{
+		MD5:    c.Request().Header.Get("Content-MD5"),
+		SHA256: c.Request().Header.Get("X-Content-SHA256"),
+	}
+	if !checksum.Valid() {
+		return checksum, echo.NewHTTPError(http.StatusBadRequest, "invalid checksum")
+	}
+	return checksum, nil
+}
+
+// checkPartBody checks the part is sent with its length, which the storage needs ahead.
+func checkPartBody(c echo.Context) error {
+	if c.Request().Body == nil || c.Request().ContentLength == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "empty body")
+	}
+	if c.Request().ContentLength < 0 {
+		return echo.NewHTTPError(http.StatusLengthRequired, "content length required")
+	}
+	return nil
+}
+
+// checkUploadOwner responds with 404 unless the upload is started by the user, as if it did not exist.
+func checkUploadOwner(c echo.Context, fileId string) error {
+	cc := c.(context.CustomContext)
+	return uploadError(oss.CheckUploadOwner(c.Request().Context(), cc.Token.Subject, fileId))
 }
 
 func UploadStart(c echo.Context) error {
-	fileId, err := oss.UploadInit(c.Request().Context())
+	cc := c.(context.CustomContext)
+	req := new(uploadStartRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+	if req.Size > oss.UploadMaxLength {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "upload too large")
+	}
+
+	fileId, err := oss.UploadInit(c.Request().Context(), cc.Token.Subject, req.Size)
 	if err != nil {
 		return err
 	}
 	return c.JSON(http.StatusOK, &UploadStartResponse{
 		FileId:   fileId,
 		PartSize: oss.UploadPartSize,
+		// if the storage cannot be accessed directly, the parts are uploaded through the server
+		Direct: viper.GetBool("oss.upload_direct") && oss.UploadDirectSupported(c.Request().Context()),
 	})
 }
 
@@ -29,21 +126,124 @@ func UploadPart(c echo.Context) error {
 	if err != nil || partNumber < 1 || partNumber > 10000 {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid part number")
 	}
-	if c.Request().Body == nil || c.Request().ContentLength == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "empty body")
+	if err = checkPartBody(c); err != nil {
+		return err
 	}
-	err = oss.UploadPart(c.Request().Context(), fileId, partNumber, c.Request().Body, c.Request().ContentLength)
+	checksum, err := partChecksum(c)
 	if err != nil {
 		return err
 	}
+	if err = checkUploadOwner(c, fileId); err != nil {
+		return err
+	}
+	err = oss.UploadPart(c.Request().Context(), fileId, partNumber, c.Request().Body, c.Request().ContentLength, checksum)
+	if err != nil {
+		return uploadError(err)
+	}
 	return c.NoContent(http.StatusCreated)
 }
 
+func UploadPartLink(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	partNumber, err := strconv.Atoi(c.Param("part"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid part number")
+	}
+	req := new(uploadPartLinkRequest)
+	err = cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
+	if err != nil {
+		return err
+	}
+	if !(oss.PartChecksum{MD5: req.MD5}).Valid() {
+		return invalidField("md5", "md5", "invalid MD5 checksum")
+	}
+	if !viper.GetBool("oss.upload_direct") {
+		return echo.NewHTTPError(http.StatusForbidden, "direct upload is not enabled")
+	}
+	if err = checkUploadOwner(c, c.Param("id")); err != nil {
+		return err
+	}
+
+	url, err := oss.SignUploadPart(c.Request().Context(), c.Param("id"), partNumber, req.MD5)
+	if errors.Is(err, oss.ErrNotSupported) {
+		return echo.NewHTTPError(http.StatusForbidden, "direct upload is not enabled")
+	}
+	if err != nil {
+		return uploadError(err)
+	}
+	return c.JSON(http.StatusOK, &UploadPartLinkResponse{
+		PartNumber: partNumber,
+		URL:        url,
+	})
+}
+
 func UploadComplete(c echo.Context) error {
-	fileId := c.Param("id")
-	err := oss.UploadComplete(c.Request().Context(), fileId)
+	cc := c.(context.CustomContext)
+	req := new(uploadCompleteRequest)
+	err := cc.Bind(req)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusBadRequest,
+			Internal: err,
+		}
+	}
+	err = cc.Validate(req)
 	if err != nil {
 		return err
 	}
+
+	if err = checkUploadOwner(c, c.Param("id")); err != nil {
+		return err
+	}
+	err = oss.UploadComplete(c.Request().Context(), c.Param("id"), req.SHA256)
+	if err != nil {
+		return uploadError(err)
+	}
 	return c.NoContent(http.StatusCreated)
 }
+
+func UploadStatus(c echo.Context) error {
+	if err := checkUploadOwner(c, c.Param("id")); err != nil {
+		return err
+	}
+	return uploadStatus(c, c.Param("id"))
+}
+
+func uploadStatus(c echo.Context, fileId string) error {
+	status, err := oss.GetUploadStatus(c.Request().Context(), fileId)
+	if err != nil {
+		return uploadError(err)
+	}
+	res := &UploadStatusResponse{
+		FileId:    status.FileId,
+		PartSize:  oss.UploadPartSize,
+		StartedAt: status.StartedAt,
+		Parts:     make([]UploadPartResponse, 0, len(status.Parts)),
+	}
+	for _, part := range status.Parts {
+		res.Parts = append(res.Parts, UploadPartResponse{
+			PartNumber: part.PartNumber,
+			Size:       part.Size,
+			ETag:       part.ETag,
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func UploadAbort(c echo.Context) error {
+	if err := checkUploadOwner(c, c.Param("id")); err != nil {
+		return err
+	}
+	err := oss.UploadAbort(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return uploadError(err)
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/app/middlewares"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/jingbh/simple-share/internal/utils"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+// tusError maps the errors of stream uploads to responses.
+func tusError(err error) error {
+	switch {
+	case errors.Is(err, oss.ErrUploadNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "upload not found")
+	case errors.Is(err, oss.ErrUploadOffsetMismatch):
+		return echo.NewHTTPError(http.StatusConflict, "upload offset mismatch")
+	case errors.Is(err, oss.ErrUploadTooLarge):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "upload too large")
+	default:
+		return err
+	}
+}
+
+func setTusUploadHeaders(c echo.Context, upload *oss.StreamUpload) {
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.ExpiresAt != nil {
+		c.Response().Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+func TusOptions(c echo.Context) error {
+	c.Response().Header().Set("Tus-Version", middlewares.TusVersion)
+	c.Response().Header().Set("Tus-Extension", "creation,expiration,termination")
+	c.Response().Header().Set("Tus-Max-Size", strconv.FormatInt(oss.UploadMaxLength, 10))
+	return c.NoContent(http.StatusNoContent)
+}
+
+func TusCreate(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	if c.Request().Header.Get("Upload-Defer-Length") != "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "the length of the upload must be known")
+	}
+	length, err := strconv.ParseInt(c.Request().Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid upload length")
+	}
+	upload, err := oss.StreamUploadInit(c.Request().Context(), cc.Token.Subject, length)
+	if err != nil {
+		return tusError(err)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, utils.Url("/api/tus/"+upload.FileId))
+	if upload.ExpiresAt != nil {
+		c.Response().Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+func TusHead(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	upload, err := oss.GetStreamUpload(c.Request().Context(), cc.Token.Subject, c.Param("id"))
+	if err != nil {
+		return tusError(err)
+	}
+	setTusUploadHeaders(c, upload)
+	c.Response().Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.NoContent(http.StatusOK)
+}
+
+func TusPatch(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	if c.Request().Header.Get(echo.HeaderContentType) != "application/offset+octet-stream" {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "invalid content type")
+	}
+	offset, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid upload offset")
+	}
+	upload, err := oss.StreamUploadWrite(c.Request().Context(), cc.Token.Subject, c.Param("id"), offset, c.Request().Body)
+	if err != nil {
+		return tusError(err)
+	}
+	setTusUploadHeaders(c, upload)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func TusDelete(c echo.Context) error {
+	cc := c.(context.CustomContext)
+	err := oss.TerminateStreamUpload(c.Request().Context(), cc.Token.Subject, c.Param("id"))
+	if err != nil {
+		return tusError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
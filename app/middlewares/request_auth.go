@@ -0,0 +1,62 @@
+package middlewares
+
+import (
+	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/internal/utils"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"time"
+)
+
+func RequestAuthenticated(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cc := c.(context.CustomContext)
+
+		if cc.FileRequest == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "file request not found")
+		}
+
+		if cc.FileRequest.ExpiresAt != nil && !cc.FileRequest.ExpiresAt.After(time.Now()) {
+			// not deleted by the sweeper yet
+			return echo.NewHTTPError(http.StatusGone, "this file request has expired")
+		}
+
+		if cc.Token != nil && cc.FileRequest.Creator != nil && cc.FileRequest.Creator.Subject == cc.Token.Subject {
+			// is owner, skip authentication
+			return next(c)
+		}
+
+		if cc.FileRequest.Password != "" {
+			password := c.QueryParam("password")
+			if password == "" {
+				password = c.Request().Header.Get("X-Share-Password")
+			}
+			if password == "" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "this file request requires password to access")
+			}
+			err := utils.VerifyPassword(password, cc.FileRequest.Password)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid password")
+			}
+		}
+
+		return next(c)
+	}
+}
+
+func RequestAuthorized(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cc := c.(context.CustomContext)
+
+		if cc.FileRequest == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "file request not found")
+		}
+
+		if cc.Token != nil && cc.FileRequest.Creator != nil && cc.FileRequest.Creator.Subject == cc.Token.Subject {
+			// is owner, grant access
+			return next(c)
+		}
+
+		return echo.NewHTTPError(http.StatusForbidden, "you are not authorized to do this operation on this file request")
+	}
+}
@@ -1,10 +1,13 @@
 package middlewares
 
 import (
+	"errors"
 	"github.com/jingbh/simple-share/app/context"
+	"github.com/jingbh/simple-share/internal/oss"
 	"github.com/jingbh/simple-share/internal/utils"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"time"
 )
 
 func ShareAuthenticated(next echo.HandlerFunc) echo.HandlerFunc {
@@ -15,16 +18,18 @@ func ShareAuthenticated(next echo.HandlerFunc) echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusNotFound, "share not found")
 		}
 
+		if cc.Share.ExpiresAt != nil && !cc.Share.ExpiresAt.After(time.Now()) {
+			// not deleted by the sweeper yet
+			return echo.NewHTTPError(http.StatusGone, "this share has expired")
+		}
+
+		password := sharePassword(c)
 		if cc.Token != nil && cc.Share.Creator != nil && cc.Share.Creator.Subject == cc.Token.Subject {
 			// is owner, skip authentication
-			return next(c)
+			return shareKeyError(next(c))
 		}
 
 		if cc.Share.Password != "" {
-			password := c.QueryParam("password")
-			if password == "" {
-				password = c.Request().Header.Get("X-Share-Password")
-			}
 			if password == "" {
 				return echo.NewHTTPError(http.StatusUnauthorized, "this share requires password to access")
 			}
@@ -34,7 +39,16 @@ func ShareAuthenticated(next echo.HandlerFunc) echo.HandlerFunc {
 			}
 		}
 
-		return next(c)
+		// the downloads of the owner are not counted, so the limit does not apply to them either
+		exhausted, err := oss.ShareDownloadsExhausted(c.Request().Context(), cc.Share)
+		if err != nil {
+			return err
+		}
+		if exhausted {
+			return echo.NewHTTPError(http.StatusGone, "this share has reached its download limit")
+		}
+
+		return shareKeyError(next(c))
 	}
 }
 
@@ -48,9 +62,32 @@ func ShareAuthorized(next echo.HandlerFunc) echo.HandlerFunc {
 
 		if cc.Token != nil && cc.Share.Creator != nil && cc.Share.Creator.Subject == cc.Token.Subject {
 			// is owner, grant access
-			return next(c)
+			// changing an encrypted share may need its password
+			sharePassword(c)
+			return shareKeyError(next(c))
 		}
 
 		return echo.NewHTTPError(http.StatusForbidden, "you are not authorized to do this operation on this share")
 	}
 }
+
+// sharePassword returns the password given to access the share, and keeps it in the context of the request,
+// as it also decrypts the shares whose keys are wrapped by their passwords.
+func sharePassword(c echo.Context) string {
+	password := c.QueryParam("password")
+	if password == "" {
+		password = c.Request().Header.Get("X-Share-Password")
+	}
+	if password != "" {
+		c.SetRequest(c.Request().WithContext(oss.WithSharePassword(c.Request().Context(), password)))
+	}
+	return password
+}
+
+// shareKeyError converts the error of decrypting a share without its password into a response.
+func shareKeyError(err error) error {
+	if errors.Is(err, oss.ErrSharePasswordRequired) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "this share is encrypted with its password, which is required")
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package middlewares
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// TusVersion is the version of the tus resumable upload protocol supported.
+const TusVersion = "1.0.0"
+
+// TusResumable checks the protocol version of tus requests, and marks the responses with it.
+func TusResumable(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Tus-Resumable", TusVersion)
+		if c.Request().Method != http.MethodOptions && c.Request().Header.Get("Tus-Resumable") != TusVersion {
+			c.Response().Header().Set("Tus-Version", TusVersion)
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "unsupported tus version")
+		}
+		return next(c)
+	}
+}
@@ -9,10 +9,21 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/spf13/viper"
 	"net/url"
+	"strings"
 )
 
 func RegisterRoutes(e *echo.Echo) {
-	e.Pre(middleware.RemoveTrailingSlash())
+	e.Pre(middleware.RemoveTrailingSlashWithConfig(middleware.TrailingSlashConfig{
+		Skipper: func(c echo.Context) bool {
+			return controllers.IsSitePath(c.Request().URL.Path)
+		},
+	}))
+	e.Pre(middleware.MethodOverrideWithConfig(middleware.MethodOverrideConfig{
+		// tus clients may send PATCH and DELETE requests as POST, when the former are blocked
+		Skipper: func(c echo.Context) bool {
+			return !strings.HasPrefix(c.Request().URL.Path, "/api/tus/")
+		},
+	}))
 	e.Use(middleware.Recover())
 	e.Use(context.ExtractContext)
 
@@ -29,19 +40,50 @@ func RegisterRoutes(e *echo.Echo) {
 	g.GET("shares/:name/content", controllers.ShareGetFile, middlewares.ShareAuthenticated)
 	g.GET("shares/:name/content/type", controllers.ShareGetFileType, middlewares.ShareAuthenticated)
 	g.GET("shares/:name/content/preview", controllers.ShareGetFilePreview, middlewares.ShareAuthenticated)
+	g.GET("shares/:name/archive", controllers.ShareGetArchive, middlewares.ShareAuthenticated)
+	g.GET("shares/:name/tree", controllers.ShareGetTree, middlewares.ShareAuthenticated)
+	g.HEAD("shares/:name/path/*", controllers.ShareGetPath, middlewares.ShareAuthenticated)
+	g.GET("shares/:name/path/*", controllers.ShareGetPath, middlewares.ShareAuthenticated)
 	g.HEAD("shares/:name/files/:file", controllers.ShareGetFile, middlewares.ShareAuthenticated)
 	g.GET("shares/:name/files/:file", controllers.ShareGetFile, middlewares.ShareAuthenticated)
 	g.GET("shares/:name/files/:file/type", controllers.ShareGetFileType, middlewares.ShareAuthenticated)
 	g.GET("shares/:name/files/:file/preview", controllers.ShareGetFilePreview, middlewares.ShareAuthenticated)
+	g.PATCH("shares/:name", controllers.ShareUpdate, middlewares.ShareAuthorized)
+	g.POST("shares/:name/rename", controllers.ShareRename, middlewares.ShareAuthorized)
+	g.POST("shares/:name/files", controllers.ShareAddFiles, middlewares.ShareAuthorized)
+	g.PATCH("shares/:name/files/:file", controllers.ShareMoveFile, middlewares.ShareAuthorized)
+	g.DELETE("shares/:name/files/:file", controllers.ShareRemoveFile, middlewares.ShareAuthorized)
 	g.DELETE("shares/:name", controllers.ShareDelete, middlewares.ShareAuthorized)
 	g.GET("shares", controllers.ShareList, middlewares.Authenticated)
 	g.POST("shares", controllers.ShareCreate, middlewares.Authenticated)
 
 	g.POST("upload", controllers.UploadStart, middlewares.Authenticated)
 	g.POST("upload/:id/:part", controllers.UploadPart, middlewares.Authenticated)
+	g.POST("upload/:id/:part/link", controllers.UploadPartLink, middlewares.Authenticated)
 	g.POST("upload/:id/complete", controllers.UploadComplete, middlewares.Authenticated)
+	g.GET("upload/:id", controllers.UploadStatus, middlewares.Authenticated)
+	g.DELETE("upload/:id", controllers.UploadAbort, middlewares.Authenticated)
+	g.OPTIONS("tus", controllers.TusOptions, middlewares.TusResumable)
+	g.POST("tus", controllers.TusCreate, middlewares.TusResumable, middlewares.Authenticated)
+	g.HEAD("tus/:id", controllers.TusHead, middlewares.TusResumable, middlewares.Authenticated)
+	g.PATCH("tus/:id", controllers.TusPatch, middlewares.TusResumable, middlewares.Authenticated)
+	g.DELETE("tus/:id", controllers.TusDelete, middlewares.TusResumable, middlewares.Authenticated)
+
+	g.GET("requests/:id", controllers.RequestGet, middlewares.RequestAuthenticated)
+	g.POST("requests/:id/upload", controllers.RequestUploadStart, middlewares.RequestAuthenticated)
+	g.POST("requests/:id/upload/:file/:part", controllers.RequestUploadPart, middlewares.RequestAuthenticated)
+	g.POST("requests/:id/upload/:file/complete", controllers.RequestUploadComplete, middlewares.RequestAuthenticated)
+	g.GET("requests/:id/upload/:file", controllers.RequestUploadStatus, middlewares.RequestAuthenticated)
+	g.DELETE("requests/:id/upload/:file", controllers.RequestUploadAbort, middlewares.RequestAuthenticated)
+	g.DELETE("requests/:id", controllers.RequestDelete, middlewares.RequestAuthorized)
+	g.GET("requests", controllers.RequestList, middlewares.Authenticated)
+	g.POST("requests", controllers.RequestCreate, middlewares.Authenticated)
 
 	e.GET("s/:name", controllers.ShareShow)
+	e.GET("s/:name/path/*", controllers.ShareShowPath)
+	e.GET("s/:name/site", controllers.ShareSiteRoot)
+	e.HEAD("s/:name/site/*", controllers.ShareSite, middlewares.ShareAuthenticated)
+	e.GET("s/:name/site/*", controllers.ShareSite, middlewares.ShareAuthenticated)
 
 	if viper.GetBool("embed.disable") {
 		frontendUrl, err := url.Parse("http://localhost:5173")
@@ -53,6 +95,11 @@ func RegisterRoutes(e *echo.Echo) {
 		}})))
 	} else {
 		e.Use(middleware.StaticWithConfig(middleware.StaticConfig{
+			Skipper: func(c echo.Context) bool {
+				// the wildcard of these routes would be served from the assets otherwise
+				p := c.Request().URL.Path
+				return strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/s/")
+			},
 			Filesystem: web.HttpFs(),
 		}))
 	}
@@ -14,12 +14,27 @@ func InitConfig() {
 	viper.BindEnv("serve.port", "PORT")
 	viper.BindEnv("oss.access_key_id", "ALIBABA_CLOUD_ACCESS_KEY_ID")
 	viper.BindEnv("oss.access_key_secret", "ALIBABA_CLOUD_ACCESS_KEY_SECRET")
+	viper.BindEnv("s3.access_key_id", "AWS_ACCESS_KEY_ID")
+	viper.BindEnv("s3.access_key_secret", "AWS_SECRET_ACCESS_KEY")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
 	viper.SetDefault("debug", false)
 	viper.SetDefault("serve.port", 8080)
 	viper.SetDefault("oidc.name_claim", "username")
+	viper.SetDefault("share.delete_exhausted", false)
+	viper.SetDefault("archive.max_entries", 1000)
+	viper.SetDefault("archive.max_size", 4<<30)
+	viper.SetDefault("notify.webhook", "")
+	viper.SetDefault("storage.driver", "aliyun")
+	viper.SetDefault("storage.dedup", false)
+	viper.SetDefault("encryption.master_key", "")
+	viper.SetDefault("gc.interval", "6h")
+	viper.SetDefault("gc.dry_run", false)
 	viper.SetDefault("oss.download_direct", false)
+	viper.SetDefault("oss.upload_direct", false)
+	viper.SetDefault("local.root", "data")
+	viper.SetDefault("s3.path_style", false)
+	viper.SetDefault("s3.lifecycle", false)
 
 	if viper.GetBool("debug") {
 		viper.SetDefault("serve.host", "localhost")
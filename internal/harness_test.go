@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/jingbh/simple-share/internal/oidc"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/spf13/viper"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testClientId = "simple-share-test"
+
+// fakeOIDCProvider An OIDC provider which serves discovery and keys, and issues ID tokens for any subject.
+type fakeOIDCProvider struct {
+	server *httptest.Server
+	signer jose.Signer
+}
+
+func newFakeOIDCProvider() (*fakeOIDCProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: "test", Algorithm: string(jose.RS256)},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &fakeOIDCProvider{
+		signer: signer,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     "test",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}})
+	})
+	p.server = httptest.NewServer(mux)
+	return p, nil
+}
+
+// Token issues an ID token for the given subject, which is valid for an hour.
+func (p *fakeOIDCProvider) Token(t *testing.T, subject string) string {
+	t.Helper()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":      p.server.URL,
+		"aud":      testClientId,
+		"sub":      subject,
+		"iat":      time.Now().Unix(),
+		"exp":      time.Now().Add(time.Hour).Unix(),
+		"username": subject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := p.signer.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+var testProvider *fakeOIDCProvider
+var testServer *httptest.Server
+
+func TestMain(m *testing.M) {
+	var err error
+	testProvider, err = newFakeOIDCProvider()
+	if err != nil {
+		panic(err)
+	}
+
+	InitConfig()
+	viper.Set("storage.driver", "memory")
+	viper.Set("embed.disable", false)
+	viper.Set("oidc.issuer", testProvider.server.URL)
+	viper.Set("oidc.client_id", testClientId)
+	oidc.InitOIDC()
+	if !oidc.Enabled {
+		panic("failed to configure the fake OIDC provider")
+	}
+
+	if err = oss.OpenIndex(); err != nil {
+		panic(err)
+	}
+	testServer = httptest.NewServer(NewServer())
+	code := m.Run()
+	testServer.Close()
+	testProvider.server.Close()
+	os.Exit(code)
+}
+
+type testRequest struct {
+	Method  string
+	Path    string
+	Token   string
+	Json    interface{}
+	Body    []byte
+	Headers map[string]string
+}
+
+type testResponse struct {
+	*http.Response
+	Body []byte
+}
+
+// Json decodes the response body into `v`.
+func (r *testResponse) Json(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("invalid response body %q: %v", r.Body, err)
+	}
+}
+
+func doRequest(t *testing.T, req testRequest) *testResponse {
+	t.Helper()
+
+	var body io.Reader
+	if req.Json != nil {
+		data, err := json.Marshal(req.Json)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(data)
+	} else if req.Body != nil {
+		body = bytes.NewReader(req.Body)
+	}
+
+	httpReq, err := http.NewRequest(req.Method, testServer.URL+req.Path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Json != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if req.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+req.Token)
+	}
+	for k, v := range req.Headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testResponse{
+		Response: res,
+		Body:     resBody,
+	}
+}
+
+// expectStatus fails the test if the response does not have the expected status code.
+func expectStatus(t *testing.T, res *testResponse, code int) {
+	t.Helper()
+	if res.StatusCode != code {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", res.Request.Method, res.Request.URL.Path, code, res.StatusCode, res.Body)
+	}
+}
+
+// uploadFile uploads `content` through the multipart upload API in parts of `partSize` bytes,
+// and returns the file id.
+func uploadFile(t *testing.T, token string, content []byte, partSize int) string {
+	t.Helper()
+
+	res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: token})
+	expectStatus(t, res, http.StatusOK)
+	var upload struct {
+		Id string `json:"id"`
+	}
+	res.Json(t, &upload)
+
+	for part := 0; part*partSize < len(content); part++ {
+		end := min((part+1)*partSize, len(content))
+		res = doRequest(t, testRequest{
+			Method: http.MethodPost,
+			Path:   "/api/upload/" + upload.Id + "/" + strconv.Itoa(part+1),
+			Token:  token,
+			Body:   content[part*partSize : end],
+		})
+		expectStatus(t, res, http.StatusCreated)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/complete", Token: token})
+	expectStatus(t, res, http.StatusCreated)
+	return upload.Id
+}
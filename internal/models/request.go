@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// FileRequest A link for anyone, without an account, to upload files into a directory share of the creator.
+type FileRequest struct {
+	Id          string           `json:"id"`
+	Share       string           `json:"share"` // name of the directory share receiving the files
+	DisplayName string           `json:"displayName,omitempty"`
+	Password    string           `json:"password,omitempty"` // hashed password
+	CreatedAt   *time.Time       `json:"createdAt,omitempty"`
+	ExpiresAt   *time.Time       `json:"expiresAt,omitempty"`
+	MaxFiles    int              `json:"maxFiles,omitempty"` // 0 means unlimited
+	MaxSize     int64            `json:"maxSize,omitempty"`  // total size in bytes, 0 means unlimited
+	FileCount   int              `json:"fileCount"`          // files received so far
+	Size        int64            `json:"size"`               // total size received so far
+	Uploads     map[string]int64 `json:"uploads,omitempty"`  // bytes reserved by the files being uploaded, by their ids
+	Creator     *ShareCreator    `json:"creator,omitempty"`
+}
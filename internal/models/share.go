@@ -5,22 +5,45 @@ import (
 )
 
 type Share struct {
-	Type        string        `json:"type"` // `file`, `directory`, `text`, `url`
-	Name        string        `json:"name"`
-	DisplayName string        `json:"displayName,omitempty"`
-	Password    string        `json:"password,omitempty"` // hashed password
-	Expiry      int           `json:"expiry,omitempty"`
-	Size        int64         `json:"size"`
-	CreatedAt   *time.Time    `json:"createdAt,omitempty"`
-	ExpiresAt   *time.Time    `json:"expiresAt,omitempty"`
-	Files       ShareFiles    `json:"files,omitempty"`
-	Creator     *ShareCreator `json:"creator,omitempty"`
+	Type          string        `json:"type"` // `file`, `directory`, `text`, `url`
+	Name          string        `json:"name"`
+	DisplayName   string        `json:"displayName,omitempty"`
+	Password      string        `json:"password,omitempty"` // hashed password
+	Expiry        int           `json:"expiry,omitempty"`   // lifecycle period in days, as a backstop of ExpiresAt
+	Size          int64         `json:"size"`
+	CreatedAt     *time.Time    `json:"createdAt,omitempty"`
+	ExpiresAt     *time.Time    `json:"expiresAt,omitempty"`
+	Files         ShareFiles    `json:"files,omitempty"`
+	Creator       *ShareCreator `json:"creator,omitempty"`
+	Aliases       []string      `json:"aliases,omitempty"`       // other names resolving to this share
+	MaxDownloads  int           `json:"maxDownloads,omitempty"`  // of the content, or each file of a directory
+	BurnAfterRead bool          `json:"burnAfterRead,omitempty"` // deleted once the downloads are exhausted
+	Site          bool          `json:"site,omitempty"`          // directory served as a static website
+	Encrypted     bool          `json:"encrypted,omitempty"`     // content encrypted in the storage
 }
 
-type ShareFiles []struct {
-	Id   string `json:"id"`
-	Path string `json:"path"`
-	Size int64  `json:"size"`
+type ShareFiles []ShareFile
+
+type ShareFile struct {
+	Id     string `json:"id"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"` // in hex, if hashed when uploaded
+}
+
+// ShareTree One level of the file tree of a directory share.
+type ShareTree struct {
+	Path        string               `json:"path"` // empty for the root
+	Directories []ShareTreeDirectory `json:"directories"`
+	Files       ShareFiles           `json:"files"`
+}
+
+// ShareTreeDirectory A directory in the file tree, with the size and the count of all files under it.
+type ShareTreeDirectory struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	FileCount int    `json:"fileCount"`
 }
 
 type ShareCreator struct {
@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/spf13/viper"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Event Something the owner of a share or file request should know about.
+type Event struct {
+	Type  string               `json:"type"` // like `request.upload`
+	Time  time.Time            `json:"time"`
+	Owner *models.ShareCreator `json:"owner,omitempty"`
+	Data  interface{}          `json:"data,omitempty"`
+}
+
+var client = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// Send posts the event as JSON to the configured webhook in the background.
+// It does nothing if no webhook is configured, and failures are only logged.
+func Send(event Event) {
+	url := viper.GetString("notify.webhook")
+	if url == "" {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	go func() {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Println("Failed to encode notification: ", err)
+			return
+		}
+		res, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("Failed to send notification: ", err)
+			return
+		}
+		_ = res.Body.Close()
+		if res.StatusCode >= 300 {
+			log.Printf("Failed to send notification: webhook responded %s\n", res.Status)
+		}
+	}()
+}
@@ -0,0 +1,129 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/spf13/viper"
+	"strconv"
+	"time"
+)
+
+// Files of uploads hashed by the server may be kept once in `blobs/<sha256>`, as content-addressed blobs,
+// when `storage.dedup` is enabled. The shares of such a file are then empty objects,
+// whose `Share-Blob` metadata refers to the blob, and `Share-Blob-Size` is the size of the blob.
+// The references are not counted, but found by the garbage collector, which deletes the blobs no share refers to,
+// so files are only deduplicated while the garbage collector runs and deletes garbage.
+// `blobs/<sha256>.json` records when the blob was last referred to, so it is not collected meanwhile.
+
+type blobAcquired struct {
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+func blobKey(sum string) string {
+	return "blobs/" + sum
+}
+
+func blobAcquiredKey(sum string) string {
+	return "blobs/" + sum + ".json"
+}
+
+// dedupEnabled reports whether files are kept in blobs, which encrypted shares cannot refer to, as they have their own keys.
+// Blobs are never deleted unless the garbage collector runs without `gc.dry_run`, so files are not deduplicated otherwise.
+func dedupEnabled() bool {
+	return viper.GetBool("storage.dedup") && !encryptionEnabled() &&
+		viper.GetDuration("gc.interval") > 0 && !viper.GetBool("gc.dry_run")
+}
+
+// acquireBlob prepares the blob to be referred to by a share, and returns its size.
+// If the blob does not exist yet, it is copied from `source` first, unless `source` is empty.
+func acquireBlob(ctx context.Context, sum string, source string) (int64, error) {
+	client := Client()
+
+	// recorded first, so the garbage collector keeps the blob from now on
+	data, err := json.Marshal(&blobAcquired{AcquiredAt: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	err = client.PutObject(ctx, blobAcquiredKey(sum), bytes.NewReader(data), PutOptions{
+		ContentType: "application/json",
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	meta, err := client.HeadObject(ctx, blobKey(sum))
+	if errors.Is(err, ErrObjectNotFound) && source != "" {
+		err = client.CopyObject(ctx, source, blobKey(sum), PutOptions{
+			ContentType: "application/octet-stream",
+		})
+		if err == nil {
+			meta, err = client.HeadObject(ctx, blobKey(sum))
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return meta.Size, nil
+}
+
+// putBlobShare creates the share object of `options`, referring to the blob of the uploaded file,
+// which is created if it does not exist yet.
+func putBlobShare(ctx context.Context, options CreateShareOptions, putOptions PutOptions) error {
+	size, err := acquireBlob(ctx, options.SHA256, "uploads/"+options.Source)
+	if err != nil {
+		return err
+	}
+	putOptions.Metadata["Share-Blob"] = options.SHA256
+	putOptions.Metadata["Share-Blob-Size"] = strconv.FormatInt(size, 10)
+	return Client().PutObject(ctx, "shares/"+options.Path, bytes.NewReader(nil), putOptions)
+}
+
+// shareObjectSize returns the size of the content of a share object, which may be in a blob, or encrypted.
+func shareObjectSize(meta *ObjectMeta) int64 {
+	if meta.Meta("Share-Blob") != "" {
+		size, _ := strconv.ParseInt(meta.Meta("Share-Blob-Size"), 10, 64)
+		return size
+	}
+	if meta.Meta("Share-Nonce") != "" {
+		return decryptedSize(meta.Size)
+	}
+	return meta.Size
+}
+
+// resolveShareObject returns the key where the content of a share object is, which differs if it is in a blob,
+// and the share object.
+func resolveShareObject(ctx context.Context, key string) (string, *ObjectMeta, error) {
+	meta, err := Client().HeadObject(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	if sum := meta.Meta("Share-Blob"); sum != "" {
+		return blobKey(sum), meta, nil
+	}
+	return key, meta, nil
+}
+
+// getShareObject reads the content of a share object, which may be in a blob, or encrypted.
+func getShareObject(ctx context.Context, key string, options GetOptions) (*ObjectResponse, error) {
+	target, meta, err := resolveShareObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Meta("Share-Nonce") != "" {
+		return getEncryptedObject(ctx, key, meta, options)
+	}
+	res, err := Client().GetObject(ctx, target, options)
+	if err != nil || target == key {
+		return res, err
+	}
+	// the blob is shared, so the attributes of the share are on the share object only
+	if meta.ContentDisposition != "" {
+		res.Headers.Set("Content-Disposition", meta.ContentDisposition)
+	}
+	if meta.CacheControl != "" {
+		res.Headers.Set("Cache-Control", meta.CacheControl)
+	}
+	return res, nil
+}
@@ -1,64 +1,45 @@
 package oss
 
 import (
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"context"
+	"fmt"
 	"github.com/spf13/viper"
-	"regexp"
-	"strings"
 	"sync"
 )
 
-func newClient(internal bool) (*oss.Bucket, error) {
-	endpoint := viper.GetString("oss.endpoint")
-	if !internal {
-		endpointPublic := viper.GetString("oss.endpoint_public")
-		if endpointPublic != "" {
-			endpoint = endpointPublic
+func newStorage(driver string) (Storage, error) {
+	switch driver {
+	case "aliyun", "":
+		return newAliyunStorage()
+	case "local":
+		storage, err := newLocalStorage(viper.GetString("local.root"))
+		if err != nil {
+			return nil, err
 		}
-	}
-	akId := viper.GetString("oss.access_key_id")
-	akSecret := viper.GetString("oss.access_key_secret")
-	cname := !strings.Contains(endpoint, "aliyuncs")
-
-	region := viper.GetString("oss.region")
-	if region == "" && !cname {
-		// try to guess region from endpoint
-		pattern := `oss-(?:accelerate|(.+?))(?:-internal)?.aliyuncs.com`
-		regex, err := regexp.Compile(pattern)
-		if err == nil {
-			matches := regex.FindStringSubmatch(endpoint)
-			if len(matches) > 1 {
-				region = matches[1]
+		storage.startSweeper()
+		return storage, nil
+	case "memory":
+		return newMemoryStorage(), nil
+	case "s3":
+		storage, err := newS3Storage()
+		if err != nil {
+			return nil, err
+		}
+		if viper.GetBool("s3.lifecycle") {
+			if err = storage.ensureLifecycle(context.Background()); err != nil {
+				return nil, err
 			}
 		}
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %s", driver)
 	}
-
-	ossOptions := []oss.ClientOption{
-		oss.AuthVersion(oss.AuthV4),
-		oss.UseCname(cname),
-		oss.Region(region),
-	}
-	client, err := oss.New(endpoint, akId, akSecret, ossOptions...)
-	if err != nil {
-		return nil, err
-	}
-
-	bucket := viper.GetString("oss.bucket")
-	return client.Bucket(bucket)
 }
 
-var Client = sync.OnceValue(func() *oss.Bucket {
-	bucket, err := newClient(true)
-	if err != nil {
-		panic(err)
-	}
-	return bucket
-})
-
-var PublicClient = sync.OnceValue(func() *oss.Bucket {
-	bucket, err := newClient(false)
+var Client = sync.OnceValue(func() Storage {
+	storage, err := newStorage(viper.GetString("storage.driver"))
 	if err != nil {
 		panic(err)
 	}
-	return bucket
+	return storage
 })
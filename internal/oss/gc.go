@@ -0,0 +1,525 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/spf13/viper"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcGracePeriod is how long objects are left alone after they are written,
+// as they may be part of a share being created, like the files of a directory share written before its tree.
+const gcGracePeriod = time.Hour
+
+// GCOptions Options of a garbage collection.
+type GCOptions struct {
+	DryRun bool      // only report what would be done
+	Now    time.Time // collect as of this time instead of the current time
+}
+
+// GCAction Something the garbage collector found, and did unless it is a dry run.
+type GCAction struct {
+	Action string // `abort`, `delete`, `repair`, or `report` if it cannot be repaired
+	Key    string
+	Reason string
+}
+
+type GCReport struct {
+	DryRun  bool
+	Actions []GCAction
+}
+
+// Count returns the number of actions of the kind.
+func (r *GCReport) Count(action string) int {
+	count := 0
+	for _, a := range r.Actions {
+		if a.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+type garbageCollector struct {
+	ctx     context.Context
+	options GCOptions
+	report  *GCReport
+	client  Storage
+
+	shares   map[string]*ObjectMeta  // share objects by share name
+	children map[string][]ObjectInfo // files of directory shares by share name
+	trees    map[string]models.ShareFiles
+}
+
+// CollectGarbage removes the objects no longer used by any share or upload, and repairs inconsistent shares.
+// Those which cannot be repaired are only reported.
+func CollectGarbage(ctx context.Context, options GCOptions) (*GCReport, error) {
+	if options.Now.IsZero() {
+		options.Now = time.Now()
+	}
+	gc := &garbageCollector{
+		ctx:      ctx,
+		options:  options,
+		report:   &GCReport{DryRun: options.DryRun},
+		client:   Client(),
+		shares:   make(map[string]*ObjectMeta),
+		children: make(map[string][]ObjectInfo),
+		trees:    make(map[string]models.ShareFiles),
+	}
+	for _, step := range []func() error{
+		gc.collectMultipartUploads,
+		gc.collectUploads,
+		gc.scanShares,
+		gc.collectIndex,
+		gc.collectShareFiles,
+		gc.repairShareTrees,
+		gc.collectDownloads,
+		gc.collectAliases,
+		gc.collectFileRequests,
+		gc.collectBlobs,
+	} {
+		if err := step(); err != nil {
+			return gc.report, err
+		}
+	}
+	return gc.report, nil
+}
+
+// do records the action, after running it unless it is a dry run.
+func (gc *garbageCollector) do(action GCAction, run func() error) error {
+	if !gc.options.DryRun && run != nil {
+		if err := run(); err != nil {
+			return err
+		}
+	}
+	gc.report.Actions = append(gc.report.Actions, action)
+	return nil
+}
+
+func (gc *garbageCollector) delete(objects []ObjectInfo, reason string) error {
+	if len(objects) == 0 {
+		return nil
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if !gc.options.DryRun {
+		if err := gc.client.DeleteObjects(gc.ctx, keys); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		gc.report.Actions = append(gc.report.Actions, GCAction{Action: "delete", Key: key, Reason: reason})
+	}
+	return nil
+}
+
+func (gc *garbageCollector) olderThan(t time.Time, d time.Duration) bool {
+	return gc.options.Now.Sub(t) > d
+}
+
+// collectMultipartUploads aborts the multipart uploads of `uploads/` too old to be completed,
+// including those whose sessions have been lost. Others in the bucket may not be ours, so they are left alone.
+func (gc *garbageCollector) collectMultipartUploads() error {
+	uploads, err := gc.client.ListMultipartUploads(gc.ctx, "uploads/")
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if !gc.olderThan(upload.Initiated, uploadMaxAge) {
+			continue
+		}
+		err = gc.do(GCAction{Action: "abort", Key: upload.Key, Reason: "stale multipart upload"}, func() error {
+			err := gc.client.AbortMultipartUpload(gc.ctx, upload.Key, upload.UploadId)
+			if errors.Is(err, ErrObjectNotFound) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectUploads deletes the uploaded files, sessions, tails and checksums older than any upload may last.
+// Uploaded files are kept after being shared, so the client can retry, until they are collected.
+func (gc *garbageCollector) collectUploads() error {
+	objects, err := listAllObjects(gc.ctx, gc.client, "uploads/")
+	if err != nil {
+		return err
+	}
+	var stale []ObjectInfo
+	for _, object := range objects {
+		if gc.olderThan(object.LastModified, uploadMaxAge) {
+			stale = append(stale, object)
+		}
+	}
+	return gc.delete(stale, "stale upload")
+}
+
+// scanShares reads every share object, and the trees of directory shares.
+func (gc *garbageCollector) scanShares() error {
+	objects, err := listAllObjects(gc.ctx, gc.client, "shares/")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		rest := strings.TrimPrefix(object.Key, "shares/")
+		if name, _, ok := strings.Cut(rest, ".d/"); ok {
+			gc.children[name] = append(gc.children[name], object)
+			continue
+		}
+		meta, err := gc.client.HeadObject(gc.ctx, object.Key)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		gc.shares[rest] = meta
+		if meta.Meta("Share-Type") != "directory" {
+			continue
+		}
+		tree, err := readShareTree(gc.ctx, rest)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotFound) || errors.Is(err, ErrNotDirectory) {
+				continue
+			}
+			if errors.Is(err, ErrPreconditionFailed) {
+				// changed meanwhile, its files are kept until the next run
+				gc.trees[rest] = nil
+				continue
+			}
+			// the tree is corrupted, and its files are kept for inspection
+			err = gc.do(GCAction{Action: "report", Key: object.Key, Reason: "unreadable file tree: " + err.Error()}, nil)
+			if err != nil {
+				return err
+			}
+			gc.trees[rest] = nil
+			continue
+		}
+		gc.trees[rest] = tree.files
+	}
+	return nil
+}
+
+// collectIndex removes the shares which do not exist from the index, like those expired by the lifecycle rules.
+func (gc *garbageCollector) collectIndex() error {
+	idx := index()
+	if idx == nil {
+		return nil
+	}
+	shares, err := idx.Scan("")
+	if err != nil {
+		return err
+	}
+	for _, share := range shares {
+		if _, ok := gc.shares[share.Name]; ok {
+			continue
+		}
+		// the share may have been created since it was scanned
+		if _, err = gc.client.HeadObject(gc.ctx, "shares/"+share.Name); !errors.Is(err, ErrObjectNotFound) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = gc.do(GCAction{Action: "repair", Key: "shares/" + share.Name, Reason: "indexed share which does not exist"}, func() error {
+			invalidateShare(share.Name, share.Aliases)
+			return idx.Delete(share.Name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectShareFiles deletes the files of directory shares which do not exist or do not have them in their trees,
+// left over from directory shares failed to be created or files failed to be added.
+func (gc *garbageCollector) collectShareFiles() error {
+	for name, children := range gc.children {
+		files, isDirectory := gc.trees[name]
+		if isDirectory && files == nil {
+			continue
+		}
+
+		reason := "file not in the share tree"
+		if _, ok := gc.shares[name]; !ok {
+			reason = "file of a share which does not exist"
+		} else if !isDirectory {
+			reason = "file of a share which is not a directory"
+		}
+		var orphans []ObjectInfo
+		for _, child := range children {
+			id := strings.TrimSuffix(strings.TrimPrefix(child.Key, "shares/"+name+".d/"), ".bin")
+			if isDirectory && slices.ContainsFunc(files, func(file models.ShareFile) bool { return file.Id == id }) {
+				continue
+			}
+			if gc.olderThan(child.LastModified, gcGracePeriod) {
+				orphans = append(orphans, child)
+			}
+		}
+		if len(orphans) == 0 {
+			continue
+		}
+
+		if err := gc.delete(orphans, reason); err != nil {
+			return err
+		}
+		gc.children[name] = slices.DeleteFunc(children, func(child ObjectInfo) bool {
+			return slices.ContainsFunc(orphans, func(orphan ObjectInfo) bool { return orphan.Key == child.Key })
+		})
+	}
+	return nil
+}
+
+// repairShareTrees removes the files missing from the storage from the trees of directory shares.
+func (gc *garbageCollector) repairShareTrees() error {
+	for name, files := range gc.trees {
+		var missing []string
+		for _, file := range files {
+			key := "shares/" + name + ".d/" + file.Id + ".bin"
+			if slices.ContainsFunc(gc.children[name], func(child ObjectInfo) bool { return child.Key == key }) {
+				continue
+			}
+			// the file may have been added after the storage was listed
+			_, err := gc.client.HeadObject(gc.ctx, key)
+			if errors.Is(err, ErrObjectNotFound) {
+				missing = append(missing, file.Id)
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		key := "shares/" + name
+		if len(missing) == len(files) {
+			err := gc.do(GCAction{Action: "report", Key: key, Reason: "every file of the directory share is missing"}, nil)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		reason := "removed " + strconv.Itoa(len(missing)) + " missing files from the share tree"
+		err := gc.do(GCAction{Action: "repair", Key: key, Reason: reason}, func() error {
+			return removeMissingShareFiles(gc.ctx, name, missing)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeMissingShareFiles removes the files from the tree of the directory share, unless it would be left empty.
+func removeMissingShareFiles(ctx context.Context, name string, ids []string) error {
+	return updateShareTree(ctx, name, func(tree *shareTree) (bool, error) {
+		files := slices.DeleteFunc(slices.Clone(tree.files), func(file models.ShareFile) bool {
+			return slices.Contains(ids, file.Id)
+		})
+		if len(files) == 0 || len(files) == len(tree.files) {
+			return false, nil
+		}
+		tree.files = files
+		return true, nil
+	})
+}
+
+// collectDownloads deletes the download counts of shares which do not exist.
+func (gc *garbageCollector) collectDownloads() error {
+	objects, err := listAllObjects(gc.ctx, gc.client, "downloads/")
+	if err != nil {
+		return err
+	}
+	var orphans []ObjectInfo
+	for _, object := range objects {
+		name := strings.TrimSuffix(strings.TrimPrefix(object.Key, "downloads/"), ".json")
+		if _, ok := gc.shares[name]; !ok && gc.olderThan(object.LastModified, gcGracePeriod) {
+			orphans = append(orphans, object)
+		}
+	}
+	return gc.delete(orphans, "download counts of a share which does not exist")
+}
+
+// collectAliases deletes the aliases left over from shares which no longer have them.
+func (gc *garbageCollector) collectAliases() error {
+	objects, err := listAllObjects(gc.ctx, gc.client, "aliases/")
+	if err != nil {
+		return err
+	}
+	var orphans []ObjectInfo
+	for _, object := range objects {
+		if !gc.olderThan(object.LastModified, gcGracePeriod) {
+			continue
+		}
+		alias := strings.TrimPrefix(object.Key, "aliases/")
+		name, err := resolveAlias(gc.ctx, alias)
+		if err != nil {
+			return err
+		}
+		meta, ok := gc.shares[name]
+		if !ok || !slices.Contains(parseAliases(meta.Meta("Share-Aliases")), alias) {
+			orphans = append(orphans, object)
+		}
+	}
+	return gc.delete(orphans, "alias of a share which no longer has it")
+}
+
+// collectFileRequests deletes the file requests of shares which do not exist,
+// and keeps the listings of the requests under their shares in line with them.
+func (gc *garbageCollector) collectFileRequests() error {
+	objects, err := listAllObjects(gc.ctx, gc.client, "requests/")
+	if err != nil {
+		return err
+	}
+	listings, err := listAllObjects(gc.ctx, gc.client, "request-shares/")
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, listing := range listings {
+		listed[listing.Key] = true
+	}
+
+	var orphans []ObjectInfo
+	kept := make(map[string]bool)
+	for _, object := range objects {
+		request, err := GetFileRequest(gc.ctx, strings.TrimPrefix(object.Key, "requests/"))
+		if err != nil {
+			return err
+		}
+		if request == nil {
+			continue
+		}
+		key := requestShareKey(request.Share, request.Id)
+		kept[key] = true
+		if !gc.olderThan(object.LastModified, gcGracePeriod) {
+			continue
+		}
+		if _, ok := gc.shares[request.Share]; !ok {
+			orphans = append(orphans, object)
+			if listed[key] {
+				orphans = append(orphans, ObjectInfo{Key: key})
+			}
+			continue
+		}
+		if !listed[key] {
+			err = gc.do(GCAction{Action: "repair", Key: key, Reason: "listed the file request under its share"}, func() error {
+				return putRequestShare(gc.ctx, request)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err = gc.delete(orphans, "file request of a share which does not exist"); err != nil {
+		return err
+	}
+
+	var stale []ObjectInfo
+	for _, listing := range listings {
+		if !kept[listing.Key] && gc.olderThan(listing.LastModified, gcGracePeriod) {
+			stale = append(stale, listing)
+		}
+	}
+	return gc.delete(stale, "listing of a file request which does not receive files into the share")
+}
+
+// collectBlobs deletes the blobs no longer referred to by any share,
+// and reports the shares referring to blobs which are missing.
+func (gc *garbageCollector) collectBlobs() error {
+	refs := make(map[string][]string) // share objects by blob
+	for name, meta := range gc.shares {
+		if sum := meta.Meta("Share-Blob"); sum != "" {
+			refs[sum] = append(refs[sum], "shares/"+name)
+		}
+	}
+	for _, children := range gc.children {
+		for _, child := range children {
+			if child.Size > 0 {
+				continue
+			}
+			meta, err := gc.client.HeadObject(gc.ctx, child.Key)
+			if errors.Is(err, ErrObjectNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if sum := meta.Meta("Share-Blob"); sum != "" {
+				refs[sum] = append(refs[sum], child.Key)
+			}
+		}
+	}
+
+	objects, err := listAllObjects(gc.ctx, gc.client, "blobs/")
+	if err != nil {
+		return err
+	}
+	blobs := make(map[string][]ObjectInfo) // the blob and when it was last referred to by blob
+	for _, object := range objects {
+		sum := strings.TrimSuffix(strings.TrimPrefix(object.Key, "blobs/"), ".json")
+		blobs[sum] = append(blobs[sum], object)
+	}
+
+	for sum, keys := range refs {
+		if slices.ContainsFunc(blobs[sum], func(object ObjectInfo) bool { return object.Key == blobKey(sum) }) {
+			continue
+		}
+		for _, key := range keys {
+			if err = gc.do(GCAction{Action: "report", Key: key, Reason: "blob " + sum + " is missing"}, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	for sum, objects := range blobs {
+		// blobs are acquired before the shares referring to them are written
+		if len(refs[sum]) > 0 || slices.ContainsFunc(objects, func(object ObjectInfo) bool { return !gc.olderThan(object.LastModified, gcGracePeriod) }) {
+			continue
+		}
+		// acquired since the blobs were listed
+		meta, err := gc.client.HeadObject(gc.ctx, blobAcquiredKey(sum))
+		if err == nil && !gc.olderThan(meta.LastModified, gcGracePeriod) {
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+		if err = gc.delete(objects, "blob not referred to by any share"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartGarbageCollector collects garbage in the background every `gc.interval`, unless it is zero.
+func StartGarbageCollector() {
+	interval := viper.GetDuration("gc.interval")
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			report, err := CollectGarbage(context.Background(), GCOptions{DryRun: viper.GetBool("gc.dry_run")})
+			for _, action := range report.Actions {
+				log.Printf("Garbage collector: %s %s: %s\n", action.Action, action.Key, action.Reason)
+			}
+			if err != nil {
+				log.Println("Failed to collect garbage: ", err)
+			}
+		}
+	}()
+}
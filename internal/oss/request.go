@@ -0,0 +1,473 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/jingbh/simple-share/internal/utils"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrRequestLimitReached   = errors.New("file request has reached its limit")
+	ErrRequestUploadNotFound = errors.New("upload not found in file request")
+)
+
+// requestIdLength is the length of generated file request ids, which are long as they grant uploading.
+const requestIdLength = 16
+
+func requestKey(id string) string {
+	return "requests/" + id
+}
+
+// requestShareKey is where the share of a file request lists it, so the requests into a share are found
+// without reading every request. The request itself is the source of truth of the share it receives files into.
+func requestShareKey(share string, id string) string {
+	return requestSharePrefix(share) + id
+}
+
+func requestSharePrefix(share string) string {
+	return "request-shares/" + share + "/"
+}
+
+// putRequestShare lists the file request under its share, and expires along with it.
+func putRequestShare(ctx context.Context, request *models.FileRequest) error {
+	putOptions := fileRequestPutOptions(request)
+	putOptions.ContentType = "text/plain"
+	return Client().PutObject(ctx, requestShareKey(request.Share, request.Id), strings.NewReader(""), putOptions)
+}
+
+// CreateFileRequestOptions Request to create a file request, receiving files into the `Share` directory share.
+type CreateFileRequestOptions struct {
+	Share       string
+	DisplayName string
+	Password    string
+	ExpiresAt   *time.Time // nil if the request never expires
+	MaxFiles    int
+	MaxSize     int64
+	Creator     *models.ShareCreator
+}
+
+// CreateFileRequest creates a file request and returns its id.
+func CreateFileRequest(ctx context.Context, options CreateFileRequestOptions) (string, error) {
+	client := Client()
+
+	var id string
+	for i := 0; i < 5 && id == ""; i++ {
+		id = generateShareName(requestIdLength)
+		if _, err := client.HeadObject(ctx, requestKey(id)); !errors.Is(err, ErrObjectNotFound) {
+			id = ""
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("unable to generate a unique file request id")
+	}
+
+	now := time.Now()
+	request := &models.FileRequest{
+		Id:          id,
+		Share:       options.Share,
+		DisplayName: options.DisplayName,
+		CreatedAt:   &now,
+		ExpiresAt:   options.ExpiresAt,
+		MaxFiles:    options.MaxFiles,
+		MaxSize:     options.MaxSize,
+		Creator:     options.Creator,
+	}
+	if options.Password != "" {
+		passwordHashed, err := utils.HashPassword(options.Password)
+		if err != nil {
+			return "", err
+		}
+		request.Password = passwordHashed
+	}
+	// listed first, so the request is never missed when the share is renamed
+	if err := putRequestShare(ctx, request); err != nil {
+		return "", err
+	}
+	if err := putFileRequest(ctx, request); err != nil {
+		_ = client.DeleteObjects(context.Background(), []string{requestShareKey(request.Share, id)})
+		return "", err
+	}
+	return id, nil
+}
+
+func putFileRequest(ctx context.Context, request *models.FileRequest) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	putOptions := fileRequestPutOptions(request)
+	putOptions.ContentMD5 = utils.MD5HashBase64(data)
+	return Client().PutObject(ctx, requestKey(request.Id), bytes.NewReader(data), putOptions)
+}
+
+func fileRequestPutOptions(request *models.FileRequest) PutOptions {
+	putOptions := PutOptions{
+		ContentType: "application/json",
+		Metadata:    make(map[string]string),
+	}
+	// the lifecycle rules clean up expired requests as well
+	putOptions.setExpiry(request.ExpiresAt)
+	return putOptions
+}
+
+// updateFileRequest changes the file request with `update`, which is retried on concurrent changes,
+// from other servers as well, and returns the request written.
+func updateFileRequest(ctx context.Context, id string, update func(request *models.FileRequest) error) (*models.FileRequest, error) {
+	current, err := GetFileRequest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, ErrObjectNotFound
+	}
+
+	// the expiry never changes, so the attributes are the same for every attempt
+	var request *models.FileRequest
+	err = updateJsonObject(ctx, requestKey(id), fileRequestPutOptions(current), func(v *models.FileRequest, exists bool) error {
+		if !exists {
+			return ErrObjectNotFound
+		}
+		request = v
+		return update(v)
+	})
+	return request, err
+}
+
+// GetFileRequest returns the file request, or nil if it does not exist.
+func GetFileRequest(ctx context.Context, id string) (*models.FileRequest, error) {
+	if !shareNamePattern.MatchString(id) {
+		return nil, nil
+	}
+	res, err := Client().GetObject(ctx, requestKey(id), GetOptions{})
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	request := new(models.FileRequest)
+	err = json.NewDecoder(res.Body).Decode(request)
+	return request, err
+}
+
+// ListFileRequests returns the file requests created by the subject, the newest first.
+func ListFileRequests(ctx context.Context, creator string) ([]*models.FileRequest, error) {
+	objects, err := listAllObjects(ctx, Client(), "requests/")
+	if err != nil {
+		return nil, err
+	}
+	requests := make([]*models.FileRequest, 0)
+	for i := len(objects) - 1; i >= 0; i-- {
+		request, err := GetFileRequest(ctx, strings.TrimPrefix(objects[i].Key, "requests/"))
+		if err != nil {
+			return nil, err
+		}
+		if request != nil && request.Creator != nil && request.Creator.Subject == creator {
+			requests = append(requests, request)
+		}
+	}
+	return requests, nil
+}
+
+func DeleteFileRequest(ctx context.Context, request *models.FileRequest) error {
+	return Client().DeleteObjects(ctx, []string{requestKey(request.Id), requestShareKey(request.Share, request.Id)})
+}
+
+// checkRequestLimit returns ErrRequestLimitReached if the request cannot take `files` more files of `size` bytes,
+// besides the files received and those being uploaded.
+func checkRequestLimit(request *models.FileRequest, files int, size int64) error {
+	files += request.FileCount + len(request.Uploads)
+	size += request.Size
+	for _, reserved := range request.Uploads {
+		size += reserved
+	}
+	if request.MaxFiles > 0 && files > request.MaxFiles {
+		return ErrRequestLimitReached
+	}
+	if request.MaxSize > 0 && size > request.MaxSize {
+		return ErrRequestLimitReached
+	}
+	return nil
+}
+
+// reserveRequestUpload reserves `size` bytes of the request for the file, which counts as a file of the request
+// from its first reservation on, so concurrent uploads cannot exceed the limits.
+// If the limits are reached, the reservations of uploads which are gone, like those abandoned, are released first.
+func reserveRequestUpload(ctx context.Context, requestId string, fileId string, size int64) error {
+	reserve := func(request *models.FileRequest) error {
+		reserved, ok := request.Uploads[fileId]
+		if ok && reserved >= size {
+			return nil
+		}
+		files := 1
+		if ok {
+			files = 0
+		}
+		if err := checkRequestLimit(request, files, size-reserved); err != nil {
+			return err
+		}
+		if request.Uploads == nil {
+			request.Uploads = make(map[string]int64)
+		}
+		request.Uploads[fileId] = size
+		return nil
+	}
+	request, err := updateFileRequest(ctx, requestId, reserve)
+	if !errors.Is(err, ErrRequestLimitReached) {
+		return err
+	}
+
+	var gone []string
+	for id := range request.Uploads {
+		if id == fileId {
+			continue
+		}
+		if _, err := getUploadSession(ctx, id); errors.Is(err, ErrUploadNotFound) {
+			gone = append(gone, id)
+		}
+	}
+	if len(gone) == 0 {
+		return err
+	}
+	_, err = updateFileRequest(ctx, requestId, func(request *models.FileRequest) error {
+		for _, id := range gone {
+			delete(request.Uploads, id)
+		}
+		return reserve(request)
+	})
+	return err
+}
+
+// releaseRequestUpload releases the reservation of the file, which is no longer uploaded through the request.
+// Failures are only logged, as the reservation is released anyway once the limits are reached.
+func releaseRequestUpload(ctx context.Context, requestId string, fileId string) {
+	_, err := updateFileRequest(ctx, requestId, func(request *models.FileRequest) error {
+		delete(request.Uploads, fileId)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to release upload %s of file request %s: %v\n", fileId, requestId, err)
+	}
+}
+
+// StartRequestUpload starts uploading a file through a file request, and returns the file id.
+func StartRequestUpload(ctx context.Context, request *models.FileRequest) (string, error) {
+	if err := checkRequestLimit(request, 1, 0); err != nil && len(request.Uploads) == 0 {
+		// no reservations to release, so it is already known to be full
+		return "", err
+	}
+	fileId, err := uploadInit(ctx, "", request.Id, 0)
+	if err != nil {
+		return "", err
+	}
+	if err = reserveRequestUpload(ctx, request.Id, fileId, 0); err != nil {
+		_ = UploadAbort(context.Background(), fileId)
+		return "", err
+	}
+	return fileId, nil
+}
+
+// ReserveRequestUpload reserves room for a part of `size` bytes of the file uploaded through the request,
+// before the part is uploaded.
+func ReserveRequestUpload(ctx context.Context, request *models.FileRequest, fileId string, size int64) error {
+	uploaded, requestId, err := uploadedSize(ctx, fileId)
+	if errors.Is(err, ErrUploadNotFound) || (err == nil && requestId != request.Id) {
+		return ErrRequestUploadNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return reserveRequestUpload(ctx, request.Id, fileId, uploaded+size)
+}
+
+// CheckRequestUploadOwner returns ErrRequestUploadNotFound unless the file is being uploaded through the request.
+func CheckRequestUploadOwner(ctx context.Context, requestId string, fileId string) error {
+	session, err := getUploadSession(ctx, fileId)
+	if errors.Is(err, ErrUploadNotFound) || (err == nil && session.RequestId != requestId) {
+		return ErrRequestUploadNotFound
+	}
+	return err
+}
+
+// AbortRequestUpload cancels uploading a file through a file request, and releases its reservation.
+func AbortRequestUpload(ctx context.Context, requestId string, fileId string) error {
+	if err := CheckRequestUploadOwner(ctx, requestId, fileId); err != nil {
+		return err
+	}
+	if err := UploadAbort(ctx, fileId); err != nil {
+		return err
+	}
+	releaseRequestUpload(ctx, requestId, fileId)
+	return nil
+}
+
+// CompleteRequestUpload completes uploading a file through a file request,
+// and adds it into the directory share of the request at the path.
+// If the path is taken, a number is appended to the name of the file.
+// If `sha256Hex` is set, the file is verified against it.
+func CompleteRequestUpload(ctx context.Context, requestId string, fileId string, p string, sha256Hex string) (*models.FileRequest, models.ShareFile, error) {
+	if err := CheckRequestUploadOwner(ctx, requestId, fileId); err != nil {
+		return nil, models.ShareFile{}, err
+	}
+	p, ok := cleanSharePath(p)
+	if !ok {
+		return nil, models.ShareFile{}, ErrShareFilePathInvalid
+	}
+	err := UploadComplete(ctx, fileId, sha256Hex)
+	if errors.Is(err, ErrChecksumMismatch) {
+		// the corrupted file is discarded
+		releaseRequestUpload(context.Background(), requestId, fileId)
+	}
+	if err != nil {
+		return nil, models.ShareFile{}, err
+	}
+
+	request, file, err := acceptRequestUpload(ctx, requestId, fileId, p)
+	if err != nil {
+		// the file is not accepted, nobody can use it
+		_ = Client().DeleteObjects(context.Background(), []string{uploadKey(fileId)})
+		releaseRequestUpload(context.Background(), requestId, fileId)
+	}
+	return request, file, err
+}
+
+func acceptRequestUpload(ctx context.Context, requestId string, fileId string, p string) (*models.FileRequest, models.ShareFile, error) {
+	meta, err := Client().HeadObject(ctx, uploadKey(fileId))
+	if err != nil {
+		return nil, models.ShareFile{}, err
+	}
+	sum, err := GetUploadChecksum(ctx, fileId)
+	if err != nil {
+		return nil, models.ShareFile{}, err
+	}
+
+	// the file is counted before it is added, in place of its reservation
+	request, err := updateFileRequest(ctx, requestId, func(request *models.FileRequest) error {
+		delete(request.Uploads, fileId)
+		if err := checkRequestLimit(request, 1, meta.Size); err != nil {
+			return err
+		}
+		request.FileCount++
+		request.Size += meta.Size
+		return nil
+	})
+	if err != nil {
+		return nil, models.ShareFile{}, err
+	}
+
+	file := models.ShareFile{Id: fileId, Path: p, Size: meta.Size, SHA256: sum}
+	share, err := GetShare(ctx, request.Share)
+	if err == nil && share == nil {
+		err = ErrObjectNotFound
+	}
+	for i := 1; err == nil; i++ {
+		err = AddShareFiles(ctx, share.Name, []ShareFileOptions{{Id: fileId, Path: file.Path}})
+		if !errors.Is(err, ErrShareFilePathTaken) || i > 100 {
+			break
+		}
+		file.Path = numberedPath(p, i)
+		err = nil
+	}
+	if err != nil {
+		// give the counted file back, even if the request is cancelled
+		_, _ = updateFileRequest(context.Background(), requestId, func(request *models.FileRequest) error {
+			request.FileCount--
+			request.Size -= meta.Size
+			return nil
+		})
+		return nil, models.ShareFile{}, err
+	}
+	if share.Name != request.Share {
+		// the share is reached through an alias, point the request to the share itself
+		renameFileRequestShare(ctx, requestId, request.Share, share.Name)
+		request.Share = share.Name
+	}
+	return request, file, nil
+}
+
+// renameFileRequestShare points the file request receiving files into the share `name` to `newName`.
+func renameFileRequestShare(ctx context.Context, id string, name string, newName string) {
+	client := Client()
+
+	request, err := updateFileRequest(ctx, id, func(request *models.FileRequest) error {
+		if request.Share == name {
+			request.Share = newName
+		}
+		return nil
+	})
+	if errors.Is(err, ErrObjectNotFound) {
+		// deleted, like by the lifecycle rules, so only its listing is left
+		_ = client.DeleteObjects(ctx, []string{requestShareKey(name, id)})
+		return
+	}
+	if err == nil && request.Share == newName {
+		err = putRequestShare(ctx, request)
+	}
+	if err == nil {
+		err = client.DeleteObjects(ctx, []string{requestShareKey(name, id)})
+	}
+	if err != nil {
+		log.Printf("Failed to point file request %s to share %s: %v\n", id, newName, err)
+	}
+}
+
+// renameFileRequestShares points the file requests receiving files into the share `name` to `newName`.
+func renameFileRequestShares(ctx context.Context, name string, newName string) {
+	objects, err := listAllObjects(ctx, Client(), requestSharePrefix(name))
+	if err != nil {
+		log.Printf("Failed to point file requests to share %s: %v\n", newName, err)
+		return
+	}
+	for _, object := range objects {
+		renameFileRequestShare(ctx, strings.TrimPrefix(object.Key, requestSharePrefix(name)), name, newName)
+	}
+}
+
+// numberedPath appends a number to the name of the file, like `report (1).pdf`.
+func numberedPath(p string, n int) string {
+	ext := path.Ext(p)
+	if ext == p || strings.HasSuffix(p, "/"+ext) {
+		// a dotfile has no extension
+		ext = ""
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(p, ext), n, ext)
+}
+
+// SweepExpiredFileRequests deletes every file request which has expired, and returns the number deleted.
+// The files already received are kept in the share.
+func SweepExpiredFileRequests(ctx context.Context) (int, error) {
+	objects, err := listAllObjects(ctx, Client(), "requests/")
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	count := 0
+	for _, object := range objects {
+		request, err := GetFileRequest(ctx, strings.TrimPrefix(object.Key, "requests/"))
+		if err != nil {
+			return count, err
+		}
+		if request == nil || request.ExpiresAt == nil || request.ExpiresAt.After(now) {
+			continue
+		}
+		if err = DeleteFileRequest(ctx, request); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,60 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// aliasKey is where an alias keeps the name of the share it points to.
+// The share also lists its aliases in the `Share-Aliases` metadata, which is the source of truth.
+func aliasKey(alias string) string {
+	return "aliases/" + alias
+}
+
+func parseAliases(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// resolveAlias returns the name of the share the alias points to, or empty if there is no such alias.
+func resolveAlias(ctx context.Context, alias string) (string, error) {
+	res, err := Client().GetObject(ctx, aliasKey(alias), GetOptions{})
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	name, err := io.ReadAll(res.Body)
+	return string(name), err
+}
+
+// putAliases points the aliases to the share.
+func putAliases(ctx context.Context, name string, aliases []string) error {
+	client := Client()
+	for _, alias := range aliases {
+		err := client.PutObject(ctx, aliasKey(alias), strings.NewReader(name), PutOptions{
+			ContentType: "text/plain",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidateShare removes the share from the cache, under its name and all of its aliases.
+func invalidateShare(name string, aliases []string) {
+	shareCache.Delete(name)
+	for _, alias := range aliases {
+		shareCache.Delete(alias)
+	}
+}
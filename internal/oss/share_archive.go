@@ -0,0 +1,275 @@
+package oss
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/jingbh/simple-share/internal/models"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SelectShareFiles returns the files of a directory share with one of the ids,
+// and under the path prefix. Empty ids or prefix select everything.
+func SelectShareFiles(files models.ShareFiles, ids []string, prefix string) models.ShareFiles {
+	prefix, _ = cleanSharePath(prefix)
+	var selected models.ShareFiles
+	for _, file := range files {
+		if len(ids) > 0 && !slices.Contains(ids, file.Id) {
+			continue
+		}
+		p, _ := cleanSharePath(file.Path)
+		if prefix != "" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			continue
+		}
+		selected = append(selected, file)
+	}
+	return selected
+}
+
+// archiveEntryName returns the path of a file inside an archive,
+// which is relative and cannot escape the directory the archive is extracted to.
+func archiveEntryName(file models.ShareFile) string {
+	p, ok := cleanSharePath(file.Path)
+	if !ok {
+		return file.Id
+	}
+	return p
+}
+
+// openShareFile opens a file of a directory share for reading.
+func openShareFile(ctx context.Context, name string, fileId string) (io.ReadCloser, error) {
+	res, err := getShareObject(ctx, "shares/"+name+".d/"+fileId+".bin", GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// CheckShareFiles returns ErrObjectNotFound if one of the files of a directory share is missing,
+// as an archive is started before the files are read.
+func CheckShareFiles(ctx context.Context, share *models.Share, files models.ShareFiles) error {
+	for _, file := range files {
+		target, _, err := resolveShareObject(ctx, "shares/"+share.Name+".d/"+file.Id+".bin")
+		if err != nil {
+			return err
+		}
+		if _, err = Client().HeadObject(ctx, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteShareZip streams the files of a directory share into a ZIP archive, in the order of `files`.
+// Nothing is buffered besides the file being copied, so it works for directories of any size.
+func WriteShareZip(ctx context.Context, w io.Writer, share *models.Share, files models.ShareFiles) error {
+	modified := time.Now()
+	if share.CreatedAt != nil {
+		modified = *share.CreatedAt
+	}
+
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     archiveEntryName(file),
+			Method:   zip.Store, // files shared are mostly compressed already
+			Modified: modified,
+		})
+		if err != nil {
+			return err
+		}
+
+		body, err := openShareFile(ctx, share.Name, file.Id)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, body)
+		_ = body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// tarSegment An entry of a TAR archive, which is the header, followed by the file and its padding.
+type tarSegment struct {
+	offset   int64
+	header   []byte
+	fileId   string
+	fileSize int64
+	padding  int64
+}
+
+func (s *tarSegment) length() int64 {
+	return int64(len(s.header)) + s.fileSize + s.padding
+}
+
+// shareTarReader Reads a TAR archive of the files of a directory share at any offset,
+// so it can be served with range requests.
+// It is meant to be read sequentially, which keeps one file open at a time.
+type shareTarReader struct {
+	ctx      context.Context
+	name     string
+	segments []tarSegment
+	size     int64
+
+	// the file currently open, and the position in it
+	body     io.ReadCloser
+	bodyFile int
+	bodyPos  int64
+}
+
+func newShareTarReader(ctx context.Context, share *models.Share, files models.ShareFiles) (*shareTarReader, error) {
+	modified := time.Now()
+	if share.CreatedAt != nil {
+		modified = *share.CreatedAt
+	}
+
+	r := &shareTarReader{
+		ctx:  ctx,
+		name: share.Name,
+	}
+	for _, file := range files {
+		// the header is written on its own, the size of PAX headers for long names depends on the name
+		var header bytes.Buffer
+		err := tar.NewWriter(&header).WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     archiveEntryName(file),
+			Size:     file.Size,
+			Mode:     0o644,
+			ModTime:  modified,
+		})
+		if err != nil {
+			return nil, err
+		}
+		r.segments = append(r.segments, tarSegment{
+			offset:   r.size,
+			header:   header.Bytes(),
+			fileId:   file.Id,
+			fileSize: file.Size,
+			padding:  (tarBlockSize - file.Size%tarBlockSize) % tarBlockSize,
+		})
+		r.size += r.segments[len(r.segments)-1].length()
+	}
+	// the archive ends with two empty blocks
+	r.segments = append(r.segments, tarSegment{
+		offset: r.size,
+		header: make([]byte, 2*tarBlockSize),
+	})
+	r.size += 2 * tarBlockSize
+	return r, nil
+}
+
+const tarBlockSize = 512
+
+func (r *shareTarReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(r.segments), func(i int) bool {
+			return r.segments[i].offset+r.segments[i].length() > off
+		})
+		segment := &r.segments[i]
+		pos := off - segment.offset
+		headerSize := int64(len(segment.header))
+
+		var m int
+		switch {
+		case pos < headerSize:
+			m = copy(p[n:], segment.header[pos:])
+		case pos < headerSize+segment.fileSize:
+			var err error
+			m, err = r.readFile(i, pos-headerSize, p[n:min(int64(len(p)), int64(n)+headerSize+segment.fileSize-pos)])
+			if err != nil {
+				return n + m, err
+			}
+		default:
+			m = int(min(int64(len(p)-n), segment.length()-pos))
+			clear(p[n : n+m])
+		}
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// readFile reads the file of the segment at the position, reusing the open file if possible.
+func (r *shareTarReader) readFile(i int, pos int64, p []byte) (int, error) {
+	segment := &r.segments[i]
+	if r.body == nil || r.bodyFile != i || r.bodyPos != pos {
+		_ = r.Close()
+		options := GetOptions{}
+		if pos > 0 {
+			options.Range = "bytes=" + strconv.FormatInt(pos, 10) + "-"
+		}
+		res, err := getShareObject(r.ctx, "shares/"+r.name+".d/"+segment.fileId+".bin", options)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.bodyFile, r.bodyPos = res.Body, i, pos
+	}
+
+	m, err := r.body.Read(p)
+	r.bodyPos += int64(m)
+	if errors.Is(err, io.EOF) {
+		if r.bodyPos < segment.fileSize {
+			return m, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return m, err
+}
+
+func (r *shareTarReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// GetShareTar returns a TAR archive of the files of a directory share, honoring a `Range` header.
+// The files are read as the archive is, so nothing is buffered.
+func GetShareTar(ctx context.Context, share *models.Share, files models.ShareFiles, rangeHeader string) (*ObjectResponse, error) {
+	r, err := newShareTarReader(ctx, share, files)
+	if err != nil {
+		return nil, err
+	}
+	lastModified := time.Now()
+	if share.CreatedAt != nil {
+		lastModified = *share.CreatedAt
+	}
+	return newObjectResponse(r, r, r.size, lastModified, objectAttributes{
+		ContentType: "application/x-tar",
+	}, rangeHeader), nil
+}
+
+// WriteShareTarGz streams the files of a directory share into a gzip compressed TAR archive.
+func WriteShareTarGz(ctx context.Context, w io.Writer, share *models.Share, files models.ShareFiles) error {
+	r, err := newShareTarReader(ctx, share, files)
+	if err != nil {
+		return err
+	}
+	defer func(r io.Closer) {
+		_ = r.Close()
+	}(r)
+
+	gw := gzip.NewWriter(w)
+	_, err = io.Copy(gw, io.NewSectionReader(r, 0, r.size))
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
@@ -3,84 +3,121 @@ package oss
 import (
 	"context"
 	"encoding/json"
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/jingbh/simple-share/internal/models"
 	"github.com/jingbh/simple-share/internal/utils"
-	"net/url"
+	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // CreateShareOptions Request to create a single shared file in the OSS store.
 // If `Source` is provided, the file is already uploaded to `uploads/` and should be moved to the destination.
+// If `Body` is provided, the file is read from it instead, and should be of `Size` bytes.
 type CreateShareOptions struct {
 	Type        string // `file`, `directory`, `text`, `url`
 	Text        string
 	Source      string
+	Body        io.Reader
+	Size        int64
 	Name        string // name of the file
 	DisplayName string
 	Path        string // path to save the file, after `shares/`
 	Password    string
-	Expiry      int
-	Creator     *models.ShareCreator
+	ExpiresAt   *time.Time // nil if the share never expires
+	// MaxDownloads limits the downloads of the share, 0 means unlimited
+	MaxDownloads  int
+	BurnAfterRead bool
+	Site          bool   // serve a directory share as a static website
+	SHA256        string // of the file in hex, if hashed when uploaded
+	Creator       *models.ShareCreator
+	Key           *ShareKey // encrypts the content, nil if it is not encrypted
+}
+
+// lifecyclePeriods Expiry periods in days, for which the storage is expected to have a lifecycle rule.
+var lifecyclePeriods = []int{1, 3, 7}
+
+// lifecyclePeriod returns the shortest lifecycle period which does not delete the share before `expiresAt`,
+// or 0 if it lasts longer than any of them.
+// Expiry is enforced by the server, the lifecycle rules are only a backstop to clean up the storage.
+func lifecyclePeriod(expiresAt time.Time) int {
+	for _, period := range lifecyclePeriods {
+		if !time.Now().AddDate(0, 0, period).Before(expiresAt) {
+			return period
+		}
+	}
+	return 0
 }
 
 func CreateShare(ctx context.Context, options CreateShareOptions) error {
 	client := Client()
 
-	ossOptions := []oss.Option{
-		oss.WithContext(ctx),
-		oss.CacheControl("private, max-age=86400"),
-		oss.Meta("Share-Type", options.Type),
-		oss.Meta("Share-Expiry", strconv.Itoa(options.Expiry)),
+	putOptions := PutOptions{
+		CacheControl: "private, max-age=86400",
+		Metadata: map[string]string{
+			"Share-Type": options.Type,
+		},
 	}
+	putOptions.setExpiry(options.ExpiresAt)
 	if options.Name != "" {
-		ossOptions = append(ossOptions, oss.Meta("Share-Filename", options.Name))
-		nameEncoded := url.PathEscape(options.Name)
-		ossOptions = append(ossOptions, oss.ContentDisposition("attachment; filename=\""+nameEncoded+"\"; filename*=UTF-8''"+nameEncoded))
+		putOptions.Metadata["Share-Filename"] = options.Name
+		putOptions.ContentDisposition = utils.AttachmentDisposition(options.Name)
 	}
 	if options.DisplayName != "" {
-		ossOptions = append(ossOptions, oss.Meta("Share-Display-Name", options.DisplayName))
+		putOptions.Metadata["Share-Display-Name"] = options.DisplayName
 	}
 	if options.Creator != nil {
 		creatorJsonBytes, err := json.Marshal(options.Creator)
 		if err == nil {
-			creatorJson := string(creatorJsonBytes)
-			ossOptions = append(ossOptions, oss.Meta("Share-Creator", creatorJson))
+			putOptions.Metadata["Share-Creator"] = string(creatorJsonBytes)
 		}
 	}
+	if options.MaxDownloads > 0 {
+		putOptions.Metadata["Share-Max-Downloads"] = strconv.Itoa(options.MaxDownloads)
+	}
+	if options.BurnAfterRead {
+		putOptions.Metadata["Share-Burn-After-Read"] = "true"
+	}
+	if options.Site {
+		putOptions.Metadata["Share-Site"] = "true"
+	}
+	if options.SHA256 != "" {
+		putOptions.Metadata["Share-SHA256"] = options.SHA256
+	}
+	if options.Key != nil {
+		putOptions.Metadata["Share-Key"] = options.Key.wrapped
+	}
 	if options.Password != "" {
 		passwordHashed, err := utils.HashPassword(options.Password)
 		if err != nil {
 			return err
 		}
-		ossOptions = append(ossOptions, oss.Meta("Share-Password", passwordHashed))
-	}
-	if options.Expiry > 0 {
-		ossOptions = append(ossOptions, oss.SetTagging(oss.Tagging{Tags: []oss.Tag{
-			{Key: "period", Value: strconv.Itoa(options.Expiry)},
-		}}))
+		putOptions.Metadata["Share-Password"] = passwordHashed
 	}
 
 	// no need to add retry here, as the source file is not deleted,
 	// the client can actively retry
-	if options.Source != "" {
-		ossOptions = append(ossOptions, oss.MetadataDirective(oss.MetaReplace))
-		ossOptions = append(ossOptions, oss.TaggingDirective(oss.TaggingReplace))
-		_, err := client.CopyObject(
-			"uploads/"+options.Source,
-			"shares/"+options.Path,
-			ossOptions...,
-		)
-		return err
+	var err error
+	if options.Key != nil && options.Type != "directory" {
+		// trees of directory shares are not encrypted, only the files in them
+		err = putEncryptedShare(ctx, options, putOptions)
+	} else if options.Source != "" && options.SHA256 != "" && dedupEnabled() {
+		err = putBlobShare(ctx, options, putOptions)
+	} else if options.Source != "" {
+		err = client.CopyObject(ctx, "uploads/"+options.Source, "shares/"+options.Path, putOptions)
+	} else if options.Body != nil {
+		err = putObjectParts(ctx, client, "shares/"+options.Path, options.Body, options.Size, putOptions)
 	} else {
-		md5 := utils.MD5HashBase64([]byte(options.Text))
-		ossOptions = append(ossOptions, oss.ContentMD5(md5))
-		err := client.PutObject(
-			"shares/"+options.Path,
-			strings.NewReader(options.Text),
-			ossOptions...,
-		)
+		putOptions.ContentMD5 = utils.MD5HashBase64([]byte(options.Text))
+		err = client.PutObject(ctx, "shares/"+options.Path, strings.NewReader(options.Text), putOptions)
+	}
+	if err != nil {
 		return err
 	}
+
+	// files inside a directory share are indexed as part of the directory
+	if !strings.Contains(options.Path, "/") {
+		indexShare(ctx, options.Path)
+	}
+	return nil
 }
@@ -0,0 +1,476 @@
+package oss
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The content of encrypted shares is encrypted with a random data key per share, in chunks of
+// `encryptChunkSize` bytes sealed by AES-256-GCM, so any range can be read by decrypting the chunks it spans.
+// The nonce of a chunk is the random `Share-Nonce` of the object followed by the index of the chunk,
+// and the last chunk is sealed with a different additional data, so the content cannot be truncated.
+//
+// The data key is kept in the `Share-Key` metadata of the share and its files, wrapped by the master key,
+// or by a key derived from the password if the share has one, so it can only be read with the password.
+// Trees of directory shares and the metadata are not encrypted.
+
+var (
+	ErrSharePasswordRequired = errors.New("password is required to decrypt the share")
+	ErrShareKeyUnavailable   = errors.New("master key is not configured")
+	ErrShareDecrypt          = errors.New("failed to decrypt the share")
+)
+
+const (
+	encryptChunkSize = 64 << 10
+	encryptOverhead  = 16 // the tag of each chunk
+	encryptNonceSize = 8  // the random part of the nonces, unique per object
+)
+
+// ShareKey The data key of an encrypted share, along with how it is stored.
+type ShareKey struct {
+	key     []byte
+	wrapped string // `master:<sealed key>` or `password:<salt>:<sealed key>`
+}
+
+var errMasterKeyInvalid = errors.New("encryption master key must be 32 bytes encoded in base64")
+
+// masterKey returns the master key wrapping the data keys, or nil if encryption is disabled.
+func masterKey() ([]byte, error) {
+	value := viper.GetString("encryption.master_key")
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, errMasterKeyInvalid
+	}
+	return key, nil
+}
+
+// encryptionEnabled reports whether new shares are encrypted.
+func encryptionEnabled() bool {
+	return viper.GetString("encryption.master_key") != ""
+}
+
+// NewShareKey generates the data key of a new share, wrapped by the password if not empty.
+// It returns nil if encryption is disabled.
+func NewShareKey(password string) (*ShareKey, error) {
+	if !encryptionEnabled() {
+		return nil, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return wrapShareKey(key, password)
+}
+
+func wrapShareKey(key []byte, password string) (*ShareKey, error) {
+	if password == "" {
+		master, err := masterKey()
+		if err != nil {
+			return nil, err
+		}
+		if master == nil {
+			return nil, ErrShareKeyUnavailable
+		}
+		sealed, err := sealKey(master, key)
+		if err != nil {
+			return nil, err
+		}
+		return &ShareKey{key: key, wrapped: "master:" + sealed}, nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	kek, err := passwordKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealKey(kek, key)
+	if err != nil {
+		return nil, err
+	}
+	return &ShareKey{key: key, wrapped: "password:" + base64.RawStdEncoding.EncodeToString(salt) + ":" + sealed}, nil
+}
+
+func passwordKey(password string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, 1<<15, 8, 1, 32)
+}
+
+// sealKey encrypts the data key with the key encryption key, and returns it along with the nonce in base64.
+func sealKey(kek []byte, key []byte) (string, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, key, nil)), nil
+}
+
+func openKey(kek []byte, sealed string) ([]byte, error) {
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, ErrShareDecrypt
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, ErrShareDecrypt
+	}
+	key, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrShareDecrypt
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type sharePasswordKey struct{}
+
+// WithSharePassword returns a context carrying the password given to access a share,
+// which decrypts the shares whose keys are wrapped by their passwords.
+func WithSharePassword(ctx context.Context, password string) context.Context {
+	return context.WithValue(ctx, sharePasswordKey{}, password)
+}
+
+func sharePassword(ctx context.Context) string {
+	password, _ := ctx.Value(sharePasswordKey{}).(string)
+	return password
+}
+
+// shareKeyCache Data keys unwrapped by passwords, by the hash of the wrapped key and the password,
+// as deriving keys from passwords is slow on purpose, and content is often read in many ranges.
+var shareKeyCache = struct {
+	sync.Mutex
+	keys map[[sha256.Size]byte][]byte
+}{keys: make(map[[sha256.Size]byte][]byte)}
+
+const shareKeyCacheSize = 1000
+
+// unwrapShareKey returns the data key of the `Share-Key` metadata,
+// using the password in the context if it is wrapped by a password.
+func unwrapShareKey(ctx context.Context, wrapped string) (*ShareKey, error) {
+	scheme, rest, _ := strings.Cut(wrapped, ":")
+	switch scheme {
+	case "master":
+		master, err := masterKey()
+		if err != nil {
+			return nil, err
+		}
+		if master == nil {
+			return nil, ErrShareKeyUnavailable
+		}
+		key, err := openKey(master, rest)
+		if err != nil {
+			return nil, err
+		}
+		return &ShareKey{key: key, wrapped: wrapped}, nil
+	case "password":
+		password := sharePassword(ctx)
+		if password == "" {
+			return nil, ErrSharePasswordRequired
+		}
+		id := sha256.Sum256([]byte(wrapped + "\x00" + password))
+		shareKeyCache.Lock()
+		key, ok := shareKeyCache.keys[id]
+		shareKeyCache.Unlock()
+		if ok {
+			return &ShareKey{key: key, wrapped: wrapped}, nil
+		}
+
+		encodedSalt, sealed, _ := strings.Cut(rest, ":")
+		salt, err := base64.RawStdEncoding.DecodeString(encodedSalt)
+		if err != nil {
+			return nil, ErrShareDecrypt
+		}
+		kek, err := passwordKey(password, salt)
+		if err != nil {
+			return nil, err
+		}
+		key, err = openKey(kek, sealed)
+		if err != nil {
+			// owners are not checked against the password hash, so the password may be wrong
+			return nil, ErrSharePasswordRequired
+		}
+		shareKeyCache.Lock()
+		if len(shareKeyCache.keys) >= shareKeyCacheSize {
+			clear(shareKeyCache.keys)
+		}
+		shareKeyCache.keys[id] = key
+		shareKeyCache.Unlock()
+		return &ShareKey{key: key, wrapped: wrapped}, nil
+	default:
+		return nil, fmt.Errorf("unknown share key: %s", scheme)
+	}
+}
+
+// shareKeyFromMeta returns the data key of an encrypted share object, or nil if it is not encrypted.
+func shareKeyFromMeta(ctx context.Context, meta *ObjectMeta) (*ShareKey, error) {
+	if meta.Meta("Share-Key") == "" {
+		return nil, nil
+	}
+	return unwrapShareKey(ctx, meta.Meta("Share-Key"))
+}
+
+// encryptedSize returns the size of `size` bytes once encrypted.
+// Empty content is still sealed as one chunk, so it cannot be forged.
+func encryptedSize(size int64) int64 {
+	chunks := max((size+encryptChunkSize-1)/encryptChunkSize, 1)
+	return size + chunks*encryptOverhead
+}
+
+// decryptedSize returns the size of encrypted content of `size` bytes once decrypted.
+func decryptedSize(size int64) int64 {
+	chunks := (size + encryptChunkSize + encryptOverhead - 1) / (encryptChunkSize + encryptOverhead)
+	return max(size-chunks*encryptOverhead, 0)
+}
+
+func chunkNonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptNonceSize:], uint32(index))
+	return nonce
+}
+
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptReader Encrypts `size` bytes read from `src` chunk by chunk.
+type encryptReader struct {
+	aead   cipher.AEAD
+	prefix []byte
+	src    io.Reader
+	left   int64 // plaintext not read yet
+	index  int64
+	done   bool
+
+	plain []byte
+	buf   []byte
+	pos   int
+}
+
+// encrypt returns the content of `size` bytes read from `body` encrypted, and the `Share-Nonce` of the object.
+func (k *ShareKey) encrypt(body io.Reader, size int64) (io.Reader, string, error) {
+	aead, err := newAEAD(k.key)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := make([]byte, encryptNonceSize)
+	if _, err = rand.Read(prefix); err != nil {
+		return nil, "", err
+	}
+	return &encryptReader{
+		aead:   aead,
+		prefix: prefix,
+		src:    body,
+		left:   size,
+		plain:  make([]byte, encryptChunkSize),
+	}, base64.RawStdEncoding.EncodeToString(prefix), nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	if r.pos == len(r.buf) {
+		if r.done {
+			return 0, io.EOF
+		}
+		n := min(r.left, encryptChunkSize)
+		if _, err := io.ReadFull(r.src, r.plain[:n]); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.left -= n
+		r.done = r.left == 0
+		r.buf = r.aead.Seal(r.buf[:0], chunkNonce(r.prefix, r.index), r.plain[:n], chunkAdditionalData(r.done))
+		r.pos = 0
+		r.index++
+	}
+	n := copy(p, r.buf[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// decryptReader Decrypts the chunks read from `src`, starting at the chunk `index`.
+type decryptReader struct {
+	aead   cipher.AEAD
+	prefix []byte
+	src    io.Reader
+	index  int64
+	last   int64 // index of the last chunk of the object
+	skip   int   // bytes to skip from the first chunk
+
+	chunk []byte
+	buf   []byte
+	pos   int
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for r.pos == len(r.buf) {
+		if r.index > r.last {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.chunk)
+		if err != nil && !(errors.Is(err, io.ErrUnexpectedEOF) && r.index == r.last) {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.buf, err = r.aead.Open(r.buf[:0], chunkNonce(r.prefix, r.index), r.chunk[:n], chunkAdditionalData(r.index == r.last))
+		if err != nil {
+			return 0, ErrShareDecrypt
+		}
+		r.pos = min(r.skip, len(r.buf))
+		r.skip = 0
+		r.index++
+	}
+	n := copy(p, r.buf[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// getEncryptedObject reads an encrypted share object decrypted, honoring a `Range` of the decrypted content.
+func getEncryptedObject(ctx context.Context, key string, meta *ObjectMeta, options GetOptions) (*ObjectResponse, error) {
+	if options.Process != "" {
+		// the storage cannot process content it cannot read
+		return nil, ErrNotSupported
+	}
+	shareKey, err := shareKeyFromMeta(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(shareKey.key)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := base64.RawStdEncoding.DecodeString(meta.Meta("Share-Nonce"))
+	if err != nil || len(prefix) != encryptNonceSize {
+		return nil, ErrShareDecrypt
+	}
+
+	size := decryptedSize(meta.Size)
+	start, end, status := int64(0), size-1, http.StatusOK
+	if options.Range != "" {
+		if s, e, ok := parseRange(options.Range, size); ok {
+			if s >= size {
+				headers := make(http.Header)
+				headers.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+				return &ObjectResponse{
+					StatusCode: http.StatusRequestedRangeNotSatisfiable,
+					Headers:    headers,
+					Body:       io.NopCloser(strings.NewReader("")),
+				}, nil
+			}
+			start, end, status = s, e, http.StatusPartialContent
+		}
+	}
+
+	// the chunks spanning the range, the whole object if it is empty
+	chunkSize := int64(encryptChunkSize + encryptOverhead)
+	first, last := start/encryptChunkSize, max(end, 0)/encryptChunkSize
+	res, err := Client().GetObject(ctx, key, GetOptions{
+		Range: fmt.Sprintf("bytes=%d-%d", first*chunkSize, min((last+1)*chunkSize, meta.Size)-1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res.StatusCode = status
+	res.Headers.Del("Content-Range")
+	res.Headers.Del("ETag")
+	res.Headers.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if status == http.StatusPartialContent {
+		res.Headers.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	res.Body = rangeReadCloser{
+		Reader: io.LimitReader(&decryptReader{
+			aead:   aead,
+			prefix: prefix,
+			src:    res.Body,
+			index:  first,
+			last:   (meta.Size - 1) / chunkSize,
+			skip:   int(start - first*encryptChunkSize),
+			chunk:  make([]byte, chunkSize),
+		}, end-start+1),
+		Closer: res.Body,
+	}
+	return res, nil
+}
+
+// putEncryptedShare creates the share object of `options` with its content encrypted by `options.Key`.
+func putEncryptedShare(ctx context.Context, options CreateShareOptions, putOptions PutOptions) error {
+	client := Client()
+
+	var body io.Reader
+	var size int64
+	switch {
+	case options.Source != "":
+		meta, err := client.HeadObject(ctx, "uploads/"+options.Source)
+		if err != nil {
+			return err
+		}
+		res, err := client.GetObject(ctx, "uploads/"+options.Source, GetOptions{})
+		if err != nil {
+			return err
+		}
+		defer func(reader io.ReadCloser) {
+			_ = reader.Close()
+		}(res.Body)
+		body, size = res.Body, meta.Size
+	case options.Body != nil:
+		body, size = options.Body, options.Size
+	default:
+		body, size = strings.NewReader(options.Text), int64(len(options.Text))
+	}
+
+	encrypted, nonce, err := options.Key.encrypt(body, size)
+	if err != nil {
+		return err
+	}
+	putOptions.Metadata["Share-Nonce"] = nonce
+	return putObjectParts(ctx, client, "shares/"+options.Path, encrypted, encryptedSize(size), putOptions)
+}
+
+// rewrapShareKey wraps the data key of an encrypted share by the new password, or the master key if it is empty.
+// The current password is read from the context.
+func rewrapShareKey(ctx context.Context, meta *ObjectMeta, password string) (*ShareKey, error) {
+	shareKey, err := shareKeyFromMeta(ctx, meta)
+	if err != nil || shareKey == nil {
+		return nil, err
+	}
+	return wrapShareKey(shareKey.key, password)
+}
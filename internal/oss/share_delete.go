@@ -2,46 +2,55 @@ package oss
 
 import (
 	"context"
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"errors"
 )
 
 func DeleteShare(ctx context.Context, name string) error {
 	client := Client()
 
-	continuationToken := ""
-	for {
-		ossListOptions := []oss.Option{
-			oss.WithContext(ctx),
-			oss.MaxKeys(1000),
-			oss.Prefix("shares/" + name),
-		}
-		if continuationToken != "" {
-			ossListOptions = append(ossListOptions, oss.ContinuationToken(continuationToken))
-		}
-		res, err := client.ListObjectsV2(ossListOptions...)
-		if err != nil {
-			return err
-		}
+	var aliases []string
+	meta, err := client.HeadObject(ctx, "shares/"+name)
+	if err == nil {
+		aliases = parseAliases(meta.Meta("Share-Aliases"))
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
 
-		var keys []string
-		for _, obj := range res.Objects {
-			keys = append(keys, obj.Key)
-		}
-		if len(keys) == 0 {
-			break
-		}
-		ossDeleteOptions := []oss.Option{
-			oss.WithContext(ctx),
-			oss.DeleteObjectsQuiet(true),
-		}
-		_, err = client.DeleteObjects(keys, ossDeleteOptions...)
+	err = deleteShareObjects(ctx, name)
+	if err != nil {
+		return err
+	}
 
-		if !res.IsTruncated {
-			break
+	var aliasKeys []string
+	for _, alias := range aliases {
+		aliasKeys = append(aliasKeys, aliasKey(alias))
+	}
+	if len(aliasKeys) > 0 {
+		err = client.DeleteObjects(ctx, aliasKeys)
+		if err != nil {
+			return err
 		}
-		continuationToken = res.NextContinuationToken
 	}
 
-	shareCache.Delete(name)
+	invalidateShare(name, aliases)
+	unindexShare(name)
 	return nil
 }
+
+// deleteShareObjects deletes the share, the files of a directory share and the download counts,
+// but not the aliases pointing to the share.
+func deleteShareObjects(ctx context.Context, name string) error {
+	client := Client()
+
+	// the prefix ends with the separator, so other shares starting with this name are not matched
+	children, err := listAllObjects(ctx, client, "shares/"+name+".d/")
+	if err != nil {
+		return err
+	}
+	keys := []string{"shares/" + name, downloadsKey(name)}
+	for _, child := range children {
+		keys = append(keys, child.Key)
+	}
+	// the blobs the share refers to are collected as garbage once no share refers to them
+	return client.DeleteObjects(ctx, keys)
+}
@@ -0,0 +1,80 @@
+package oss
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jingbh/simple-share/internal/models"
+	"io"
+)
+
+var ErrDownloadLimitReached = errors.New("download limit reached")
+
+// downloadsKey is where the download counts of a share are kept, keyed by file id,
+// and by the empty string for the content of shares other than directories.
+func downloadsKey(name string) string {
+	return "downloads/" + name + ".json"
+}
+
+func getShareDownloads(ctx context.Context, name string) (map[string]int, error) {
+	counts := make(map[string]int)
+	res, err := Client().GetObject(ctx, downloadsKey(name), GetOptions{})
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return counts, nil
+		}
+		return nil, err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+	err = json.NewDecoder(res.Body).Decode(&counts)
+	return counts, err
+}
+
+// downloadsExhausted reports whether the share cannot be downloaded anymore.
+// A directory share is exhausted once each of its files is.
+func downloadsExhausted(share *models.Share, counts map[string]int) bool {
+	if share.Type != "directory" {
+		return counts[""] >= share.MaxDownloads
+	}
+	for _, file := range share.Files {
+		if counts[file.Id] < share.MaxDownloads {
+			return false
+		}
+	}
+	return true
+}
+
+// ShareDownloadsExhausted reports whether the share has reached its download limit.
+func ShareDownloadsExhausted(ctx context.Context, share *models.Share) (bool, error) {
+	if share.MaxDownloads <= 0 {
+		return false, nil
+	}
+	counts, err := getShareDownloads(ctx, share.Name)
+	if err != nil {
+		return false, err
+	}
+	return downloadsExhausted(share, counts), nil
+}
+
+// CountShareDownload counts a download of the share content, or of one file in a directory share.
+// It returns ErrDownloadLimitReached if there are no downloads left,
+// and whether the share is exhausted after this download.
+func CountShareDownload(ctx context.Context, share *models.Share, fileId string) (bool, error) {
+	exhausted := false
+	err := updateJsonObject(ctx, downloadsKey(share.Name), PutOptions{
+		ContentType: "application/json",
+	}, func(counts *map[string]int, _ bool) error {
+		if *counts == nil {
+			*counts = make(map[string]int)
+		}
+		if (*counts)[fileId] >= share.MaxDownloads {
+			return ErrDownloadLimitReached
+		}
+		(*counts)[fileId]++
+		exhausted = downloadsExhausted(share, *counts)
+		return nil
+	})
+	return exhausted, err
+}
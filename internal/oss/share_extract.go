@@ -0,0 +1,204 @@
+package oss
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/jingbh/simple-share/internal/utils"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrArchiveInvalid  = errors.New("invalid or unsupported archive")
+	ErrArchiveTooLarge = errors.New("archive exceeds the extraction limits")
+)
+
+// ExtractShareArchiveOptions An archive uploaded to `uploads/`, to expand into the files of a directory share.
+type ExtractShareArchiveOptions struct {
+	Source    string // the uploaded archive, after `uploads/`
+	Name      string // name of the directory share
+	ExpiresAt *time.Time
+	Key       *ShareKey // encrypts the files, nil if they are not encrypted
+}
+
+// archiveLimits Limits of expanding an archive, as the content is controlled by the uploader.
+type archiveLimits struct {
+	entries int
+	size    int64
+}
+
+// archiveWalkFunc is called with each regular file of an archive, whose content is `size` bytes read from `body`.
+type archiveWalkFunc func(p string, size int64, body io.Reader) error
+
+// ExtractShareArchive expands a ZIP, TAR or gzipped TAR archive into the files of a directory share,
+// and returns the file tree of the share.
+// Directories, links and other special entries are skipped.
+// On error, the files already extracted are left for the caller to delete along with the share.
+func ExtractShareArchive(ctx context.Context, options ExtractShareArchiveOptions) (models.ShareFiles, error) {
+	res, err := Client().GetObject(ctx, "uploads/"+options.Source, GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	limits := archiveLimits{
+		entries: viper.GetInt("archive.max_entries"),
+		size:    viper.GetInt64("archive.max_size"),
+	}
+	var files models.ShareFiles
+	var size int64
+	paths := make(map[string]bool)
+	walk := func(p string, entrySize int64, body io.Reader) error {
+		p, err := archiveEntryPath(p)
+		if err != nil {
+			return err
+		}
+		if paths[p] {
+			return fmt.Errorf("%w: duplicate path %s", ErrArchiveInvalid, p)
+		}
+		paths[p] = true
+
+		size += entrySize
+		if len(files) >= limits.entries || size > limits.size {
+			return ErrArchiveTooLarge
+		}
+
+		id, err := generateFileId()
+		if err != nil {
+			return err
+		}
+		// the server reads every byte, so the checksum comes for free
+		hash := sha256.New()
+		err = CreateShare(ctx, CreateShareOptions{
+			Type:      "file",
+			Body:      io.TeeReader(body, hash),
+			Size:      entrySize,
+			Name:      utils.ExtractFilename(p),
+			Path:      options.Name + ".d/" + id + ".bin",
+			ExpiresAt: options.ExpiresAt,
+			Key:       options.Key,
+		})
+		if err != nil {
+			return err
+		}
+		files = append(files, models.ShareFile{Id: id, Path: p, SHA256: hex.EncodeToString(hash.Sum(nil))})
+		return nil
+	}
+
+	// the format is told by the leading bytes, like the `file` command does
+	br := bufio.NewReaderSize(res.Body, 512)
+	magic, _ := br.Peek(512)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		err = walkZip(br, limits, walk)
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		var gr *gzip.Reader
+		gr, err = gzip.NewReader(br)
+		if err == nil {
+			err = walkTar(gr, walk)
+		}
+	case len(magic) == 512 && string(magic[257:262]) == "ustar":
+		err = walkTar(br, walk)
+	default:
+		err = ErrArchiveInvalid
+	}
+	if err == nil && len(files) == 0 {
+		err = fmt.Errorf("%w: no files in the archive", ErrArchiveInvalid)
+	}
+	if errors.Is(err, zip.ErrFormat) || errors.Is(err, tar.ErrHeader) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w: %s", ErrArchiveInvalid, err)
+	}
+	return files, err
+}
+
+// archiveEntryPath returns the path of an archive entry inside the share.
+// Paths escaping the archive are rejected instead of cleaned, as the archive is likely malicious.
+func archiveEntryPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if path.IsAbs(name) || slices.Contains(strings.Split(name, "/"), "..") {
+		return "", fmt.Errorf("%w: path %s escapes the archive", ErrArchiveInvalid, name)
+	}
+	p, ok := cleanSharePath(name)
+	if !ok {
+		return "", fmt.Errorf("%w: empty path", ErrArchiveInvalid)
+	}
+	return p, nil
+}
+
+// walkZip reads a ZIP archive, which needs random access, so it is copied into a temporary file first.
+func walkZip(r io.Reader, limits archiveLimits, walk archiveWalkFunc) error {
+	f, err := os.CreateTemp("", "simple-share-*.zip")
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(f)
+
+	// an archive is not larger than its content, besides the headers
+	n, err := io.Copy(f, io.LimitReader(r, limits.size+int64(limits.entries)*1024+1))
+	if err != nil {
+		return err
+	}
+	if n > limits.size+int64(limits.entries)*1024 {
+		return ErrArchiveTooLarge
+	}
+
+	zr, err := zip.NewReader(f, n)
+	if err != nil {
+		return err
+	}
+	for _, file := range zr.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		body, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = walk(file.Name, int64(file.UncompressedSize64), body)
+		_ = body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTar reads a TAR archive as it is streamed.
+func walkTar(r io.Reader, walk archiveWalkFunc) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = walk(header.Name, header.Size, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
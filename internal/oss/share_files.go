@@ -0,0 +1,260 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/jingbh/simple-share/internal/utils"
+	"io"
+	"math/rand/v2"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotDirectory         = errors.New("share is not a directory")
+	ErrShareFileNotFound    = errors.New("file not found in share")
+	ErrShareFilePathTaken   = errors.New("path already exists in share")
+	ErrShareFilePathInvalid = errors.New("invalid file path")
+	ErrShareFileLast        = errors.New("cannot remove the last file of a share")
+)
+
+// ShareFileOptions A file uploaded to `uploads/` to add into a directory share.
+type ShareFileOptions struct {
+	Id   string
+	Path string
+}
+
+// cleanSharePath normalizes a path inside a directory share, and reports whether it is valid.
+func cleanSharePath(p string) (string, bool) {
+	p = strings.TrimPrefix(path.Clean("/"+strings.TrimSpace(p)), "/")
+	return p, p != ""
+}
+
+// shareTree is the file tree of a directory share, along with the attributes of the tree object.
+type shareTree struct {
+	meta  *ObjectMeta
+	etag  string
+	files models.ShareFiles
+}
+
+func readShareTree(ctx context.Context, name string) (*shareTree, error) {
+	client := Client()
+
+	key := "shares/" + name
+	meta, err := client.HeadObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Meta("Share-Type") != "directory" {
+		return nil, ErrNotDirectory
+	}
+
+	res, err := client.GetObject(ctx, key, GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	tree := &shareTree{meta: meta, etag: res.Headers.Get("ETag")}
+	if tree.etag != meta.ETag {
+		// changed between the requests
+		return nil, ErrPreconditionFailed
+	}
+	err = json.NewDecoder(res.Body).Decode(&tree.files)
+	return tree, err
+}
+
+// updateShareTree reads the tree of a directory share, and writes it back if `update` reports it changed.
+// The tree is only written if it is unchanged since it was read, otherwise it is read and updated again,
+// so concurrent changes, from other servers as well, are not lost.
+func updateShareTree(ctx context.Context, name string, update func(tree *shareTree) (bool, error)) error {
+	for attempt := 0; ; attempt++ {
+		tree, err := readShareTree(ctx, name)
+		if err == nil {
+			var changed bool
+			changed, err = update(tree)
+			if err != nil || !changed {
+				return err
+			}
+			err = tree.write(ctx, name)
+		}
+		if !errors.Is(err, ErrPreconditionFailed) || attempt == updateMaxAttempts-1 {
+			return err
+		}
+		time.Sleep(time.Duration(rand.IntN(10*(attempt+1))) * time.Millisecond)
+	}
+}
+
+// write replaces the tree object as a whole, so readers never see a partial tree.
+// It fails with ErrPreconditionFailed if the tree has changed since it was read.
+func (t *shareTree) write(ctx context.Context, name string) error {
+	for i := range t.files {
+		// sizes are read from the storage
+		t.files[i].Size = 0
+	}
+	data, err := json.Marshal(t.files)
+	if err != nil {
+		return err
+	}
+
+	putOptions := putOptionsFromMeta(t.meta)
+	keepShareTimes(&putOptions, t.meta)
+	putOptions.ContentMD5 = utils.MD5HashBase64(data)
+	putOptions.IfMatch = t.etag
+	err = Client().PutObject(ctx, "shares/"+name, bytes.NewReader(data), putOptions)
+	if err != nil {
+		return err
+	}
+
+	invalidateShare(name, parseAliases(t.meta.Meta("Share-Aliases")))
+	indexShare(ctx, name)
+	return nil
+}
+
+func (t *shareTree) find(id string) int {
+	for i, file := range t.files {
+		if file.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *shareTree) hasPath(p string) bool {
+	for _, file := range t.files {
+		if file.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// AddShareFiles adds uploaded files into a directory share.
+func AddShareFiles(ctx context.Context, name string, files []ShareFileOptions) error {
+	tree, err := readShareTree(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt *time.Time
+	if t, err := time.Parse(time.RFC3339, tree.meta.Meta("Share-Expires-At")); err == nil {
+		expiresAt = &t
+	}
+	shareKey, err := shareKeyFromMeta(ctx, tree.meta)
+	if err != nil {
+		return err
+	}
+
+	// the files are checked against the tree again when it is written
+	var added []string
+	var newFiles models.ShareFiles
+	var sum string
+	for _, file := range files {
+		p, ok := cleanSharePath(file.Path)
+		if !ok {
+			err = ErrShareFilePathInvalid
+		} else if tree.hasPath(p) || tree.find(file.Id) >= 0 {
+			err = ErrShareFilePathTaken
+		} else if sum, err = GetUploadChecksum(ctx, file.Id); err == nil {
+			key := name + ".d/" + file.Id + ".bin"
+			err = CreateShare(ctx, CreateShareOptions{
+				Type:      "file",
+				Source:    file.Id + ".bin",
+				Name:      utils.ExtractFilename(p),
+				Path:      key,
+				ExpiresAt: expiresAt,
+				SHA256:    sum,
+				Key:       shareKey,
+			})
+			added = append(added, "shares/"+key)
+		}
+		if err != nil {
+			break
+		}
+		newFiles = append(newFiles, models.ShareFile{Id: file.Id, Path: p, SHA256: sum})
+		tree.files = append(tree.files, newFiles[len(newFiles)-1])
+	}
+	if err == nil {
+		err = updateShareTree(ctx, name, func(tree *shareTree) (bool, error) {
+			for _, file := range newFiles {
+				if tree.hasPath(file.Path) || tree.find(file.Id) >= 0 {
+					return false, ErrShareFilePathTaken
+				}
+				tree.files = append(tree.files, file)
+			}
+			return true, nil
+		})
+	}
+	if err != nil && len(added) > 0 {
+		// the files are not in the tree, remove them even if the request is cancelled
+		_ = Client().DeleteObjects(context.Background(), added)
+	}
+	return err
+}
+
+// RemoveShareFile removes a file from a directory share.
+func RemoveShareFile(ctx context.Context, name string, id string) error {
+	err := updateShareTree(ctx, name, func(tree *shareTree) (bool, error) {
+		i := tree.find(id)
+		if i < 0 {
+			return false, ErrShareFileNotFound
+		}
+		if len(tree.files) == 1 {
+			return false, ErrShareFileLast
+		}
+		tree.files = append(tree.files[:i], tree.files[i+1:]...)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	// removed from the tree first, so the tree never refers to a missing file
+	return Client().DeleteObjects(ctx, []string{"shares/" + name + ".d/" + id + ".bin"})
+}
+
+// MoveShareFile changes the path of a file in a directory share.
+func MoveShareFile(ctx context.Context, name string, id string, newPath string) error {
+	p, ok := cleanSharePath(newPath)
+	if !ok {
+		return ErrShareFilePathInvalid
+	}
+	return updateShareTree(ctx, name, func(tree *shareTree) (bool, error) {
+		i := tree.find(id)
+		if i < 0 {
+			return false, ErrShareFileNotFound
+		}
+		if tree.files[i].Path == p {
+			return false, nil
+		}
+		if tree.hasPath(p) {
+			return false, ErrShareFilePathTaken
+		}
+
+		filename := utils.ExtractFilename(p)
+		if filename != utils.ExtractFilename(tree.files[i].Path) {
+			// the file is downloaded with its name
+			client := Client()
+			key := "shares/" + name + ".d/" + id + ".bin"
+			meta, err := client.HeadObject(ctx, key)
+			if err != nil {
+				return false, err
+			}
+			putOptions := putOptionsFromMeta(meta)
+			putOptions.ContentDisposition = utils.AttachmentDisposition(filename)
+			putOptions.Metadata["Share-Filename"] = filename
+			err = client.CopyObject(ctx, key, key, putOptions)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		tree.files[i].Path = p
+		return true, nil
+	})
+}
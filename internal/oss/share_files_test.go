@@ -0,0 +1,53 @@
+package oss
+
+import (
+	"context"
+	"github.com/jingbh/simple-share/internal/models"
+	"strings"
+	"testing"
+)
+
+func TestUpdateShareTreeConflict(t *testing.T) {
+	ctx := context.Background()
+	useStorage(t, newMemoryStorage())
+
+	err := Client().PutObject(ctx, "shares/treetest", strings.NewReader(`[{"id":"a","path":"a.txt"}]`), PutOptions{
+		ContentType: "application/json",
+		Metadata:    map[string]string{"share-type": "directory"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	err = updateShareTree(ctx, "treetest", func(tree *shareTree) (bool, error) {
+		attempts++
+		if attempts == 1 {
+			// another server changes the tree meanwhile
+			err := updateShareTree(ctx, "treetest", func(tree *shareTree) (bool, error) {
+				tree.files = append(tree.files, models.ShareFile{Id: "b", Path: "b.txt"})
+				return true, nil
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+		tree.files = append(tree.files, models.ShareFile{Id: "c", Path: "c.txt"})
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := readShareTree(ctx, "treetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, file := range tree.files {
+		ids = append(ids, file.Id)
+	}
+	if attempts != 2 || strings.Join(ids, ",") != "a,b,c" {
+		t.Fatalf("unexpected tree after %d attempts: %v", attempts, ids)
+	}
+}
@@ -0,0 +1,285 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shareIndexBucket = []byte("shares")
+
+// ErrIndexLocked is returned when the index is held by another process, like the running server.
+var ErrIndexLocked = errors.New("index is in use by another process, send SIGHUP to the running server to rebuild it instead")
+
+// shareIndex An embedded database holding the metadata of every share,
+// so querying shares does not need a round trip to the storage per share.
+// The storage stays the source of truth, and the index can be rebuilt from it at any time.
+type shareIndex struct {
+	db *bolt.DB
+
+	mu sync.Mutex
+	// touched holds the shares written while the index is being rebuilt, which the rebuild leaves as they are
+	touched map[string]bool
+}
+
+// currentIndex is the share index opened by OpenIndex, nil if it is not enabled.
+var currentIndex atomic.Pointer[shareIndex]
+
+// index returns the share index, or nil if it is not enabled.
+func index() *shareIndex {
+	return currentIndex.Load()
+}
+
+// OpenIndex opens the share index at `index.path`, replacing the one already open.
+// Nothing is opened if the index is not enabled.
+func OpenIndex() error {
+	CloseIndex()
+	path := viper.GetString("index.path")
+	if path == "" {
+		return nil
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return ErrIndexLocked
+	}
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(shareIndexBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	currentIndex.Store(&shareIndex{db: db})
+	return nil
+}
+
+// CloseIndex closes the share index, if it is open.
+func CloseIndex() {
+	if idx := currentIndex.Swap(nil); idx != nil {
+		_ = idx.db.Close()
+	}
+}
+
+// touch records a write of the share, if the index is being rebuilt.
+func (i *shareIndex) touch(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.touched != nil {
+		i.touched[name] = true
+	}
+}
+
+func (i *shareIndex) Get(name string) (*models.Share, error) {
+	var share *models.Share
+	err := i.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(shareIndexBucket).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		share = new(models.Share)
+		return json.Unmarshal(data, share)
+	})
+	return share, err
+}
+
+func (i *shareIndex) Put(share *models.Share) error {
+	data, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	i.touch(share.Name)
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(shareIndexBucket).Put([]byte(share.Name), data)
+	})
+}
+
+func (i *shareIndex) Delete(name string) error {
+	i.touch(name)
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(shareIndexBucket).Delete([]byte(name))
+	})
+}
+
+// Scan returns every indexed share whose name starts with `prefix`, ordered by name.
+func (i *shareIndex) Scan(prefix string) ([]*models.Share, error) {
+	var result []*models.Share
+	err := i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(shareIndexBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			share := new(models.Share)
+			if err := json.Unmarshal(v, share); err != nil {
+				return err
+			}
+			result = append(result, share)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Replace swaps the whole index for the given shares, scanned since beginRebuild.
+// The shares written meanwhile are newer than the scan, and kept as they are.
+func (i *shareIndex) Replace(shares []*models.Share) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	touched := i.touched
+	i.touched = nil
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(shareIndexBucket)
+		scanned := make(map[string]bool)
+		for _, share := range shares {
+			scanned[share.Name] = true
+			if touched[share.Name] {
+				continue
+			}
+			data, err := json.Marshal(share)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put([]byte(share.Name), data); err != nil {
+				return err
+			}
+		}
+
+		var stale [][]byte
+		err := bucket.ForEach(func(k, _ []byte) error {
+			if !scanned[string(k)] && !touched[string(k)] {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// beginRebuild starts recording the shares written, until the rebuilt index replaces it.
+func (i *shareIndex) beginRebuild() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.touched = make(map[string]bool)
+}
+
+// endRebuild stops recording the shares written, if the rebuild fails before replacing the index.
+func (i *shareIndex) endRebuild() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.touched = nil
+}
+
+// indexShare reads the share from the storage into the index, if the index is enabled.
+// Failures are only logged, as the index can always be rebuilt.
+func indexShare(ctx context.Context, name string) {
+	idx := index()
+	if idx == nil {
+		return
+	}
+	share, err := fetchShare(ctx, name)
+	if err == nil {
+		if share == nil {
+			err = idx.Delete(name)
+		} else {
+			err = idx.Put(share)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to index share %s: %v\n", name, err)
+	}
+}
+
+// unindexShare removes the share from the index, if the index is enabled.
+func unindexShare(name string) {
+	idx := index()
+	if idx == nil {
+		return
+	}
+	if err := idx.Delete(name); err != nil {
+		log.Printf("Failed to remove share %s from index: %v\n", name, err)
+	}
+}
+
+// RebuildIndex rescans every share in the storage and replaces the index with the result.
+// It returns the number of indexed shares.
+func RebuildIndex(ctx context.Context) (int, error) {
+	idx := index()
+	if idx == nil {
+		return 0, errors.New("index is not enabled, set INDEX_PATH")
+	}
+
+	idx.beginRebuild()
+	defer idx.endRebuild()
+	client := Client()
+	var shares []*models.Share
+	continuationToken := ""
+	for {
+		res, err := client.ListObjects(ctx, ListOptions{
+			Prefix:            "shares/",
+			Delimiter:         "/",
+			ContinuationToken: continuationToken,
+			MaxKeys:           1000,
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, object := range res.Objects {
+			share, err := fetchShare(ctx, strings.TrimPrefix(object.Key, "shares/"))
+			if err != nil {
+				return 0, err
+			}
+			if share != nil {
+				shares = append(shares, share)
+			}
+		}
+		if !res.IsTruncated {
+			break
+		}
+		continuationToken = res.NextContinuationToken
+	}
+
+	return len(shares), idx.Replace(shares)
+}
+
+// StartIndexRebuilder rebuilds the index in the background now, and whenever the process receives SIGHUP,
+// picking up the shares changed behind the server's back, like those expired by the lifecycle rules.
+func StartIndexRebuilder() {
+	if index() == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for {
+			n, err := RebuildIndex(context.Background())
+			if err != nil {
+				log.Println("Failed to rebuild index: ", err)
+			} else {
+				log.Printf("Indexed %d shares\n", n)
+			}
+			<-signals
+		}
+	}()
+}
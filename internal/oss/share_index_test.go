@@ -0,0 +1,37 @@
+package oss
+
+import (
+	"context"
+	"github.com/spf13/viper"
+	"path/filepath"
+	"testing"
+)
+
+// unlistableStorage Storage which fails to list objects.
+type unlistableStorage struct {
+	Storage
+}
+
+func (s *unlistableStorage) ListObjects(context.Context, ListOptions) (*ListResult, error) {
+	return nil, errInjected
+}
+
+func TestRebuildIndexFailure(t *testing.T) {
+	useStorage(t, &unlistableStorage{Storage: newMemoryStorage()})
+	path := viper.GetString("index.path")
+	viper.Set("index.path", filepath.Join(t.TempDir(), "index.db"))
+	t.Cleanup(func() {
+		CloseIndex()
+		viper.Set("index.path", path)
+	})
+	if err := OpenIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RebuildIndex(context.Background()); err == nil {
+		t.Fatal("expected the rebuild to fail")
+	}
+	if index().touched != nil {
+		t.Fatal("writes are still recorded after the failed rebuild")
+	}
+}
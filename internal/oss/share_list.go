@@ -0,0 +1,149 @@
+package oss
+
+import (
+	"context"
+	"github.com/jingbh/simple-share/internal/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const shareListPageSize = 10
+
+// ListSharesOptions Filters and ordering of the shares to list.
+// Empty fields do not filter.
+type ListSharesOptions struct {
+	Creator    string // subject of the creator, required
+	Type       string // `file`, `directory`, `text`, `url`
+	Status     string // `active`, `expired`
+	Protected  *bool  // whether the share has a password
+	Prefix     string // prefix of the share name
+	Sort       string // `name` (default), `createdAt`, `expiresAt`, `size`
+	Descending bool
+	Cursor     string
+}
+
+func (o *ListSharesOptions) match(share *models.Share, now time.Time) bool {
+	if share.Creator == nil || share.Creator.Subject != o.Creator {
+		return false
+	}
+	if o.Type != "" && share.Type != o.Type {
+		return false
+	}
+	if o.Status != "" {
+		expired := share.ExpiresAt != nil && !share.ExpiresAt.After(now)
+		if expired != (o.Status == "expired") {
+			return false
+		}
+	}
+	if o.Protected != nil && (share.Password != "") != *o.Protected {
+		return false
+	}
+	return true
+}
+
+// less reports whether `a` is ordered before `b` by the sort field, ascending.
+// Shares without the field are ordered last, and ties are broken by name.
+func (o *ListSharesOptions) less(a, b *models.Share) bool {
+	compareTime := func(a, b *time.Time) int {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		case b == nil:
+			return -1
+		default:
+			return a.Compare(*b)
+		}
+	}
+
+	result := 0
+	switch o.Sort {
+	case "createdAt":
+		result = compareTime(a.CreatedAt, b.CreatedAt)
+	case "expiresAt":
+		result = compareTime(a.ExpiresAt, b.ExpiresAt)
+	case "size":
+		if a.Size < b.Size {
+			result = -1
+		} else if a.Size > b.Size {
+			result = 1
+		}
+	}
+	if result == 0 {
+		result = strings.Compare(a.Name, b.Name)
+	}
+	if o.Descending {
+		return result > 0
+	}
+	return result < 0
+}
+
+// ListShares returns a page of shares matching the options, and the cursor of the next page,
+// which is empty on the last page.
+// Without the index, every share in the storage is read to filter them by creator,
+// so this gets slow with lots of shares.
+func ListShares(ctx context.Context, options ListSharesOptions) ([]*models.Share, string, error) {
+	shares, err := scanShares(ctx, options.Prefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	var matched []*models.Share
+	for _, share := range shares {
+		if options.match(share, now) {
+			matched = append(matched, share)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return options.less(matched[i], matched[j])
+	})
+
+	offset, _ := strconv.Atoi(options.Cursor)
+	if offset < 0 || offset > len(matched) {
+		offset = len(matched)
+	}
+	end := min(offset+shareListPageSize, len(matched))
+	nextCursor := ""
+	if end < len(matched) {
+		nextCursor = strconv.Itoa(end)
+	}
+	return matched[offset:end], nextCursor, nil
+}
+
+// scanShares returns every share whose name starts with `prefix`.
+func scanShares(ctx context.Context, prefix string) ([]*models.Share, error) {
+	if idx := index(); idx != nil {
+		return idx.Scan(prefix)
+	}
+
+	client := Client()
+	var result []*models.Share
+	continuationToken := ""
+	for {
+		res, err := client.ListObjects(ctx, ListOptions{
+			Prefix:            "shares/" + prefix,
+			Delimiter:         "/",
+			ContinuationToken: continuationToken,
+			MaxKeys:           1000,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range res.Objects {
+			name := strings.TrimPrefix(object.Key, "shares/")
+			share, _ := GetShareCached(ctx, name)
+			if share != nil {
+				result = append(result, share)
+			}
+		}
+		if !res.IsTruncated {
+			break
+		}
+		continuationToken = res.NextContinuationToken
+	}
+	return result, nil
+}
@@ -1,17 +1,23 @@
 package oss
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"regexp"
 )
 
+var ErrShareNameUnavailable = errors.New("share name is invalid or already taken")
+
 // excluded 0, 1, l, o to avoid confusion
 const charset = "abcdefghijkmnpqrstuvwxyz23456789"
 
 // allowed name pattern
 const validPattern = `^[a-zA-Z0-9]{2,64}$`
 
+var shareNamePattern = regexp.MustCompile(validPattern)
+
 func generateShareName(length int) string {
 	b := make([]byte, length)
 	for i := range b {
@@ -32,13 +38,15 @@ func GenerateShareName(length int) (string, error) {
 
 func CheckShareName(name string) bool {
 	// check pattern
-	re, err := regexp.Compile(validPattern)
-	if err != nil || !re.MatchString(name) {
+	if !shareNamePattern.MatchString(name) {
 		return false
 	}
 
-	// check existence
+	// check existence, of both shares and aliases
 	client := Client()
-	_, err = client.GetObjectMeta("shares/" + name)
+	if _, err := client.HeadObject(context.Background(), "shares/"+name); err == nil {
+		return false
+	}
+	_, err := client.HeadObject(context.Background(), aliasKey(name))
 	return err != nil // object does not exist, then name is available
 }
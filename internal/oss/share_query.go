@@ -4,13 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/jingbh/simple-share/internal/models"
 	"github.com/jingbh/simple-share/internal/utils"
+	"io"
+	"log"
 	"net/http"
-	"regexp"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -26,26 +26,73 @@ type GetShareContentLinkOptions struct {
 	ContentType string
 }
 
+// GetShare returns the share with the name, or the share it is an alias of.
 func GetShare(ctx context.Context, name string) (*models.Share, error) {
+	share, err := getShare(ctx, name)
+	if err != nil || share != nil {
+		return share, err
+	}
+
+	target, err := resolveAlias(ctx, name)
+	if err != nil || target == "" {
+		return nil, err
+	}
+	share, err = getShare(ctx, target)
+	if err != nil || share == nil || !slices.Contains(share.Aliases, name) {
+		// the alias is left over from a share which no longer has it
+		return nil, err
+	}
+	return share, nil
+}
+
+// getShare returns the share from the index if enabled, or the storage.
+func getShare(ctx context.Context, name string) (*models.Share, error) {
+	idx := index()
+	if idx == nil {
+		return fetchShare(ctx, name)
+	}
+
+	share, err := idx.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if share != nil {
+		// trusted without reading the storage, a share deleted behind the server's back
+		// is removed once its content is found missing, see GetShareContent
+		return share, nil
+	}
+
+	// not indexed yet, e.g. created before the index was enabled
+	share, err = fetchShare(ctx, name)
+	if err == nil && share != nil {
+		if err := idx.Put(share); err != nil {
+			log.Printf("Failed to index share %s: %v\n", name, err)
+		}
+	}
+	return share, err
+}
+
+// fetchShare reads the share from the storage, bypassing the index.
+func fetchShare(ctx context.Context, name string) (*models.Share, error) {
 	client := Client()
 
 	key := "shares/" + name
-	res, err := client.GetObjectDetailedMeta(key, oss.WithContext(ctx))
+	res, err := client.HeadObject(ctx, key)
 	if err != nil {
-		var ossErr oss.ServiceError
-		if errors.As(err, &ossErr) && ossErr.Code == "NoSuchKey" {
+		if errors.Is(err, ErrObjectNotFound) {
 			return nil, nil
 		}
 		return nil, err
 	}
 
-	shareType := res.Get(oss.HTTPHeaderOssMetaPrefix + "Share-Type")
-	expiry, _ := strconv.Atoi(res.Get(oss.HTTPHeaderOssMetaPrefix + "Share-Expiry"))
-	size, _ := strconv.ParseInt(res.Get(oss.HTTPHeaderContentLength), 10, 64)
+	shareType := res.Meta("Share-Type")
+	expiry, _ := strconv.Atoi(res.Meta("Share-Expiry"))
+	maxDownloads, _ := strconv.Atoi(res.Meta("Share-Max-Downloads"))
+	size := shareObjectSize(res)
 
 	var creator *models.ShareCreator = nil
 	{
-		creatorJson := res.Get(oss.HTTPHeaderOssMetaPrefix + "Share-Creator")
+		creatorJson := res.Meta("Share-Creator")
 		if creatorJson != "" {
 			creator = new(models.ShareCreator)
 			_ = json.Unmarshal([]byte(creatorJson), creator)
@@ -53,54 +100,48 @@ func GetShare(ctx context.Context, name string) (*models.Share, error) {
 	}
 
 	var createdAt *time.Time = nil
-	{
-		createdAtTime, err := http.ParseTime(res.Get(oss.HTTPHeaderLastModified))
-		if err == nil {
-			createdAt = &createdAtTime
-		}
+	if t, err := time.Parse(time.RFC3339, res.Meta("Share-Created-At")); err == nil {
+		// the share has been updated since its creation
+		createdAt = &t
+	} else if !res.LastModified.IsZero() {
+		createdAt = &res.LastModified
 	}
 
-	var expiresAt *time.Time = nil
-	{
-		expirationHeader := res.Get("X-OSS-Expiration")
-		expiryPattern := `expiry-date=\"(.+?)\"`
-		expiryRegex, err := regexp.Compile(expiryPattern)
-		if err == nil {
-			match := expiryRegex.FindStringSubmatch(expirationHeader)
-			if len(match) > 1 {
-				expiresAtTime, err := http.ParseTime(match[1])
-				if err == nil {
-					expiresAt = &expiresAtTime
-				}
-			}
-		}
+	expiresAt := res.ExpiresAt
+	if t, err := time.Parse(time.RFC3339, res.Meta("Share-Expires-At")); err == nil {
+		expiresAt = &t
 	}
 
 	var files models.ShareFiles = nil
 	if shareType == "directory" {
 		// get file tree and calculate total size
-		filesJsonReader, err := client.GetObject(key, oss.WithContext(ctx))
+		filesJson, err := client.GetObject(ctx, key, GetOptions{})
 		if err == nil {
-			err = json.NewDecoder(filesJsonReader).Decode(&files)
+			_ = json.NewDecoder(filesJson.Body).Decode(&files)
+			_ = filesJson.Body.Close()
 		}
 
 		var dirSize int64 = 0
 		continuationToken := ""
 		for {
-			ossListOptions := []oss.Option{
-				oss.WithContext(ctx),
-				oss.MaxKeys(1000),
-				oss.Prefix(key),
-			}
-			if continuationToken != "" {
-				ossListOptions = append(ossListOptions, oss.ContinuationToken(continuationToken))
-			}
-
-			dirRes, err := client.ListObjectsV2(ossListOptions...)
+			dirRes, err := client.ListObjects(ctx, ListOptions{
+				Prefix:            key + ".d/",
+				ContinuationToken: continuationToken,
+				MaxKeys:           1000,
+			})
 			if err != nil {
 				break
 			}
 			for _, object := range dirRes.Objects {
+				if object.Size == 0 {
+					// may refer to a blob
+					if meta, err := client.HeadObject(ctx, object.Key); err == nil {
+						object.Size = shareObjectSize(meta)
+					}
+				} else if res.Meta("Share-Key") != "" {
+					// files of encrypted directory shares are all encrypted
+					object.Size = decryptedSize(object.Size)
+				}
 				if files != nil {
 					for fileKey, file := range files {
 						if object.Key == key+".d/"+file.Id+".bin" {
@@ -120,117 +161,87 @@ func GetShare(ctx context.Context, name string) (*models.Share, error) {
 			size = dirSize
 		}
 	} else if shareType == "file" {
-		filename := res.Get(oss.HTTPHeaderOssMetaPrefix + "Share-Filename")
+		filename := res.Meta("Share-Filename")
 		files = models.ShareFiles{{
-			Path: filename,
-			Size: size,
+			Path:   filename,
+			Size:   size,
+			SHA256: res.Meta("Share-SHA256"),
 		}}
 	}
 
 	return &models.Share{
-		Type:        shareType,
-		Name:        name,
-		DisplayName: res.Get(oss.HTTPHeaderOssMetaPrefix + "Share-Display-Name"),
-		Password:    res.Get(oss.HTTPHeaderOssMetaPrefix + "Share-Password"),
-		Expiry:      expiry,
-		Size:        size,
-		CreatedAt:   createdAt,
-		ExpiresAt:   expiresAt,
-		Files:       files,
-		Creator:     creator,
+		Type:          shareType,
+		Name:          name,
+		DisplayName:   res.Meta("Share-Display-Name"),
+		Password:      res.Meta("Share-Password"),
+		Expiry:        expiry,
+		Size:          size,
+		CreatedAt:     createdAt,
+		ExpiresAt:     expiresAt,
+		Files:         files,
+		Creator:       creator,
+		MaxDownloads:  maxDownloads,
+		BurnAfterRead: res.Meta("Share-Burn-After-Read") == "true",
+		Site:          res.Meta("Share-Site") == "true",
+		Aliases:       parseAliases(res.Meta("Share-Aliases")),
+		Encrypted:     res.Meta("Share-Key") != "",
 	}, nil
 }
 
-func ListShares(ctx context.Context, continuationToken string) ([]*models.Share, string, error) {
-	client := Client()
-
-	var result []*models.Share
-	ossOptions := []oss.Option{
-		oss.WithContext(ctx),
-		oss.MaxKeys(10),
-		oss.Prefix("shares/"),
-		oss.Delimiter("/"),
-	}
-	if continuationToken != "" {
-		ossOptions = append(ossOptions, oss.ContinuationToken(continuationToken))
-	}
-	res, err := client.ListObjectsV2(ossOptions...)
-	if err != nil {
-		return nil, "", err
-	}
-
-	for _, object := range res.Objects {
-		name := strings.TrimPrefix(object.Key, res.Prefix)
-		share, _ := GetShareCached(ctx, name)
-		if share != nil {
-			result = append(result, share)
-		}
-	}
-	if res.IsTruncated {
-		return result, res.NextContinuationToken, nil
-	} else {
-		return result, "", nil
-	}
-}
-
-func GetShareContent(ctx context.Context, options GetShareContentOptions) (*oss.Response, error) {
-	client := Client()
-
+func GetShareContent(ctx context.Context, options GetShareContentOptions) (*ObjectResponse, error) {
 	key := "shares/" + options.Name
 	if options.FileId != "" {
 		key += ".d/" + options.FileId + ".bin"
 	}
 
-	ossOptions := []oss.Option{
-		oss.WithContext(ctx),
-	}
+	var getOptions GetOptions
 	if options.Headers != nil {
-		for k, vs := range options.Headers {
-			if k == http.CanonicalHeaderKey("X-OSS-Process") && len(vs) > 0 {
-				ossOptions = append(ossOptions, oss.Process(vs[0]))
-				continue
-			}
-			for _, v := range vs {
-				ossOptions = append(ossOptions, oss.SetHeader(k, v))
-			}
-		}
+		getOptions.Range = options.Headers.Get("Range")
+		getOptions.Process = options.Headers.Get("X-OSS-Process")
 	}
 
-	res, err := client.DoGetObject(&oss.GetObjectRequest{
-		ObjectKey: key,
-	}, ossOptions)
+	res, err := getShareObject(ctx, key, getOptions)
 	if err != nil {
-		var ossErr oss.ServiceError
-		if errors.As(err, &ossErr) && ossErr.Code == "NoSuchKey" {
+		if errors.Is(err, ErrObjectNotFound) {
+			if options.FileId == "" {
+				// deleted behind the server's back, like by the lifecycle rules
+				unindexShare(options.Name)
+				invalidateShare(options.Name, nil)
+			}
 			return nil, nil
 		}
 		return nil, err
 	}
 
-	return res.Response, nil
+	return res, nil
 }
 
 func GetShareContentLink(ctx context.Context, options GetShareContentLinkOptions) (string, error) {
-	client := PublicClient()
+	client := Client()
 
 	key := "shares/" + options.Name
 	if options.FileId != "" {
 		key += ".d/" + options.FileId + ".bin"
 	}
 
-	ossOptions := []oss.Option{
-		oss.WithContext(ctx),
+	signOptions := SignOptions{
+		ContentType: options.ContentType,
 	}
-	if options.ContentType != "" {
-		ossOptions = append(ossOptions, oss.ResponseContentType(options.ContentType))
+	target, meta, err := resolveShareObject(ctx, key)
+	if err != nil {
+		return "", err
 	}
-
-	return client.SignURL(key, oss.HTTPGet, 3600, ossOptions...)
+	if meta.Meta("Share-Nonce") != "" {
+		// encrypted content can only be decrypted by the server
+		return "", ErrNotSupported
+	}
+	if target != key {
+		signOptions.ContentDisposition = meta.ContentDisposition
+	}
+	return client.SignURL(ctx, target, http.MethodGet, time.Hour, signOptions)
 }
 
 func GetShareContentType(ctx context.Context, name string, fileId string) (models.FileType, error) {
-	client := Client()
-
 	key := "shares/" + name
 	if fileId != "" {
 		key += ".d/" + fileId + ".bin"
@@ -238,22 +249,21 @@ func GetShareContentType(ctx context.Context, name string, fileId string) (model
 
 	// https://github.com/h2non/filetype#file-header
 	// Only first 262 bytes representing the max file header is required
-	ossOptions := []oss.Option{
-		oss.WithContext(ctx),
-		oss.Range(0, 262),
-	}
-	res, err := client.DoGetObject(&oss.GetObjectRequest{
-		ObjectKey: key,
-	}, ossOptions)
+	res, err := getShareObject(ctx, key, GetOptions{
+		Range: "bytes=0-261",
+	})
 	if err != nil {
 		return models.FileTypeUnknown, err
 	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
 
 	head := make([]byte, 262)
-	_, err = res.Response.Body.Read(head)
-	if err != nil && err.Error() != "EOF" {
+	n, err := io.ReadFull(res.Body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
 		return models.FileTypeUnknown, err
 	}
 
-	return utils.DeduceFileType(head)
+	return utils.DeduceFileType(head[:n])
 }
@@ -0,0 +1,98 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+)
+
+// RenameShare moves the share, along with the files of a directory share, to a new name.
+// The aliases of the share are kept and point to the new name, and so do the file requests into the share.
+func RenameShare(ctx context.Context, name string, newName string) error {
+	client := Client()
+
+	if !CheckShareName(newName) {
+		return ErrShareNameUnavailable
+	}
+
+	key := "shares/" + name
+	meta, err := client.HeadObject(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	err = copyShareObjects(ctx, name, newName, meta)
+	if err != nil {
+		// remove the partial copy, even if the request is cancelled
+		_ = deleteShareObjects(context.Background(), newName)
+		return err
+	}
+
+	// the aliases are moved before the source is deleted, so they never point to a missing share
+	aliases := parseAliases(meta.Meta("Share-Aliases"))
+	err = putAliases(ctx, newName, aliases)
+	if err != nil {
+		// point the aliases back and remove the copy, even if the request is cancelled
+		_ = putAliases(context.Background(), name, aliases)
+		_ = deleteShareObjects(context.Background(), newName)
+		invalidateShare(name, aliases)
+		return err
+	}
+
+	// the copy is the share from now on, so the source is not restored if it is partly deleted
+	err = deleteShareObjects(ctx, name)
+	if err != nil {
+		log.Printf("Failed to delete share %s after renaming it to %s: %v\n", name, newName, err)
+	}
+
+	invalidateShare(name, aliases)
+	shareCache.Delete(newName)
+	unindexShare(name)
+	indexShare(ctx, newName)
+	renameFileRequestShares(ctx, name, newName)
+	return nil
+}
+
+// copyShareObjects copies the files and the download counts of a share, and finally the share itself.
+func copyShareObjects(ctx context.Context, name string, newName string, meta *ObjectMeta) error {
+	client := Client()
+
+	prefix := "shares/" + name + ".d/"
+	children, err := listAllObjects(ctx, client, prefix)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		childMeta, err := client.HeadObject(ctx, child.Key)
+		if err != nil {
+			return err
+		}
+		newKey := "shares/" + newName + ".d/" + strings.TrimPrefix(child.Key, prefix)
+		err = copyShareObject(ctx, child.Key, newKey, childMeta, putOptionsFromMeta(childMeta))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.CopyObject(ctx, downloadsKey(name), downloadsKey(newName), PutOptions{
+		ContentType: "application/json",
+	})
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+
+	putOptions := putOptionsFromMeta(meta)
+	keepShareTimes(&putOptions, meta)
+	return copyShareObject(ctx, "shares/"+name, "shares/"+newName, meta, putOptions)
+}
+
+// copyShareObject copies a share object, which is another reference to its blob if it has one.
+func copyShareObject(ctx context.Context, key string, newKey string, meta *ObjectMeta, putOptions PutOptions) error {
+	if sum := meta.Meta("Share-Blob"); sum != "" {
+		if _, err := acquireBlob(ctx, sum, ""); err != nil {
+			return err
+		}
+	}
+	return Client().CopyObject(ctx, key, newKey, putOptions)
+}
@@ -0,0 +1,87 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// failingStorage Storage whose writes of the keys matching `fail`, if set, fail.
+type failingStorage struct {
+	Storage
+	fail func(key string) bool
+}
+
+var errInjected = errors.New("injected failure")
+
+func (s *failingStorage) PutObject(ctx context.Context, key string, body io.Reader, options PutOptions) error {
+	if s.fail != nil && s.fail(key) {
+		return errInjected
+	}
+	return s.Storage.PutObject(ctx, key, body, options)
+}
+
+func (s *failingStorage) CopyObject(ctx context.Context, src string, dst string, options PutOptions) error {
+	if s.fail != nil && s.fail(dst) {
+		return errInjected
+	}
+	return s.Storage.CopyObject(ctx, src, dst, options)
+}
+
+// useStorage makes `storage` the client of the package for the duration of the test.
+func useStorage(t *testing.T, storage Storage) {
+	client := Client
+	Client = func() Storage {
+		return storage
+	}
+	t.Cleanup(func() {
+		Client = client
+	})
+}
+
+func TestRenameShareRollback(t *testing.T) {
+	ctx := context.Background()
+	storage := &failingStorage{Storage: newMemoryStorage()}
+	useStorage(t, storage)
+
+	err := storage.PutObject(ctx, "shares/renamefrom", strings.NewReader("content"), PutOptions{
+		Metadata: map[string]string{"share-type": "text", "share-aliases": "renamealias"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = putAliases(ctx, "renamefrom", []string{"renamealias"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, failing := range []string{"shares/renameto", aliasKey("renamealias")} {
+		storage.fail = func(key string) bool {
+			return key == failing
+		}
+		if err = RenameShare(ctx, "renamefrom", "renameto"); !errors.Is(err, errInjected) {
+			t.Fatalf("%s: expected the injected failure, got %v", failing, err)
+		}
+		if _, err = storage.HeadObject(ctx, "shares/renamefrom"); err != nil {
+			t.Fatalf("%s: source missing after rollback: %v", failing, err)
+		}
+		if _, err = storage.HeadObject(ctx, "shares/renameto"); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("%s: copy left after rollback: %v", failing, err)
+		}
+		if name, err := resolveAlias(ctx, "renamealias"); err != nil || name != "renamefrom" {
+			t.Fatalf("%s: unexpected alias after rollback: %q %v", failing, name, err)
+		}
+	}
+
+	storage.fail = nil
+	if err = RenameShare(ctx, "renamefrom", "renameto"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.HeadObject(ctx, "shares/renamefrom"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("source left after rename: %v", err)
+	}
+	if name, err := resolveAlias(ctx, "renamealias"); err != nil || name != "renameto" {
+		t.Fatalf("unexpected alias after rename: %q %v", name, err)
+	}
+}
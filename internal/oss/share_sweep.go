@@ -0,0 +1,56 @@
+package oss
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// SweepExpiredShares deletes every share which has expired, and returns the number of deleted shares.
+func SweepExpiredShares(ctx context.Context) (int, error) {
+	shares, err := scanShares(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	count := 0
+	for _, share := range shares {
+		if share.ExpiresAt == nil || share.ExpiresAt.After(now) {
+			continue
+		}
+		if err = DeleteShare(ctx, share.Name); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// StartShareSweeper deletes expired shares, file requests and uploads in the background every 10 minutes.
+// Until then, expired shares are rejected when accessed.
+func StartShareSweeper() {
+	go func() {
+		for {
+			n, err := SweepExpiredShares(context.Background())
+			if err != nil {
+				log.Println("Failed to sweep expired shares: ", err)
+			} else if n > 0 {
+				log.Printf("Swept %d expired shares\n", n)
+			}
+			n, err = SweepExpiredFileRequests(context.Background())
+			if err != nil {
+				log.Println("Failed to sweep expired file requests: ", err)
+			} else if n > 0 {
+				log.Printf("Swept %d expired file requests\n", n)
+			}
+			n, err = SweepExpiredUploads(context.Background())
+			if err != nil {
+				log.Println("Failed to sweep expired uploads: ", err)
+			} else if n > 0 {
+				log.Printf("Aborted %d expired uploads\n", n)
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+}
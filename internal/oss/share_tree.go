@@ -0,0 +1,93 @@
+package oss
+
+import (
+	"github.com/jingbh/simple-share/internal/models"
+	"path"
+	"slices"
+	"strings"
+)
+
+// GetShareTree returns the directories and files right under `p` in the file tree of a directory share.
+// Paths of the files are cleaned, the same as in archives.
+// It returns false if there is no such directory.
+func GetShareTree(files models.ShareFiles, p string) (*models.ShareTree, bool) {
+	p, _ = cleanSharePath(p)
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+
+	tree := &models.ShareTree{
+		Path:        p,
+		Directories: []models.ShareTreeDirectory{},
+		Files:       models.ShareFiles{},
+	}
+	found := p == ""
+	directories := make(map[string]int)
+	for _, file := range files {
+		file.Path = archiveEntryName(file)
+		rest, ok := strings.CutPrefix(file.Path, prefix)
+		if !ok {
+			continue
+		}
+		found = true
+
+		name, _, isDirectory := strings.Cut(rest, "/")
+		if !isDirectory {
+			tree.Files = append(tree.Files, file)
+			continue
+		}
+		i, ok := directories[name]
+		if !ok {
+			i = len(tree.Directories)
+			directories[name] = i
+			tree.Directories = append(tree.Directories, models.ShareTreeDirectory{
+				Name: name,
+				Path: prefix + name,
+			})
+		}
+		tree.Directories[i].Size += file.Size
+		tree.Directories[i].FileCount++
+	}
+	if !found {
+		return nil, false
+	}
+
+	slices.SortFunc(tree.Directories, func(a, b models.ShareTreeDirectory) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	slices.SortFunc(tree.Files, func(a, b models.ShareFile) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return tree, true
+}
+
+// FindShareFile returns the file of a directory share at the path.
+func FindShareFile(files models.ShareFiles, p string) (models.ShareFile, bool) {
+	p, ok := cleanSharePath(p)
+	if !ok {
+		return models.ShareFile{}, false
+	}
+	for _, file := range files {
+		if archiveEntryName(file) == p {
+			return file, true
+		}
+	}
+	return models.ShareFile{}, false
+}
+
+// ResolveSiteFile returns the file of a website at the path, which is the `index.html` of a directory.
+// It also reports whether the path is a directory without the trailing slash,
+// to which the client should be redirected so relative links resolve.
+func ResolveSiteFile(files models.ShareFiles, p string) (file models.ShareFile, redirect bool, ok bool) {
+	isDirectory := p == "" || strings.HasSuffix(p, "/")
+	if !isDirectory {
+		if file, ok := FindShareFile(files, p); ok {
+			return file, false, true
+		}
+	}
+	if file, ok := FindShareFile(files, path.Join(p, "index.html")); ok {
+		return file, !isDirectory, true
+	}
+	return models.ShareFile{}, false, false
+}
@@ -0,0 +1,256 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"github.com/jingbh/simple-share/internal/utils"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpdateShareOptions Changes to the metadata of an existing share.
+// Nil fields are left unchanged.
+type UpdateShareOptions struct {
+	Name        string
+	DisplayName *string    // empty removes the display name
+	Password    *string    // empty removes the password
+	ExpiresAt   *time.Time // the zero time removes the expiry
+	Aliases     *[]string  // replaces all aliases
+	Site        *bool
+}
+
+// putOptionsFromMeta returns options which keep all attributes of the object when copied.
+func putOptionsFromMeta(meta *ObjectMeta) PutOptions {
+	options := PutOptions{
+		ContentType:        meta.ContentType,
+		ContentDisposition: meta.ContentDisposition,
+		CacheControl:       meta.CacheControl,
+		Metadata:           make(map[string]string),
+	}
+	for k, v := range meta.Metadata {
+		options.Metadata[k] = v
+	}
+	if expiry, _ := strconv.Atoi(meta.Meta("Share-Expiry")); expiry > 0 {
+		options.Tags = map[string]string{
+			"period": strconv.Itoa(expiry),
+		}
+	}
+	return options
+}
+
+// keepShareTimes keeps the creation and expiration time of a share when it is rewritten.
+func keepShareTimes(options *PutOptions, meta *ObjectMeta) {
+	if options.Metadata["Share-Created-At"] == "" {
+		// rewriting changes the modification time, which is used as the creation time
+		options.Metadata["Share-Created-At"] = meta.LastModified.UTC().Format(time.RFC3339)
+	}
+	if options.Metadata["Share-Expires-At"] == "" && meta.ExpiresAt != nil {
+		// created before the expiry was enforced by the server, keep the expiry of the lifecycle rules
+		options.Metadata["Share-Expires-At"] = meta.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+}
+
+// setExpiry updates the expiry metadata, and the `period` tag which drives the lifecycle rules.
+func (o *PutOptions) setExpiry(expiresAt *time.Time) {
+	o.Tags = nil
+	if expiresAt == nil {
+		o.Metadata["Share-Expiry"] = "0"
+		delete(o.Metadata, "Share-Expires-At")
+		return
+	}
+
+	period := lifecyclePeriod(*expiresAt)
+	o.Metadata["Share-Expiry"] = strconv.Itoa(period)
+	o.Metadata["Share-Expires-At"] = expiresAt.UTC().Format(time.RFC3339)
+	if period > 0 {
+		o.Tags = map[string]string{
+			"period": strconv.Itoa(period),
+		}
+	}
+}
+
+// UpdateShare rewrites the metadata of the share in place, without transferring its content.
+func UpdateShare(ctx context.Context, options UpdateShareOptions) error {
+	client := Client()
+
+	key := "shares/" + options.Name
+	meta, err := client.HeadObject(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	putOptions := putOptionsFromMeta(meta)
+	keepShareTimes(&putOptions, meta)
+
+	oldAliases := parseAliases(meta.Meta("Share-Aliases"))
+	var removedAliases []string
+	if options.Aliases != nil {
+		var addedAliases []string
+		for _, alias := range *options.Aliases {
+			if !slices.Contains(oldAliases, alias) {
+				if alias == options.Name || !CheckShareName(alias) {
+					return ErrShareNameUnavailable
+				}
+				addedAliases = append(addedAliases, alias)
+			}
+		}
+		for _, alias := range oldAliases {
+			if !slices.Contains(*options.Aliases, alias) {
+				removedAliases = append(removedAliases, aliasKey(alias))
+			}
+		}
+
+		err = putAliases(ctx, options.Name, addedAliases)
+		if err != nil {
+			return err
+		}
+		if len(*options.Aliases) > 0 {
+			putOptions.Metadata["Share-Aliases"] = strings.Join(*options.Aliases, ",")
+		} else {
+			delete(putOptions.Metadata, "Share-Aliases")
+		}
+	}
+
+	if options.DisplayName != nil {
+		if *options.DisplayName != "" {
+			putOptions.Metadata["Share-Display-Name"] = *options.DisplayName
+		} else {
+			delete(putOptions.Metadata, "Share-Display-Name")
+		}
+	}
+	var shareKey *ShareKey
+	if options.Password != nil {
+		if *options.Password != "" {
+			passwordHashed, err := utils.HashPassword(*options.Password)
+			if err != nil {
+				return err
+			}
+			putOptions.Metadata["Share-Password"] = passwordHashed
+		} else {
+			delete(putOptions.Metadata, "Share-Password")
+		}
+		// the key of an encrypted share is wrapped by its password, if it has one
+		shareKey, err = rewrapShareKey(ctx, meta, *options.Password)
+		if err != nil {
+			return err
+		}
+		if shareKey != nil {
+			putOptions.Metadata["Share-Key"] = shareKey.wrapped
+		}
+	}
+	if options.Site != nil {
+		if *options.Site {
+			putOptions.Metadata["Share-Site"] = "true"
+		} else {
+			delete(putOptions.Metadata, "Share-Site")
+		}
+	}
+	var expiresAt *time.Time
+	if options.ExpiresAt != nil {
+		if !options.ExpiresAt.IsZero() {
+			expiresAt = options.ExpiresAt
+		}
+		putOptions.setExpiry(expiresAt)
+	}
+
+	// files of a directory share expire along with it, and have the same key
+	if meta.Meta("Share-Type") == "directory" && (options.ExpiresAt != nil || shareKey != nil) {
+		restore, err := updateShareChildren(ctx, options.Name, func(childOptions *PutOptions) {
+			if options.ExpiresAt != nil {
+				childOptions.setExpiry(expiresAt)
+			}
+			if shareKey != nil {
+				childOptions.Metadata["Share-Key"] = shareKey.wrapped
+			}
+		})
+		if err == nil {
+			// written last, and only if unchanged meanwhile, like by files added with the old key
+			err = rewriteShareObject(ctx, key, meta.ETag, putOptions)
+		}
+		if err != nil {
+			// the files are restored even if the request is cancelled, so they never have another key than the share
+			restore()
+			return err
+		}
+	} else {
+		err = client.CopyObject(ctx, key, key, putOptions)
+		if err != nil {
+			return err
+		}
+	}
+	if len(removedAliases) > 0 {
+		err = client.DeleteObjects(ctx, removedAliases)
+		if err != nil {
+			return err
+		}
+	}
+
+	invalidateShare(options.Name, oldAliases)
+	indexShare(ctx, options.Name)
+	return nil
+}
+
+// updateShareChildren rewrites the metadata of every file in a directory share.
+// It returns a function which restores the metadata of the files rewritten, also when it fails partway.
+func updateShareChildren(ctx context.Context, name string, update func(*PutOptions)) (func(), error) {
+	client := Client()
+
+	var rewritten []string
+	var previous []PutOptions
+	restore := func() {
+		for i, key := range rewritten {
+			if err := client.CopyObject(context.Background(), key, key, previous[i]); err != nil {
+				log.Printf("Failed to restore file %s of share %s: %v\n", key, name, err)
+			}
+		}
+	}
+
+	children, err := listAllObjects(ctx, client, "shares/"+name+".d/")
+	if err != nil {
+		return restore, err
+	}
+	for _, child := range children {
+		meta, err := client.HeadObject(ctx, child.Key)
+		if err != nil {
+			return restore, err
+		}
+		putOptions := putOptionsFromMeta(meta)
+		update(&putOptions)
+		err = client.CopyObject(ctx, child.Key, child.Key, putOptions)
+		if err != nil {
+			return restore, err
+		}
+		rewritten = append(rewritten, child.Key)
+		previous = append(previous, putOptionsFromMeta(meta))
+	}
+	return restore, nil
+}
+
+// rewriteShareObject rewrites the attributes of a directory share object, if it still has the ETag `etag`.
+// Its content is the file tree, which is small enough to be written again.
+func rewriteShareObject(ctx context.Context, key string, etag string, putOptions PutOptions) error {
+	client := Client()
+
+	res, err := client.GetObject(ctx, key, GetOptions{})
+	if err != nil {
+		return err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+	if res.Headers.Get("ETag") != etag {
+		return ErrPreconditionFailed
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	putOptions.ContentMD5 = utils.MD5HashBase64(data)
+	putOptions.IfMatch = etag
+	return client.PutObject(ctx, key, bytes.NewReader(data), putOptions)
+}
@@ -0,0 +1,64 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateShareRollback(t *testing.T) {
+	ctx := context.Background()
+	storage := &failingStorage{Storage: newMemoryStorage()}
+	useStorage(t, storage)
+
+	err := storage.PutObject(ctx, "shares/updatedir", strings.NewReader(`[{"id":"a","path":"a"},{"id":"b","path":"b"}]`), PutOptions{
+		ContentType: "application/json",
+		Metadata:    map[string]string{"share-type": "directory"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	children := []string{"shares/updatedir.d/a.bin", "shares/updatedir.d/b.bin"}
+	for _, key := range children {
+		if err = storage.PutObject(ctx, key, strings.NewReader(key), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiresAt := func(key string) string {
+		t.Helper()
+		meta, err := storage.HeadObject(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta.Meta("Share-Expires-At")
+	}
+
+	expiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	for _, failing := range []string{children[1], "shares/updatedir"} {
+		storage.fail = func(key string) bool {
+			return key == failing
+		}
+		err = UpdateShare(ctx, UpdateShareOptions{Name: "updatedir", ExpiresAt: &expiry})
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("%s: expected the injected failure, got %v", failing, err)
+		}
+		for _, key := range append(children, "shares/updatedir") {
+			if v := expiresAt(key); v != "" {
+				t.Fatalf("%s: %s changed after rollback: %s", failing, key, v)
+			}
+		}
+	}
+
+	storage.fail = nil
+	if err = UpdateShare(ctx, UpdateShareOptions{Name: "updatedir", ExpiresAt: &expiry}); err != nil {
+		t.Fatal(err)
+	}
+	want := expiry.UTC().Format(time.RFC3339)
+	for _, key := range append(children, "shares/updatedir") {
+		if v := expiresAt(key); v != want {
+			t.Fatalf("unexpected expiry of %s: %q", key, v)
+		}
+	}
+}
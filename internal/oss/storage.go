@@ -0,0 +1,495 @@
+package oss
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned by a Storage when the requested object or upload does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrNotSupported is returned by a Storage when the requested feature is not available on the backend.
+var ErrNotSupported = errors.New("operation not supported by storage backend")
+
+// ErrPreconditionFailed is returned by a Storage when the object does not match the condition of a put.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrChecksumMismatch is returned by a Storage when an uploaded part does not match its checksums.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Storage is the object store the shares are kept in.
+// Keys are always relative to the bucket root, like `shares/<name>` or `uploads/<id>.bin`.
+type Storage interface {
+	PutObject(ctx context.Context, key string, body io.Reader, options PutOptions) error
+	// CopyObject copies `src` to `dst`, replacing the metadata and tags with the ones in `options`.
+	// `src` and `dst` may be the same key, which rewrites the metadata in place.
+	CopyObject(ctx context.Context, src string, dst string, options PutOptions) error
+	GetObject(ctx context.Context, key string, options GetOptions) (*ObjectResponse, error)
+	HeadObject(ctx context.Context, key string) (*ObjectMeta, error)
+	ListObjects(ctx context.Context, options ListOptions) (*ListResult, error)
+	DeleteObjects(ctx context.Context, keys []string) error
+
+	InitMultipartUpload(ctx context.Context, key string, options PutOptions) (string, error)
+	// UploadPart uploads a part of `size` bytes, which the storage verifies against the checksums given.
+	UploadPart(ctx context.Context, key string, uploadId string, partNumber int, body io.Reader, size int64, checksum PartChecksum) (UploadedPart, error)
+	CompleteMultipartUpload(ctx context.Context, key string, uploadId string, parts []UploadedPart) error
+	AbortMultipartUpload(ctx context.Context, key string, uploadId string) error
+	ListUploadedParts(ctx context.Context, key string, uploadId string) ([]UploadedPart, error)
+	// ListMultipartUploads lists the multipart uploads in progress of the keys with the prefix.
+	ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error)
+
+	// SignURL returns a URL that is directly accessible by the client without further authentication.
+	SignURL(ctx context.Context, key string, method string, expires time.Duration, options SignOptions) (string, error)
+}
+
+// PutOptions Attributes stored along with an object.
+// Metadata keys are in canonical header form without any vendor prefix, like `Share-Type`.
+type PutOptions struct {
+	ContentType        string
+	ContentDisposition string
+	CacheControl       string
+	ContentMD5         string // base64 encoded
+	Metadata           map[string]string
+	Tags               map[string]string
+	IfMatch            string // only put if the object has this ETag, for PutObject
+	IfNoneMatch        bool   // only put if the object does not exist, for PutObject
+}
+
+type GetOptions struct {
+	Range   string // value of the HTTP `Range` header
+	Process string // Alibaba Cloud OSS image processing, other backends return ErrNotSupported
+}
+
+type ListOptions struct {
+	Prefix            string
+	Delimiter         string
+	ContinuationToken string
+	MaxKeys           int
+}
+
+type ListResult struct {
+	Objects               []ObjectInfo
+	CommonPrefixes        []string
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type ObjectMeta struct {
+	ETag               string // quoted, as in HTTP headers
+	Size               int64
+	ContentType        string
+	ContentDisposition string
+	CacheControl       string
+	LastModified       time.Time
+	ExpiresAt          *time.Time
+	Metadata           map[string]string
+}
+
+// ObjectResponse An object being read, in the shape of an HTTP response so it can be proxied to the client.
+type ObjectResponse struct {
+	StatusCode int
+	Headers    http.Header
+	Body       io.ReadCloser
+}
+
+type UploadedPart struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+// PartChecksum The checksums of a part to upload, any of which may be empty.
+type PartChecksum struct {
+	MD5    string // base64, like `Content-MD5`
+	SHA256 string // hex
+}
+
+type MultipartUpload struct {
+	Key       string
+	UploadId  string
+	Initiated time.Time
+}
+
+type SignOptions struct {
+	ContentType        string // overrides the `Content-Type` of the response
+	ContentDisposition string // overrides the `Content-Disposition` of the response
+	UploadId           string // signs the upload of a part of the multipart upload instead, with `PartNumber`
+	PartNumber         int
+	ContentMD5         string // the part must be uploaded with this `Content-MD5`, which the storage verifies
+}
+
+// Valid reports whether the checksums are well-formed.
+func (c PartChecksum) Valid() bool {
+	if c.MD5 != "" {
+		if sum, err := base64.StdEncoding.DecodeString(c.MD5); err != nil || len(sum) != md5.Size {
+			return false
+		}
+	}
+	if c.SHA256 != "" {
+		if sum, err := hex.DecodeString(c.SHA256); err != nil || len(sum) != sha256.Size {
+			return false
+		}
+	}
+	return true
+}
+
+// checksumReader Reads `size` bytes of a part, for backends which cannot verify the checksums on their own.
+// The end is looked ahead, so the last bytes are only returned once they match, otherwise ErrChecksumMismatch is.
+type checksumReader struct {
+	reader   *bufio.Reader
+	checksum PartChecksum
+	md5      hash.Hash
+	sha256   hash.Hash
+	mismatch bool
+}
+
+func newChecksumReader(body io.Reader, size int64, checksum PartChecksum) *checksumReader {
+	return &checksumReader{
+		reader:   bufio.NewReader(io.LimitReader(body, size)),
+		checksum: checksum,
+		md5:      md5.New(),
+		sha256:   sha256.New(),
+	}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.checksum.MD5 != "" {
+		r.md5.Write(p[:n])
+	}
+	if r.checksum.SHA256 != "" {
+		r.sha256.Write(p[:n])
+	}
+	if err == nil {
+		if _, err = r.reader.Peek(1); err == nil {
+			return n, nil
+		}
+	}
+	if err == io.EOF && !r.matches() {
+		r.mismatch = true
+		return 0, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+func (r *checksumReader) matches() bool {
+	if r.checksum.MD5 != "" && r.checksum.MD5 != base64.StdEncoding.EncodeToString(r.md5.Sum(nil)) {
+		return false
+	}
+	if r.checksum.SHA256 != "" && !strings.EqualFold(r.checksum.SHA256, hex.EncodeToString(r.sha256.Sum(nil))) {
+		return false
+	}
+	return true
+}
+
+// Meta returns the metadata value with the given key, or an empty string.
+func (m *ObjectMeta) Meta(key string) string {
+	if m.Metadata == nil {
+		return ""
+	}
+	return m.Metadata[http.CanonicalHeaderKey(key)]
+}
+
+// objectAttributes The attributes of an object, for backends which keep them on their own.
+type objectAttributes struct {
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Tags               map[string]string `json:"tags,omitempty"`
+	ETag               string            `json:"etag,omitempty"`
+}
+
+func newObjectAttributes(options PutOptions) objectAttributes {
+	attributes := objectAttributes{
+		ContentType:        options.ContentType,
+		ContentDisposition: options.ContentDisposition,
+		CacheControl:       options.CacheControl,
+		Tags:               options.Tags,
+	}
+	if len(options.Metadata) > 0 {
+		attributes.Metadata = make(map[string]string)
+		for k, v := range options.Metadata {
+			attributes.Metadata[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	return attributes
+}
+
+// expiresAt mimics the OSS lifecycle rule, which expires an object `period` days after it is last modified.
+func (m *objectAttributes) expiresAt(lastModified time.Time) *time.Time {
+	period, err := strconv.Atoi(m.Tags["period"])
+	if err != nil || period <= 0 {
+		return nil
+	}
+	t := lastModified.Add(time.Duration(period) * 24 * time.Hour)
+	return &t
+}
+
+// md5ETag returns the ETag of content with the MD5 digest, like OSS does for objects put in a single request.
+func md5ETag(sum []byte) string {
+	return "\"" + strings.ToUpper(hex.EncodeToString(sum)) + "\""
+}
+
+// checkPutConditions checks the conditions of a put against the ETag of the existing object, empty if there is none,
+// for backends which keep the ETags on their own.
+func checkPutConditions(etag string, options PutOptions) error {
+	if (options.IfNoneMatch && etag != "") || (options.IfMatch != "" && etag != options.IfMatch) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+var rangePattern = regexp.MustCompile(`^bytes=(\d*)-(\d*)$`)
+
+// parseRange parses a single HTTP byte range against an object of `size` bytes.
+// ok is false if the range header should be ignored.
+func parseRange(header string, size int64) (start int64, end int64, ok bool) {
+	match := rangePattern.FindStringSubmatch(strings.TrimSpace(header))
+	if match == nil || (match[1] == "" && match[2] == "") {
+		return 0, 0, false
+	}
+	if match[1] == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, true
+	}
+	start, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end = size - 1
+	if match[2] != "" {
+		end, err = strconv.ParseInt(match[2], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newObjectResponse builds the response of reading an object, honoring a `Range` header.
+func newObjectResponse(content io.ReaderAt, closer io.Closer, size int64, lastModified time.Time, attributes objectAttributes, rangeHeader string) *ObjectResponse {
+	headers := make(http.Header)
+	headers.Set("Accept-Ranges", "bytes")
+	headers.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	if attributes.ETag != "" {
+		headers.Set("ETag", attributes.ETag)
+	}
+	headers.Set("Content-Type", attributes.ContentType)
+	if attributes.ContentType == "" {
+		headers.Set("Content-Type", "application/octet-stream")
+	}
+	if attributes.ContentDisposition != "" {
+		headers.Set("Content-Disposition", attributes.ContentDisposition)
+	}
+	if attributes.CacheControl != "" {
+		headers.Set("Cache-Control", attributes.CacheControl)
+	}
+
+	if rangeHeader != "" {
+		if start, end, ok := parseRange(rangeHeader, size); ok {
+			if start >= size {
+				_ = closer.Close()
+				headers.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+				return &ObjectResponse{
+					StatusCode: http.StatusRequestedRangeNotSatisfiable,
+					Headers:    headers,
+					Body:       io.NopCloser(strings.NewReader("")),
+				}
+			}
+			headers.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+			headers.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+			return &ObjectResponse{
+				StatusCode: http.StatusPartialContent,
+				Headers:    headers,
+				Body: rangeReadCloser{
+					Reader: io.NewSectionReader(content, start, end-start+1),
+					Closer: closer,
+				},
+			}
+		}
+	}
+
+	headers.Set("Content-Length", strconv.FormatInt(size, 10))
+	return &ObjectResponse{
+		StatusCode: http.StatusOK,
+		Headers:    headers,
+		Body: rangeReadCloser{
+			Reader: io.NewSectionReader(content, 0, size),
+			Closer: closer,
+		},
+	}
+}
+
+// listSortedObjects pages through `objects`, which are sorted by key, like ListObjectsV2 does.
+// The continuation token is the last key or common prefix returned.
+func listSortedObjects(objects []ObjectInfo, options ListOptions) *ListResult {
+	maxKeys := options.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	result := &ListResult{}
+	count := 0
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Key, options.Prefix) {
+			continue
+		}
+		if options.ContinuationToken != "" && object.Key <= options.ContinuationToken {
+			continue
+		}
+		if options.Delimiter != "" {
+			rest := strings.TrimPrefix(object.Key, options.Prefix)
+			if i := strings.Index(rest, options.Delimiter); i >= 0 {
+				commonPrefix := options.Prefix + rest[:i+len(options.Delimiter)]
+				if strings.HasPrefix(options.ContinuationToken, commonPrefix) {
+					continue
+				}
+				if n := len(result.CommonPrefixes); n > 0 && result.CommonPrefixes[n-1] == commonPrefix {
+					continue
+				}
+				if count == maxKeys {
+					result.IsTruncated = true
+					break
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix)
+				result.NextContinuationToken = commonPrefix
+				count++
+				continue
+			}
+		}
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		result.Objects = append(result.Objects, object)
+		result.NextContinuationToken = object.Key
+		count++
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+	return result
+}
+
+// listAllObjects lists every object under `prefix`, going through all pages.
+func listAllObjects(ctx context.Context, storage Storage, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	continuationToken := ""
+	for {
+		res, err := storage.ListObjects(ctx, ListOptions{
+			Prefix:            prefix,
+			ContinuationToken: continuationToken,
+			MaxKeys:           1000,
+		})
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, res.Objects...)
+		if !res.IsTruncated {
+			return objects, nil
+		}
+		continuationToken = res.NextContinuationToken
+	}
+}
+
+// updateJsonObject reads the JSON object at `key`, applies `update` to it and writes it back with `options`,
+// only if the object has not been changed meanwhile, starting over if it has.
+// `exists` tells whether the object exists, `v` is zero if not. The error of `update` is returned as is.
+func updateJsonObject[T any](ctx context.Context, key string, options PutOptions, update func(v *T, exists bool) error) error {
+	client := Client()
+	for attempt := 0; ; attempt++ {
+		v := new(T)
+		res, err := client.GetObject(ctx, key, GetOptions{})
+		exists := err == nil
+		if exists {
+			options.IfMatch, options.IfNoneMatch = res.Headers.Get("ETag"), false
+			err = json.NewDecoder(res.Body).Decode(v)
+			_ = res.Body.Close()
+			if err != nil {
+				return err
+			}
+		} else if errors.Is(err, ErrObjectNotFound) {
+			options.IfMatch, options.IfNoneMatch = "", true
+		} else {
+			return err
+		}
+
+		if err = update(v, exists); err != nil {
+			return err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		err = client.PutObject(ctx, key, bytes.NewReader(data), options)
+		if !errors.Is(err, ErrPreconditionFailed) || attempt == updateMaxAttempts-1 {
+			return err
+		}
+		// changed by someone else, back off a little before trying again
+		time.Sleep(time.Duration(rand.IntN(10*(attempt+1))) * time.Millisecond)
+	}
+}
+
+// updateMaxAttempts is how many times updateJsonObject tries before giving up on concurrent changes.
+const updateMaxAttempts = 10
+
+// putObjectParts puts an object of a known size, which is uploaded in parts if it is too large for a single request.
+// Unlike PutObject, the body is never read into memory as a whole.
+func putObjectParts(ctx context.Context, storage Storage, key string, body io.Reader, size int64, options PutOptions) error {
+	if size <= UploadPartSize {
+		return storage.PutObject(ctx, key, io.LimitReader(body, size), options)
+	}
+
+	uploadId, err := storage.InitMultipartUpload(ctx, key, options)
+	if err != nil {
+		return err
+	}
+	var parts []UploadedPart
+	for partNumber := 1; err == nil && size > 0; partNumber++ {
+		partSize := min(size, UploadPartSize)
+		var part UploadedPart
+		part, err = storage.UploadPart(ctx, key, uploadId, partNumber, io.LimitReader(body, partSize), partSize, PartChecksum{})
+		parts = append(parts, part)
+		size -= partSize
+	}
+	if err == nil {
+		err = storage.CompleteMultipartUpload(ctx, key, uploadId, parts)
+	}
+	if err != nil {
+		// the request may be cancelled, the upload is aborted anyway
+		_ = storage.AbortMultipartUpload(context.Background(), key, uploadId)
+	}
+	return err
+}
@@ -0,0 +1,469 @@
+package oss
+
+import (
+	"context"
+	"errors"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/spf13/viper"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aliyunStorage Storage backed by Alibaba Cloud OSS.
+type aliyunStorage struct {
+	bucket *oss.Bucket
+	// public is used to sign URLs which are accessed by the client
+	public *oss.Bucket
+}
+
+func newAliyunBucket(internal bool) (*oss.Bucket, error) {
+	endpoint := viper.GetString("oss.endpoint")
+	if !internal {
+		endpointPublic := viper.GetString("oss.endpoint_public")
+		if endpointPublic != "" {
+			endpoint = endpointPublic
+		}
+	}
+	akId := viper.GetString("oss.access_key_id")
+	akSecret := viper.GetString("oss.access_key_secret")
+	cname := !strings.Contains(endpoint, "aliyuncs")
+
+	region := viper.GetString("oss.region")
+	if region == "" && !cname {
+		// try to guess region from endpoint
+		pattern := `oss-(?:accelerate|(.+?))(?:-internal)?.aliyuncs.com`
+		regex, err := regexp.Compile(pattern)
+		if err == nil {
+			matches := regex.FindStringSubmatch(endpoint)
+			if len(matches) > 1 {
+				region = matches[1]
+			}
+		}
+	}
+
+	ossOptions := []oss.ClientOption{
+		oss.AuthVersion(oss.AuthV4),
+		oss.UseCname(cname),
+		oss.Region(region),
+	}
+	client, err := oss.New(endpoint, akId, akSecret, ossOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := viper.GetString("oss.bucket")
+	return client.Bucket(bucket)
+}
+
+func newAliyunStorage() (*aliyunStorage, error) {
+	bucket, err := newAliyunBucket(true)
+	if err != nil {
+		return nil, err
+	}
+	public, err := newAliyunBucket(false)
+	if err != nil {
+		return nil, err
+	}
+	return &aliyunStorage{
+		bucket: bucket,
+		public: public,
+	}, nil
+}
+
+// aliyunError converts `NoSuchKey` and `NoSuchUpload` errors into ErrObjectNotFound,
+// and failed conditions into ErrPreconditionFailed.
+func aliyunError(err error) error {
+	var ossErr oss.ServiceError
+	if errors.As(err, &ossErr) {
+		switch ossErr.Code {
+		case "NoSuchKey", "NoSuchUpload":
+			return ErrObjectNotFound
+		case "PreconditionFailed", "FileAlreadyExists":
+			return ErrPreconditionFailed
+		case "InvalidDigest":
+			return ErrChecksumMismatch
+		}
+	}
+	return err
+}
+
+func aliyunPutOptions(ctx context.Context, options PutOptions) []oss.Option {
+	ossOptions := []oss.Option{
+		oss.WithContext(ctx),
+	}
+	if options.ContentType != "" {
+		ossOptions = append(ossOptions, oss.ContentType(options.ContentType))
+	}
+	if options.ContentDisposition != "" {
+		ossOptions = append(ossOptions, oss.ContentDisposition(options.ContentDisposition))
+	}
+	if options.CacheControl != "" {
+		ossOptions = append(ossOptions, oss.CacheControl(options.CacheControl))
+	}
+	if options.ContentMD5 != "" {
+		ossOptions = append(ossOptions, oss.ContentMD5(options.ContentMD5))
+	}
+	for k, v := range options.Metadata {
+		ossOptions = append(ossOptions, oss.Meta(k, v))
+	}
+	if len(options.Tags) > 0 {
+		var tags []oss.Tag
+		for k, v := range options.Tags {
+			tags = append(tags, oss.Tag{Key: k, Value: v})
+		}
+		ossOptions = append(ossOptions, oss.SetTagging(oss.Tagging{Tags: tags}))
+	}
+	return ossOptions
+}
+
+func (s *aliyunStorage) PutObject(ctx context.Context, key string, body io.Reader, options PutOptions) error {
+	ossOptions := aliyunPutOptions(ctx, options)
+	if options.IfNoneMatch {
+		ossOptions = append(ossOptions, oss.ForbidOverWrite(true))
+	}
+	if options.IfMatch != "" {
+		// OSS does not enforce `If-Match` on writes, so the ETag is checked while holding the lock of the key
+		unlock, err := s.lock(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		meta, err := s.HeadObject(ctx, key)
+		if errors.Is(err, ErrObjectNotFound) || (err == nil && meta.ETag != options.IfMatch) {
+			return ErrPreconditionFailed
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return aliyunError(s.bucket.PutObject(key, body, ossOptions...))
+}
+
+// aliyunLockPrefix is where the locks of conditional writes are kept.
+const aliyunLockPrefix = "locks/"
+
+// aliyunLockTimeout is how long a lock may be held, after which it is taken over, as its holder may have stopped.
+const aliyunLockTimeout = 30 * time.Second
+
+// lock takes the lock of writing `key` on a condition, and returns the function to release it.
+// The lock is an object which is only created if it does not exist, which OSS does atomically,
+// so a single writer holds it at a time. If it is held by another one, ErrPreconditionFailed is returned,
+// so the write is retried like any other conflict.
+func (s *aliyunStorage) lock(ctx context.Context, key string) (func(), error) {
+	lockKey := aliyunLockPrefix + key
+	err := aliyunError(s.bucket.PutObject(lockKey, strings.NewReader(""), oss.ForbidOverWrite(true), oss.WithContext(ctx)))
+	if errors.Is(err, ErrPreconditionFailed) {
+		meta, headErr := s.HeadObject(ctx, lockKey)
+		if headErr == nil && time.Since(meta.LastModified) > aliyunLockTimeout {
+			_ = s.bucket.DeleteObject(lockKey, oss.WithContext(ctx))
+		}
+		return nil, ErrPreconditionFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		// released even if the request is cancelled meanwhile
+		_ = s.bucket.DeleteObject(lockKey)
+	}, nil
+}
+
+// aliyunMaxCopySize is the largest object which can be copied with a single request.
+const aliyunMaxCopySize = 1 << 30
+
+// aliyunCopyPartSize is the part size used to copy objects larger than aliyunMaxCopySize.
+const aliyunCopyPartSize = 256 << 20
+
+func (s *aliyunStorage) CopyObject(ctx context.Context, src string, dst string, options PutOptions) error {
+	meta, err := s.HeadObject(ctx, src)
+	if err != nil {
+		return err
+	}
+	if meta.Size > aliyunMaxCopySize {
+		return s.copyObjectMultipart(ctx, src, dst, meta.Size, options)
+	}
+
+	ossOptions := aliyunPutOptions(ctx, options)
+	ossOptions = append(ossOptions, oss.MetadataDirective(oss.MetaReplace))
+	ossOptions = append(ossOptions, oss.TaggingDirective(oss.TaggingReplace))
+	_, err = s.bucket.CopyObject(src, dst, ossOptions...)
+	return aliyunError(err)
+}
+
+// copyObjectMultipart copies a large object part by part, which also works when `src` equals `dst`.
+func (s *aliyunStorage) copyObjectMultipart(ctx context.Context, src string, dst string, size int64, options PutOptions) error {
+	imur, err := s.bucket.InitiateMultipartUpload(dst, aliyunPutOptions(ctx, options)...)
+	if err != nil {
+		return err
+	}
+
+	var parts []oss.UploadPart
+	for start, partNumber := int64(0), 1; start < size; start, partNumber = start+aliyunCopyPartSize, partNumber+1 {
+		part, err := s.bucket.UploadPartCopy(imur, s.bucket.BucketName, src, start, min(aliyunCopyPartSize, size-start), partNumber, oss.WithContext(ctx))
+		if err != nil {
+			_ = s.bucket.AbortMultipartUpload(imur)
+			return aliyunError(err)
+		}
+		parts = append(parts, part)
+	}
+
+	_, err = s.bucket.CompleteMultipartUpload(imur, parts, oss.WithContext(ctx))
+	if err != nil {
+		_ = s.bucket.AbortMultipartUpload(imur)
+	}
+	return aliyunError(err)
+}
+
+func (s *aliyunStorage) GetObject(ctx context.Context, key string, options GetOptions) (*ObjectResponse, error) {
+	ossOptions := []oss.Option{
+		oss.WithContext(ctx),
+	}
+	if options.Range != "" {
+		ossOptions = append(ossOptions, oss.SetHeader("Range", options.Range))
+	}
+	if options.Process != "" {
+		ossOptions = append(ossOptions, oss.Process(options.Process))
+	}
+
+	res, err := s.bucket.DoGetObject(&oss.GetObjectRequest{
+		ObjectKey: key,
+	}, ossOptions)
+	if err != nil {
+		return nil, aliyunError(err)
+	}
+
+	return &ObjectResponse{
+		StatusCode: res.Response.StatusCode,
+		Headers:    res.Response.Headers,
+		Body:       res.Response.Body,
+	}, nil
+}
+
+func (s *aliyunStorage) HeadObject(ctx context.Context, key string) (*ObjectMeta, error) {
+	res, err := s.bucket.GetObjectDetailedMeta(key, oss.WithContext(ctx))
+	if err != nil {
+		return nil, aliyunError(err)
+	}
+
+	meta := &ObjectMeta{
+		ETag:               res.Get(oss.HTTPHeaderEtag),
+		ContentType:        res.Get(oss.HTTPHeaderContentType),
+		ContentDisposition: res.Get(oss.HTTPHeaderContentDisposition),
+		CacheControl:       res.Get(oss.HTTPHeaderCacheControl),
+		Metadata:           make(map[string]string),
+	}
+	meta.Size, _ = strconv.ParseInt(res.Get(oss.HTTPHeaderContentLength), 10, 64)
+	meta.LastModified, _ = http.ParseTime(res.Get(oss.HTTPHeaderLastModified))
+	for k := range res {
+		if strings.HasPrefix(k, oss.HTTPHeaderOssMetaPrefix) {
+			meta.Metadata[strings.TrimPrefix(k, oss.HTTPHeaderOssMetaPrefix)] = res.Get(k)
+		}
+	}
+
+	{
+		// expiration date computed by the lifecycle rules
+		expirationHeader := res.Get("X-OSS-Expiration")
+		expiryPattern := `expiry-date=\"(.+?)\"`
+		expiryRegex, err := regexp.Compile(expiryPattern)
+		if err == nil {
+			match := expiryRegex.FindStringSubmatch(expirationHeader)
+			if len(match) > 1 {
+				expiresAt, err := http.ParseTime(match[1])
+				if err == nil {
+					meta.ExpiresAt = &expiresAt
+				}
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+func (s *aliyunStorage) ListObjects(ctx context.Context, options ListOptions) (*ListResult, error) {
+	ossOptions := []oss.Option{
+		oss.WithContext(ctx),
+	}
+	if options.Prefix != "" {
+		ossOptions = append(ossOptions, oss.Prefix(options.Prefix))
+	}
+	if options.Delimiter != "" {
+		ossOptions = append(ossOptions, oss.Delimiter(options.Delimiter))
+	}
+	if options.MaxKeys > 0 {
+		ossOptions = append(ossOptions, oss.MaxKeys(options.MaxKeys))
+	}
+	if options.ContinuationToken != "" {
+		ossOptions = append(ossOptions, oss.ContinuationToken(options.ContinuationToken))
+	}
+	res, err := s.bucket.ListObjectsV2(ossOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ListResult{
+		CommonPrefixes:        res.CommonPrefixes,
+		IsTruncated:           res.IsTruncated,
+		NextContinuationToken: res.NextContinuationToken,
+	}
+	for _, object := range res.Objects {
+		result.Objects = append(result.Objects, ObjectInfo{
+			Key:          object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+	}
+	return result, nil
+}
+
+func (s *aliyunStorage) DeleteObjects(ctx context.Context, keys []string) error {
+	// OSS accepts at most 1000 keys per request
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 1000)]
+		keys = keys[len(batch):]
+		_, err := s.bucket.DeleteObjects(batch, oss.WithContext(ctx), oss.DeleteObjectsQuiet(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *aliyunStorage) InitMultipartUpload(ctx context.Context, key string, options PutOptions) (string, error) {
+	res, err := s.bucket.InitiateMultipartUpload(key, aliyunPutOptions(ctx, options)...)
+	if err != nil {
+		return "", err
+	}
+	return res.UploadID, nil
+}
+
+func (s *aliyunStorage) multipartUpload(key string, uploadId string) oss.InitiateMultipartUploadResult {
+	return oss.InitiateMultipartUploadResult{
+		Bucket:   s.bucket.BucketName,
+		Key:      key,
+		UploadID: uploadId,
+	}
+}
+
+func (s *aliyunStorage) UploadPart(ctx context.Context, key string, uploadId string, partNumber int, body io.Reader, size int64, checksum PartChecksum) (UploadedPart, error) {
+	ossOptions := []oss.Option{
+		oss.WithContext(ctx),
+	}
+	if checksum.MD5 != "" {
+		ossOptions = append(ossOptions, oss.ContentMD5(checksum.MD5))
+	}
+	// OSS cannot verify a SHA-256, so the part is verified while it is sent instead
+	reader := newChecksumReader(body, size, checksum)
+	res, err := s.bucket.UploadPart(s.multipartUpload(key, uploadId), reader, size, partNumber, ossOptions...)
+	if reader.mismatch {
+		return UploadedPart{}, ErrChecksumMismatch
+	}
+	if err != nil {
+		return UploadedPart{}, aliyunError(err)
+	}
+	return UploadedPart{
+		PartNumber: res.PartNumber,
+		ETag:       res.ETag,
+		Size:       size,
+	}, nil
+}
+
+func (s *aliyunStorage) CompleteMultipartUpload(ctx context.Context, key string, uploadId string, parts []UploadedPart) error {
+	var ossParts []oss.UploadPart
+	for _, part := range parts {
+		ossParts = append(ossParts, oss.UploadPart{
+			PartNumber: part.PartNumber,
+			ETag:       part.ETag,
+		})
+	}
+	_, err := s.bucket.CompleteMultipartUpload(s.multipartUpload(key, uploadId), ossParts, oss.WithContext(ctx))
+	return aliyunError(err)
+}
+
+func (s *aliyunStorage) AbortMultipartUpload(ctx context.Context, key string, uploadId string) error {
+	err := s.bucket.AbortMultipartUpload(s.multipartUpload(key, uploadId), oss.WithContext(ctx))
+	return aliyunError(err)
+}
+
+func (s *aliyunStorage) ListUploadedParts(ctx context.Context, key string, uploadId string) ([]UploadedPart, error) {
+	var parts []UploadedPart
+	marker := 0
+	for {
+		ossOptions := []oss.Option{
+			oss.WithContext(ctx),
+			oss.MaxParts(1000),
+		}
+		if marker > 0 {
+			ossOptions = append(ossOptions, oss.PartNumberMarker(marker))
+		}
+		res, err := s.bucket.ListUploadedParts(s.multipartUpload(key, uploadId), ossOptions...)
+		if err != nil {
+			return nil, aliyunError(err)
+		}
+		for _, part := range res.UploadedParts {
+			parts = append(parts, UploadedPart{
+				PartNumber: part.PartNumber,
+				ETag:       part.ETag,
+				Size:       int64(part.Size),
+			})
+		}
+		if !res.IsTruncated {
+			break
+		}
+		marker, _ = strconv.Atoi(res.NextPartNumberMarker)
+		if marker == 0 {
+			break
+		}
+	}
+	return parts, nil
+}
+
+func (s *aliyunStorage) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	var uploads []MultipartUpload
+	keyMarker, uploadIdMarker := "", ""
+	for {
+		res, err := s.bucket.ListMultipartUploads(
+			oss.WithContext(ctx),
+			oss.Prefix(prefix),
+			oss.KeyMarker(keyMarker),
+			oss.UploadIDMarker(uploadIdMarker),
+			oss.MaxUploads(1000),
+		)
+		if err != nil {
+			return nil, err
+		}
+		for _, upload := range res.Uploads {
+			uploads = append(uploads, MultipartUpload{
+				Key:       upload.Key,
+				UploadId:  upload.UploadID,
+				Initiated: upload.Initiated,
+			})
+		}
+		if !res.IsTruncated {
+			return uploads, nil
+		}
+		keyMarker, uploadIdMarker = res.NextKeyMarker, res.NextUploadIDMarker
+	}
+}
+
+func (s *aliyunStorage) SignURL(ctx context.Context, key string, method string, expires time.Duration, options SignOptions) (string, error) {
+	ossOptions := []oss.Option{
+		oss.WithContext(ctx),
+	}
+	if options.ContentType != "" {
+		ossOptions = append(ossOptions, oss.ResponseContentType(options.ContentType))
+	}
+	if options.ContentDisposition != "" {
+		ossOptions = append(ossOptions, oss.ResponseContentDisposition(options.ContentDisposition))
+	}
+	if options.UploadId != "" {
+		ossOptions = append(ossOptions, oss.AddParam("partNumber", strconv.Itoa(options.PartNumber)), oss.AddParam("uploadId", options.UploadId))
+	}
+	if options.ContentMD5 != "" {
+		ossOptions = append(ossOptions, oss.ContentMD5(options.ContentMD5))
+	}
+	return s.public.SignURL(key, oss.HTTPMethod(method), int64(expires.Seconds()), ossOptions...)
+}
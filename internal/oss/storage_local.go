@@ -0,0 +1,617 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localStorage Storage backed by a directory on the local filesystem.
+//
+// The layout of the root directory is:
+//   - `objects/<key>`: object content
+//   - `meta/<key>.json`: sidecar holding the attributes which OSS keeps in headers
+//   - `multipart/<upload id>/`: parts of in-progress multipart uploads
+//
+// Writes are serialized within the process only, so the root must not be shared by several servers.
+type localStorage struct {
+	root string
+	mu   sync.RWMutex
+}
+
+// localUpload The state file of a multipart upload.
+type localUpload struct {
+	Key       string           `json:"key"`
+	Meta      objectAttributes `json:"meta"`
+	Initiated time.Time        `json:"initiated"`
+}
+
+const localTempPrefix = ".tmp-"
+
+func newLocalStorage(root string) (*localStorage, error) {
+	if root == "" {
+		return nil, errors.New("local storage root is not configured")
+	}
+	for _, dir := range []string{"objects", "meta", "multipart"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &localStorage{root: root}, nil
+}
+
+func (s *localStorage) objectPath(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return "", fmt.Errorf("invalid object key: %s", key)
+	}
+	return filepath.Join(s.root, "objects", filepath.FromSlash(key)), nil
+}
+
+func (s *localStorage) metaPath(key string) string {
+	return filepath.Join(s.root, "meta", filepath.FromSlash(key)+".json")
+}
+
+func (s *localStorage) uploadPath(uploadId string) (string, error) {
+	if _, err := uuid.Parse(uploadId); err != nil {
+		return "", ErrObjectNotFound
+	}
+	return filepath.Join(s.root, "multipart", uploadId), nil
+}
+
+// writeFileAtomic writes the content of `r` to a temporary file next to `dst` and renames it into place.
+// It returns the MD5 digest of the written content.
+func writeFileAtomic(dst string, r io.Reader) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(dst), localTempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), os.Rename(f.Name(), dst)
+}
+
+func writeJsonAtomic(dst string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = writeFileAtomic(dst, bytes.NewReader(data))
+	return err
+}
+
+func readJson(src string, v interface{}) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *localStorage) readMeta(key string) objectAttributes {
+	var meta objectAttributes
+	_ = readJson(s.metaPath(key), &meta)
+	return meta
+}
+
+// localETag returns the ETag kept in the sidecar, or for objects written before ETags were kept,
+// one made of the modification time and size.
+func localETag(meta objectAttributes, stat fs.FileInfo) string {
+	if meta.ETag != "" {
+		return meta.ETag
+	}
+	return fmt.Sprintf("\"%x-%x\"", stat.ModTime().UnixNano(), stat.Size())
+}
+
+// currentETag returns the ETag of the object, or an empty string if it does not exist.
+// The caller must hold the lock.
+func (s *localStorage) currentETag(key string, p string) string {
+	stat, err := os.Stat(p)
+	if err != nil || stat.IsDir() {
+		return ""
+	}
+	return localETag(s.readMeta(key), stat)
+}
+
+func (s *localStorage) PutObject(_ context.Context, key string, body io.Reader, options PutOptions) error {
+	dst, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = checkPutConditions(s.currentETag(key, dst), options); err != nil {
+		return err
+	}
+
+	// write the content aside first, so a failed checksum leaves the existing object untouched
+	tmp := filepath.Join(s.root, "multipart", localTempPrefix+uuid.NewString())
+	defer func() {
+		_ = os.Remove(tmp)
+	}()
+	sum, err := writeFileAtomic(tmp, body)
+	if err != nil {
+		return err
+	}
+	if options.ContentMD5 != "" && options.ContentMD5 != base64.StdEncoding.EncodeToString(sum) {
+		return ErrChecksumMismatch
+	}
+
+	attributes := newObjectAttributes(options)
+	attributes.ETag = md5ETag(sum)
+	if err = writeJsonAtomic(s.metaPath(key), attributes); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func (s *localStorage) CopyObject(_ context.Context, src string, dst string, options PutOptions) error {
+	srcPath, err := s.objectPath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.objectPath(dst)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attributes := newObjectAttributes(options)
+	if src != dst {
+		f, err := os.Open(srcPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return ErrObjectNotFound
+			}
+			return err
+		}
+		defer func(f *os.File) {
+			_ = f.Close()
+		}(f)
+		sum, err := writeFileAtomic(dstPath, f)
+		if err != nil {
+			return err
+		}
+		attributes.ETag = md5ETag(sum)
+	} else if _, err = os.Stat(srcPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrObjectNotFound
+		}
+		return err
+	} else {
+		// rewriting metadata in place counts as a modification, like it does on OSS
+		now := time.Now()
+		_ = os.Chtimes(dstPath, now, now)
+		attributes.ETag = s.readMeta(src).ETag
+	}
+
+	return writeJsonAtomic(s.metaPath(dst), attributes)
+}
+
+func (s *localStorage) GetObject(_ context.Context, key string, options GetOptions) (*ObjectResponse, error) {
+	if options.Process != "" {
+		return nil, ErrNotSupported
+	}
+	p, err := s.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		_ = f.Close()
+		return nil, ErrObjectNotFound
+	}
+	meta := s.readMeta(key)
+	meta.ETag = localETag(meta, stat)
+	return newObjectResponse(f, f, stat.Size(), stat.ModTime(), meta, options.Range), nil
+}
+
+func (s *localStorage) HeadObject(_ context.Context, key string) (*ObjectMeta, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stat, err := os.Stat(p)
+	if err != nil || stat.IsDir() {
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	meta := s.readMeta(key)
+
+	return &ObjectMeta{
+		ETag:               localETag(meta, stat),
+		Size:               stat.Size(),
+		ContentType:        meta.ContentType,
+		ContentDisposition: meta.ContentDisposition,
+		CacheControl:       meta.CacheControl,
+		LastModified:       stat.ModTime(),
+		ExpiresAt:          meta.expiresAt(stat.ModTime()),
+		Metadata:           meta.Metadata,
+	}, nil
+}
+
+// walk calls `fn` for every object under `prefix`, in lexical order of keys.
+func (s *localStorage) walk(prefix string, fn func(key string, info fs.FileInfo) error) error {
+	objectsRoot := filepath.Join(s.root, "objects")
+	// only walk the deepest directory containing the prefix
+	walkRoot := objectsRoot
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		walkRoot = filepath.Join(objectsRoot, filepath.FromSlash(prefix[:i]))
+	}
+
+	err := filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(objectsRoot, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if p != walkRoot && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		return fn(key, info)
+	})
+	return err
+}
+
+func (s *localStorage) ListObjects(_ context.Context, options ListOptions) (*ListResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// WalkDir does not yield keys in lexical order when a key is a prefix of a directory,
+	// like `shares/a` and `shares/a.d/`, so everything is collected and sorted first.
+	var objects []ObjectInfo
+	err := s.walk(options.Prefix, func(key string, info fs.FileInfo) error {
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return listSortedObjects(objects, options), nil
+}
+
+func (s *localStorage) DeleteObjects(_ context.Context, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		if err := s.deleteObject(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteObject removes an object along with its sidecar, and any directory left empty.
+// The caller must hold the write lock.
+func (s *localStorage) deleteObject(key string) error {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err = os.Remove(s.metaPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, dir := range []string{"objects", "meta"} {
+		stop := filepath.Join(s.root, dir)
+		for parent := filepath.Dir(filepath.Join(stop, filepath.FromSlash(key))); parent != stop; parent = filepath.Dir(parent) {
+			if os.Remove(parent) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (s *localStorage) InitMultipartUpload(_ context.Context, key string, options PutOptions) (string, error) {
+	if _, err := s.objectPath(key); err != nil {
+		return "", err
+	}
+	uploadId := uuid.NewString()
+	dir, _ := s.uploadPath(uploadId)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	err := writeJsonAtomic(filepath.Join(dir, "upload.json"), &localUpload{
+		Key:       key,
+		Meta:      newObjectAttributes(options),
+		Initiated: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return uploadId, nil
+}
+
+func (s *localStorage) readUpload(key string, uploadId string) (string, *localUpload, error) {
+	dir, err := s.uploadPath(uploadId)
+	if err != nil {
+		return "", nil, err
+	}
+	upload := new(localUpload)
+	if err = readJson(filepath.Join(dir, "upload.json"), upload); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil, ErrObjectNotFound
+		}
+		return "", nil, err
+	}
+	if upload.Key != key {
+		return "", nil, ErrObjectNotFound
+	}
+	return dir, upload, nil
+}
+
+func (s *localStorage) UploadPart(_ context.Context, key string, uploadId string, partNumber int, body io.Reader, size int64, checksum PartChecksum) (UploadedPart, error) {
+	dir, _, err := s.readUpload(key, uploadId)
+	if err != nil {
+		return UploadedPart{}, err
+	}
+
+	partPath := filepath.Join(dir, strconv.Itoa(partNumber)+".part")
+	// the part is only written if it matches, as the temporary file is removed otherwise
+	sum, err := writeFileAtomic(partPath, newChecksumReader(body, size, checksum))
+	if err != nil {
+		return UploadedPart{}, err
+	}
+	etag := md5ETag(sum)
+	if err = os.WriteFile(partPath+".etag", []byte(etag), 0o644); err != nil {
+		return UploadedPart{}, err
+	}
+
+	stat, err := os.Stat(partPath)
+	if err != nil {
+		return UploadedPart{}, err
+	}
+	return UploadedPart{
+		PartNumber: partNumber,
+		ETag:       etag,
+		Size:       stat.Size(),
+	}, nil
+}
+
+func (s *localStorage) CompleteMultipartUpload(_ context.Context, key string, uploadId string, parts []UploadedPart) error {
+	dir, upload, err := s.readUpload(key, uploadId)
+	if err != nil {
+		return err
+	}
+	dst, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return errors.New("no parts to complete the upload with")
+	}
+
+	parts = append([]UploadedPart(nil), parts...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	var readers []io.Reader
+	for _, part := range parts {
+		partPath := filepath.Join(dir, strconv.Itoa(part.PartNumber)+".part")
+		etag, err := os.ReadFile(partPath + ".etag")
+		if err != nil || string(etag) != part.ETag {
+			return fmt.Errorf("invalid part: %d", part.PartNumber)
+		}
+		f, err := os.Open(partPath)
+		if err != nil {
+			return err
+		}
+		defer func(f *os.File) {
+			_ = f.Close()
+		}(f)
+		readers = append(readers, f)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sum, err := writeFileAtomic(dst, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+	upload.Meta.ETag = md5ETag(sum)
+	if err = writeJsonAtomic(s.metaPath(key), upload.Meta); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *localStorage) AbortMultipartUpload(_ context.Context, key string, uploadId string) error {
+	dir, _, err := s.readUpload(key, uploadId)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *localStorage) ListUploadedParts(_ context.Context, key string, uploadId string) ([]UploadedPart, error) {
+	dir, _, err := s.readUpload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []UploadedPart
+	for _, entry := range entries {
+		partNumber, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".part"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".part") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		etag, err := os.ReadFile(filepath.Join(dir, entry.Name()+".etag"))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, UploadedPart{
+			PartNumber: partNumber,
+			ETag:       string(etag),
+			Size:       info.Size(),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+func (s *localStorage) ListMultipartUploads(_ context.Context, prefix string) ([]MultipartUpload, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, "multipart"))
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []MultipartUpload
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), localTempPrefix) {
+			continue
+		}
+		upload := new(localUpload)
+		if err = readJson(filepath.Join(s.root, "multipart", entry.Name(), "upload.json"), upload); err != nil {
+			// being initiated, or already completed
+			continue
+		}
+		if strings.HasPrefix(upload.Key, prefix) {
+			uploads = append(uploads, MultipartUpload{
+				Key:       upload.Key,
+				UploadId:  entry.Name(),
+				Initiated: upload.Initiated,
+			})
+		}
+	}
+	return uploads, nil
+}
+
+func (s *localStorage) SignURL(context.Context, string, string, time.Duration, SignOptions) (string, error) {
+	return "", ErrNotSupported
+}
+
+// SweepExpired deletes objects whose lifecycle `period` tag has passed,
+// taking the place of the OSS lifecycle rules.
+func (s *localStorage) SweepExpired(ctx context.Context) (int, error) {
+	var expired []string
+	s.mu.RLock()
+	err := s.walk("", func(key string, info fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		meta := s.readMeta(key)
+		if expiresAt := meta.expiresAt(info.ModTime()); expiresAt != nil && time.Now().After(*expiresAt) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	s.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if name, ok := strings.CutPrefix(key, "shares/"); ok && !strings.Contains(name, "/") {
+			shareCache.Delete(name)
+			unindexShare(name)
+		}
+	}
+	return len(expired), s.DeleteObjects(ctx, expired)
+}
+
+func (s *localStorage) startSweeper() {
+	go func() {
+		for {
+			n, err := s.SweepExpired(context.Background())
+			if err != nil {
+				log.Println("Failed to sweep expired objects: ", err)
+			} else if n > 0 {
+				log.Printf("Swept %d expired objects\n", n)
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+}
@@ -0,0 +1,282 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jingbh/simple-share/internal/utils"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStorage Storage kept in the process memory, for development and tests.
+// Everything is lost when the process exits.
+type memoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+	uploads map[string]*memoryUpload
+}
+
+type memoryObject struct {
+	data         []byte
+	attributes   objectAttributes
+	lastModified time.Time
+}
+
+type memoryUpload struct {
+	key        string
+	attributes objectAttributes
+	parts      map[int][]byte
+	initiated  time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		objects: make(map[string]*memoryObject),
+		uploads: make(map[string]*memoryUpload),
+	}
+}
+
+func memoryETag(data []byte) string {
+	sum := md5.Sum(data)
+	return md5ETag(sum[:])
+}
+
+func (s *memoryStorage) PutObject(_ context.Context, key string, body io.Reader, options PutOptions) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if options.ContentMD5 != "" && options.ContentMD5 != utils.MD5HashBase64(data) {
+		return ErrChecksumMismatch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	etag := ""
+	if existing, ok := s.objects[key]; ok {
+		etag = existing.attributes.ETag
+	}
+	if err = checkPutConditions(etag, options); err != nil {
+		return err
+	}
+	s.objects[key] = newMemoryObject(data, newObjectAttributes(options))
+	return nil
+}
+
+func newMemoryObject(data []byte, attributes objectAttributes) *memoryObject {
+	attributes.ETag = memoryETag(data)
+	return &memoryObject{
+		data:         data,
+		attributes:   attributes,
+		lastModified: time.Now(),
+	}
+}
+
+func (s *memoryStorage) CopyObject(_ context.Context, src string, dst string, options PutOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[src]
+	if !ok {
+		return ErrObjectNotFound
+	}
+	s.objects[dst] = newMemoryObject(object.data, newObjectAttributes(options))
+	return nil
+}
+
+func (s *memoryStorage) GetObject(_ context.Context, key string, options GetOptions) (*ObjectResponse, error) {
+	if options.Process != "" {
+		return nil, ErrNotSupported
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return newObjectResponse(bytes.NewReader(object.data), io.NopCloser(nil), int64(len(object.data)), object.lastModified, object.attributes, options.Range), nil
+}
+
+func (s *memoryStorage) HeadObject(_ context.Context, key string) (*ObjectMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return &ObjectMeta{
+		ETag:               object.attributes.ETag,
+		Size:               int64(len(object.data)),
+		ContentType:        object.attributes.ContentType,
+		ContentDisposition: object.attributes.ContentDisposition,
+		CacheControl:       object.attributes.CacheControl,
+		LastModified:       object.lastModified,
+		ExpiresAt:          object.attributes.expiresAt(object.lastModified),
+		Metadata:           object.attributes.Metadata,
+	}, nil
+}
+
+func (s *memoryStorage) ListObjects(_ context.Context, options ListOptions) (*ListResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for key, object := range s.objects {
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         int64(len(object.data)),
+			LastModified: object.lastModified,
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return listSortedObjects(objects, options), nil
+}
+
+func (s *memoryStorage) DeleteObjects(_ context.Context, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.objects, key)
+	}
+	return nil
+}
+
+func (s *memoryStorage) InitMultipartUpload(_ context.Context, key string, options PutOptions) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uploadId := uuid.NewString()
+	s.uploads[uploadId] = &memoryUpload{
+		key:        key,
+		attributes: newObjectAttributes(options),
+		parts:      make(map[int][]byte),
+		initiated:  time.Now(),
+	}
+	return uploadId, nil
+}
+
+// upload returns the upload with the given id, the caller must hold the lock.
+func (s *memoryStorage) upload(key string, uploadId string) (*memoryUpload, error) {
+	upload, ok := s.uploads[uploadId]
+	if !ok || upload.key != key {
+		return nil, ErrObjectNotFound
+	}
+	return upload, nil
+}
+
+func (s *memoryStorage) UploadPart(_ context.Context, key string, uploadId string, partNumber int, body io.Reader, size int64, checksum PartChecksum) (UploadedPart, error) {
+	data, err := io.ReadAll(newChecksumReader(body, size, checksum))
+	if err != nil {
+		return UploadedPart{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, err := s.upload(key, uploadId)
+	if err != nil {
+		return UploadedPart{}, err
+	}
+	upload.parts[partNumber] = data
+	return UploadedPart{
+		PartNumber: partNumber,
+		ETag:       memoryETag(data),
+		Size:       int64(len(data)),
+	}, nil
+}
+
+func (s *memoryStorage) CompleteMultipartUpload(_ context.Context, key string, uploadId string, parts []UploadedPart) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, err := s.upload(key, uploadId)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return errors.New("no parts to complete the upload with")
+	}
+
+	parts = append([]UploadedPart(nil), parts...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	var data []byte
+	for _, part := range parts {
+		partData, ok := upload.parts[part.PartNumber]
+		if !ok || memoryETag(partData) != part.ETag {
+			return fmt.Errorf("invalid part: %d", part.PartNumber)
+		}
+		data = append(data, partData...)
+	}
+
+	s.objects[key] = newMemoryObject(data, upload.attributes)
+	delete(s.uploads, uploadId)
+	return nil
+}
+
+func (s *memoryStorage) AbortMultipartUpload(_ context.Context, key string, uploadId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.upload(key, uploadId); err != nil {
+		return err
+	}
+	delete(s.uploads, uploadId)
+	return nil
+}
+
+func (s *memoryStorage) ListUploadedParts(_ context.Context, key string, uploadId string) ([]UploadedPart, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	upload, err := s.upload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+	var parts []UploadedPart
+	for partNumber, data := range upload.parts {
+		parts = append(parts, UploadedPart{
+			PartNumber: partNumber,
+			ETag:       memoryETag(data),
+			Size:       int64(len(data)),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+func (s *memoryStorage) ListMultipartUploads(_ context.Context, prefix string) ([]MultipartUpload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var uploads []MultipartUpload
+	for uploadId, upload := range s.uploads {
+		if strings.HasPrefix(upload.key, prefix) {
+			uploads = append(uploads, MultipartUpload{
+				Key:       upload.key,
+				UploadId:  uploadId,
+				Initiated: upload.initiated,
+			})
+		}
+	}
+	return uploads, nil
+}
+
+func (s *memoryStorage) SignURL(context.Context, string, string, time.Duration, SignOptions) (string, error) {
+	return "", ErrNotSupported
+}
@@ -0,0 +1,476 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/spf13/viper"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3LifecycleRulePrefix = "simple-share-period-"
+
+const s3MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// s3Storage Storage backed by an S3 compatible service, like AWS S3, MinIO or Cloudflare R2.
+type s3Storage struct {
+	bucket string
+	client *minio.Core
+	// public is used to sign URLs which are accessed by the client
+	public *minio.Client
+}
+
+func newS3Client(internal bool) (*minio.Client, error) {
+	endpoint := viper.GetString("s3.endpoint")
+	if !internal {
+		endpointPublic := viper.GetString("s3.endpoint_public")
+		if endpointPublic != "" {
+			endpoint = endpointPublic
+		}
+	}
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil || endpointUrl.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", endpoint)
+	}
+
+	bucketLookup := minio.BucketLookupAuto
+	if viper.GetBool("s3.path_style") {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	return minio.New(endpointUrl.Host, &minio.Options{
+		Creds: credentials.NewStaticV4(
+			viper.GetString("s3.access_key_id"),
+			viper.GetString("s3.access_key_secret"),
+			"",
+		),
+		Secure:       endpointUrl.Scheme != "http",
+		Region:       viper.GetString("s3.region"),
+		BucketLookup: bucketLookup,
+	})
+}
+
+func newS3Storage() (*s3Storage, error) {
+	client, err := newS3Client(true)
+	if err != nil {
+		return nil, err
+	}
+	public, err := newS3Client(false)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{
+		bucket: viper.GetString("s3.bucket"),
+		client: &minio.Core{Client: client},
+		public: public,
+	}, nil
+}
+
+// s3Error converts `NoSuchKey` and `NoSuchUpload` errors into ErrObjectNotFound,
+// and failed conditions into ErrPreconditionFailed.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchUpload", "NotFound":
+		return ErrObjectNotFound
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return ErrPreconditionFailed
+	case "BadDigest", "XAmzContentSHA256Mismatch":
+		return ErrChecksumMismatch
+	}
+	return err
+}
+
+// s3ETag returns the ETag quoted, as the client strips the quotes from some responses only.
+func s3ETag(etag string) string {
+	return "\"" + strings.Trim(etag, "\"") + "\""
+}
+
+// S3 user metadata only allows US-ASCII, so values are stored MIME encoded.
+func s3EncodeMeta(metadata map[string]string) map[string]string {
+	encoded := make(map[string]string)
+	for k, v := range metadata {
+		encoded[k] = mime.QEncoding.Encode("utf-8", v)
+	}
+	return encoded
+}
+
+func s3DecodeMeta(metadata map[string]string) map[string]string {
+	decoder := new(mime.WordDecoder)
+	decoded := make(map[string]string)
+	for k, v := range metadata {
+		if d, err := decoder.DecodeHeader(v); err == nil {
+			v = d
+		}
+		decoded[http.CanonicalHeaderKey(k)] = v
+	}
+	return decoded
+}
+
+func s3PutOptions(options PutOptions) minio.PutObjectOptions {
+	return minio.PutObjectOptions{
+		ContentType:        options.ContentType,
+		ContentDisposition: options.ContentDisposition,
+		CacheControl:       options.CacheControl,
+		UserMetadata:       s3EncodeMeta(options.Metadata),
+		UserTags:           options.Tags,
+	}
+}
+
+func (s *s3Storage) PutObject(ctx context.Context, key string, body io.Reader, options PutOptions) error {
+	// objects put directly are small, like text shares and directory trees,
+	// so they are read into memory to get a known size and a single request
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	putOptions := s3PutOptions(options)
+	if options.IfMatch != "" {
+		putOptions.SetMatchETag(strings.Trim(options.IfMatch, "\""))
+	}
+	if options.IfNoneMatch {
+		putOptions.SetMatchETagExcept("*")
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), options.ContentMD5, "", putOptions)
+	return s3Error(err)
+}
+
+func (s *s3Storage) CopyObject(ctx context.Context, src string, dst string, options PutOptions) error {
+	userMetadata := s3EncodeMeta(options.Metadata)
+	if options.ContentType != "" {
+		userMetadata["Content-Type"] = options.ContentType
+	}
+	if options.ContentDisposition != "" {
+		userMetadata["Content-Disposition"] = options.ContentDisposition
+	}
+	if options.CacheControl != "" {
+		userMetadata["Cache-Control"] = options.CacheControl
+	}
+
+	srcInfo, err := s.client.StatObject(ctx, s.bucket, src, minio.StatObjectOptions{})
+	if err != nil {
+		return s3Error(err)
+	}
+	dstOptions := minio.CopyDestOptions{
+		Bucket:          s.bucket,
+		Object:          dst,
+		UserMetadata:    userMetadata,
+		ReplaceMetadata: true,
+		UserTags:        options.Tags,
+		ReplaceTags:     true,
+	}
+	srcOptions := minio.CopySrcOptions{
+		Bucket:    s.bucket,
+		Object:    src,
+		MatchETag: srcInfo.ETag,
+	}
+	// a single copy request is limited to 5 GiB, larger objects are copied in parts
+	if srcInfo.Size > s3MaxCopySize {
+		_, err = s.client.ComposeObject(ctx, dstOptions, srcOptions)
+	} else {
+		_, err = s.client.Client.CopyObject(ctx, dstOptions, srcOptions)
+	}
+	return s3Error(err)
+}
+
+func (s *s3Storage) GetObject(ctx context.Context, key string, options GetOptions) (*ObjectResponse, error) {
+	if options.Process != "" {
+		return nil, ErrNotSupported
+	}
+	getOptions := minio.GetObjectOptions{}
+	if options.Range != "" {
+		getOptions.Set("Range", options.Range)
+	}
+
+	body, _, headers, err := s.client.GetObject(ctx, s.bucket, key, getOptions)
+	if minio.ToErrorResponse(err).Code == "InvalidRange" {
+		// answered like the other backends do, with the size of the object
+		info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, s3Error(err)
+		}
+		headers = make(http.Header)
+		headers.Set("Content-Range", "bytes */"+strconv.FormatInt(info.Size, 10))
+		return &ObjectResponse{
+			StatusCode: http.StatusRequestedRangeNotSatisfiable,
+			Headers:    headers,
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	statusCode := http.StatusOK
+	if headers.Get("Content-Range") != "" {
+		statusCode = http.StatusPartialContent
+	}
+	return &ObjectResponse{
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       body,
+	}, nil
+}
+
+func (s *s3Storage) HeadObject(ctx context.Context, key string) (*ObjectMeta, error) {
+	res, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	meta := &ObjectMeta{
+		ETag:               s3ETag(res.ETag),
+		Size:               res.Size,
+		ContentType:        res.ContentType,
+		ContentDisposition: res.Metadata.Get("Content-Disposition"),
+		CacheControl:       res.Metadata.Get("Cache-Control"),
+		LastModified:       res.LastModified,
+		Metadata:           s3DecodeMeta(res.UserMetadata),
+	}
+	if !res.Expiration.IsZero() {
+		meta.ExpiresAt = &res.Expiration
+	}
+	return meta, nil
+}
+
+// ListObjects lists a page of objects, only `/` is supported as the delimiter.
+// The continuation token is the last key or common prefix returned, like on the other backends.
+func (s *s3Storage) ListObjects(ctx context.Context, options ListOptions) (*ListResult, error) {
+	if options.Delimiter != "" && options.Delimiter != "/" {
+		return nil, fmt.Errorf("unsupported delimiter: %s", options.Delimiter)
+	}
+	maxKeys := options.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	objectsCh := s.client.Client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:     options.Prefix,
+		Recursive:  options.Delimiter == "",
+		StartAfter: options.ContinuationToken,
+		// one more than requested, to tell if the listing is truncated
+		MaxKeys: maxKeys + 1,
+	})
+	defer func() {
+		// the listing is stopped once the page is full, and drained so it can exit
+		cancel()
+		for range objectsCh {
+		}
+	}()
+
+	// in each page of the listing, common prefixes are sent after the objects,
+	// so the page is sorted once it is read
+	var entries []minio.ObjectInfo
+	for object := range objectsCh {
+		if object.Err != nil {
+			return nil, s3Error(object.Err)
+		}
+		if object.Key == options.ContinuationToken {
+			// the common prefix the previous page ended with
+			continue
+		}
+		entries = append(entries, object)
+		if len(entries) > maxKeys {
+			break
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	result := &ListResult{}
+	if len(entries) > maxKeys {
+		entries = entries[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = entries[maxKeys-1].Key
+	}
+	for _, object := range entries {
+		if object.LastModified.IsZero() && strings.HasSuffix(object.Key, "/") {
+			result.CommonPrefixes = append(result.CommonPrefixes, object.Key)
+			continue
+		}
+		result.Objects = append(result.Objects, ObjectInfo{
+			Key:          object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+	}
+	return result, nil
+}
+
+func (s *s3Storage) DeleteObjects(ctx context.Context, keys []string) error {
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objectsCh)
+		for _, key := range keys {
+			objectsCh <- minio.ObjectInfo{Key: key}
+		}
+	}()
+
+	var err error
+	for res := range s.client.RemoveObjects(ctx, s.bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if err == nil && res.Err != nil && !errors.Is(s3Error(res.Err), ErrObjectNotFound) {
+			err = res.Err
+		}
+	}
+	return err
+}
+
+func (s *s3Storage) InitMultipartUpload(ctx context.Context, key string, options PutOptions) (string, error) {
+	return s.client.NewMultipartUpload(ctx, s.bucket, key, s3PutOptions(options))
+}
+
+func (s *s3Storage) UploadPart(ctx context.Context, key string, uploadId string, partNumber int, body io.Reader, size int64, checksum PartChecksum) (UploadedPart, error) {
+	res, err := s.client.PutObjectPart(ctx, s.bucket, key, uploadId, partNumber, body, size, minio.PutObjectPartOptions{
+		// the body is streamed from the client, so its checksum cannot be computed ahead,
+		// but the ones sent by the client are, as `Content-MD5` and `X-Amz-Content-Sha256`
+		Md5Base64:            checksum.MD5,
+		Sha256Hex:            strings.ToLower(checksum.SHA256),
+		DisableContentSha256: true,
+	})
+	if err != nil {
+		return UploadedPart{}, s3Error(err)
+	}
+	return UploadedPart{
+		PartNumber: res.PartNumber,
+		ETag:       s3ETag(res.ETag),
+		Size:       res.Size,
+	}, nil
+}
+
+func (s *s3Storage) CompleteMultipartUpload(ctx context.Context, key string, uploadId string, parts []UploadedPart) error {
+	var completeParts []minio.CompletePart
+	for _, part := range parts {
+		completeParts = append(completeParts, minio.CompletePart{
+			PartNumber: part.PartNumber,
+			ETag:       part.ETag,
+		})
+	}
+	// S3 requires the parts in ascending order
+	sort.Slice(completeParts, func(i, j int) bool {
+		return completeParts[i].PartNumber < completeParts[j].PartNumber
+	})
+	_, err := s.client.CompleteMultipartUpload(ctx, s.bucket, key, uploadId, completeParts, minio.PutObjectOptions{})
+	return s3Error(err)
+}
+
+func (s *s3Storage) AbortMultipartUpload(ctx context.Context, key string, uploadId string) error {
+	return s3Error(s.client.AbortMultipartUpload(ctx, s.bucket, key, uploadId))
+}
+
+func (s *s3Storage) ListUploadedParts(ctx context.Context, key string, uploadId string) ([]UploadedPart, error) {
+	var parts []UploadedPart
+	marker := 0
+	for {
+		res, err := s.client.ListObjectParts(ctx, s.bucket, key, uploadId, marker, 1000)
+		if err != nil {
+			return nil, s3Error(err)
+		}
+		for _, part := range res.ObjectParts {
+			parts = append(parts, UploadedPart{
+				PartNumber: part.PartNumber,
+				ETag:       s3ETag(part.ETag),
+				Size:       part.Size,
+			})
+		}
+		if !res.IsTruncated || res.NextPartNumberMarker == 0 {
+			break
+		}
+		marker = res.NextPartNumberMarker
+	}
+	return parts, nil
+}
+
+func (s *s3Storage) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	var uploads []MultipartUpload
+	keyMarker, uploadIdMarker := "", ""
+	for {
+		res, err := s.client.ListMultipartUploads(ctx, s.bucket, prefix, keyMarker, uploadIdMarker, "", 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, upload := range res.Uploads {
+			uploads = append(uploads, MultipartUpload{
+				Key:       upload.Key,
+				UploadId:  upload.UploadID,
+				Initiated: upload.Initiated,
+			})
+		}
+		if !res.IsTruncated {
+			return uploads, nil
+		}
+		keyMarker, uploadIdMarker = res.NextKeyMarker, res.NextUploadIDMarker
+	}
+}
+
+func (s *s3Storage) SignURL(ctx context.Context, key string, method string, expires time.Duration, options SignOptions) (string, error) {
+	params := make(url.Values)
+	if options.ContentType != "" {
+		params.Set("response-content-type", options.ContentType)
+	}
+	if options.ContentDisposition != "" {
+		params.Set("response-content-disposition", options.ContentDisposition)
+	}
+	if options.UploadId != "" {
+		params.Set("partNumber", strconv.Itoa(options.PartNumber))
+		params.Set("uploadId", options.UploadId)
+	}
+	// signed headers must be sent as they are by the client
+	header := make(http.Header)
+	if options.ContentMD5 != "" {
+		header.Set("Content-MD5", options.ContentMD5)
+	}
+	res, err := s.public.PresignHeader(ctx, method, s.bucket, key, expires, params, header)
+	if err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
+// ensureLifecycle installs the lifecycle rules which expire objects by their `period` tag,
+// keeping any other rule already set on the bucket.
+func (s *s3Storage) ensureLifecycle(ctx context.Context) error {
+	config, err := s.client.GetBucketLifecycle(ctx, s.bucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+			return err
+		}
+		config = lifecycle.NewConfiguration()
+	}
+
+	var rules []lifecycle.Rule
+	for _, rule := range config.Rules {
+		if !strings.HasPrefix(rule.ID, s3LifecycleRulePrefix) {
+			rules = append(rules, rule)
+		}
+	}
+	for _, period := range lifecyclePeriods {
+		rules = append(rules, lifecycle.Rule{
+			ID:     s3LifecycleRulePrefix + strconv.Itoa(period),
+			Status: "Enabled",
+			RuleFilter: lifecycle.Filter{
+				Tag: lifecycle.Tag{Key: "period", Value: strconv.Itoa(period)},
+			},
+			Expiration: lifecycle.Expiration{
+				Days: lifecycle.ExpirationDays(period),
+			},
+		})
+	}
+	config.Rules = rules
+
+	return s.client.SetBucketLifecycle(ctx, s.bucket, config)
+}
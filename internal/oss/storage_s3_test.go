@@ -0,0 +1,572 @@
+package oss
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jingbh/simple-share/internal/utils"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeS3Server An S3 compatible server backed by a memoryStorage,
+// serving the subset of the API which s3Storage uses, with path style requests.
+type fakeS3Server struct {
+	bucket  string
+	storage *memoryStorage
+}
+
+type fakeS3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+type fakeS3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeS3Object
+	CommonPrefixes        []struct{ Prefix string }
+}
+
+type fakeS3Part struct {
+	PartNumber   int
+	ETag         string
+	Size         int64 `xml:",omitempty"`
+	LastModified time.Time
+}
+
+// newFakeS3Storage returns an s3Storage talking to a fake S3 server, which is closed once the test ends,
+// and an HTTP client trusting the server.
+func newFakeS3Storage(t *testing.T) (*s3Storage, *http.Client) {
+	f := &fakeS3Server{
+		bucket:  "test",
+		storage: newMemoryStorage(),
+	}
+	server := httptest.NewTLSServer(f)
+	t.Cleanup(server.Close)
+
+	endpoint, _ := url.Parse(server.URL)
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4("test", "secret", ""),
+		Secure:       true,
+		Transport:    server.Client().Transport,
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &s3Storage{
+		bucket: f.bucket,
+		client: &minio.Core{Client: client},
+		public: client,
+	}, server.Client()
+}
+
+func (f *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Has("uploads"):
+		f.listMultipartUploads(w, r)
+	case key == "" && r.Method == http.MethodGet:
+		f.listObjects(w, r)
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		f.deleteObjects(w, r)
+	case key == "":
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.initMultipartUpload(w, r, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.uploadPart(w, r, key)
+	case r.Method == http.MethodGet && query.Has("uploadId"):
+		f.listParts(w, r, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.completeMultipartUpload(w, r, key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.abortMultipartUpload(w, r, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.copyObject(w, r, key)
+	case r.Method == http.MethodPut:
+		f.putObject(w, r, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.getObject(w, r, key)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{
+		Code:    code,
+		Message: code,
+	})
+}
+
+func fakeS3Xml(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+// fakeS3PutOptions reads the attributes of an object from the request headers.
+func fakeS3PutOptions(header http.Header) PutOptions {
+	options := PutOptions{
+		ContentType:        header.Get("Content-Type"),
+		ContentDisposition: header.Get("Content-Disposition"),
+		CacheControl:       header.Get("Cache-Control"),
+		ContentMD5:         header.Get("Content-Md5"),
+		Metadata:           make(map[string]string),
+	}
+	for k := range header {
+		if name, ok := strings.CutPrefix(k, "X-Amz-Meta-"); ok {
+			options.Metadata[name] = header.Get(k)
+		}
+	}
+	if tagging := header.Get("X-Amz-Tagging"); tagging != "" {
+		values, _ := url.ParseQuery(tagging)
+		options.Tags = make(map[string]string)
+		for k := range values {
+			options.Tags[k] = values.Get(k)
+		}
+	}
+	return options
+}
+
+// fakeS3ETag returns the quoted ETag the way S3 does.
+func fakeS3ETag(etag string) string {
+	return "\"" + strings.Trim(etag, "\"") + "\""
+}
+
+func (f *fakeS3Server) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	options := fakeS3PutOptions(r.Header)
+	options.IfMatch = r.Header.Get("If-Match")
+	options.IfNoneMatch = r.Header.Get("If-None-Match") == "*"
+	err := f.storage.PutObject(r.Context(), key, r.Body, options)
+	if errors.Is(err, ErrPreconditionFailed) {
+		fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	} else if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "BadDigest")
+		return
+	}
+	meta, err := f.storage.HeadObject(r.Context(), key)
+	if err != nil {
+		fakeS3Error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("ETag", meta.ETag)
+}
+
+func (f *fakeS3Server) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	src = strings.TrimPrefix(strings.TrimPrefix(src, "/"), f.bucket+"/")
+	if err := f.storage.CopyObject(r.Context(), src, key, fakeS3PutOptions(r.Header)); err != nil {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	f.storage.mu.RLock()
+	object := f.storage.objects[key]
+	f.storage.mu.RUnlock()
+	fakeS3Xml(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified time.Time
+	}{
+		ETag:         object.attributes.ETag,
+		LastModified: object.lastModified,
+	})
+}
+
+func (f *fakeS3Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	meta, err := f.storage.HeadObject(r.Context(), key)
+	if err != nil {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	res, err := f.storage.GetObject(r.Context(), key, GetOptions{Range: r.Header.Get("Range")})
+	if err != nil {
+		fakeS3Error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		fakeS3Error(w, res.StatusCode, "InvalidRange")
+		return
+	}
+
+	for k, v := range res.Headers {
+		w.Header()[k] = v
+	}
+	for k, v := range meta.Metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+	w.WriteHeader(res.StatusCode)
+	if r.Method == http.MethodGet {
+		_, _ = io.Copy(w, res.Body)
+	}
+}
+
+// listObjects lists like ListObjectsV2, where `start-after` excludes keys only,
+// so a common prefix is listed again if keys under it come after.
+func (f *fakeS3Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	startAfter, token := query.Get("start-after"), query.Get("continuation-token")
+	maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil || maxKeys <= 0 || maxKeys > 1000 {
+		maxKeys = 1000
+	}
+
+	f.storage.mu.RLock()
+	var objects []fakeS3Object
+	for key, object := range f.storage.objects {
+		objects = append(objects, fakeS3Object{
+			Key:          key,
+			Size:         int64(len(object.data)),
+			LastModified: object.lastModified,
+			ETag:         memoryETag(object.data),
+		})
+	}
+	f.storage.mu.RUnlock()
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	result := fakeS3ListResult{
+		Name:    f.bucket,
+		Prefix:  prefix,
+		MaxKeys: maxKeys,
+	}
+	last := ""
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Key, prefix) || object.Key <= startAfter {
+			continue
+		}
+		if token != "" && (object.Key <= token || strings.HasPrefix(object.Key, token)) {
+			continue
+		}
+		entry := object.Key
+		if i := strings.Index(strings.TrimPrefix(object.Key, prefix), delimiter); delimiter != "" && i >= 0 {
+			entry = object.Key[:len(prefix)+i+len(delimiter)]
+			if entry == last {
+				continue
+			}
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if entry != object.Key {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{entry})
+		} else {
+			result.Contents = append(result.Contents, object)
+		}
+		result.KeyCount++
+		last = entry
+	}
+	fakeS3Xml(w, result)
+}
+
+func (f *fakeS3Server) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Object []struct{ Key string }
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	result := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Deleted []struct{ Key string }
+	}{}
+	for _, object := range request.Object {
+		_ = f.storage.DeleteObjects(r.Context(), []string{object.Key})
+		result.Deleted = append(result.Deleted, struct{ Key string }{object.Key})
+	}
+	fakeS3Xml(w, result)
+}
+
+func (f *fakeS3Server) initMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	uploadId, _ := f.storage.InitMultipartUpload(r.Context(), key, fakeS3PutOptions(r.Header))
+	fakeS3Xml(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{
+		Bucket:   f.bucket,
+		Key:      key,
+		UploadId: uploadId,
+	})
+}
+
+func (f *fakeS3Server) uploadPart(w http.ResponseWriter, r *http.Request, key string) {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	checksum := PartChecksum{MD5: r.Header.Get("Content-Md5")}
+	if sum := r.Header.Get("X-Amz-Content-Sha256"); len(sum) == 64 {
+		// not `UNSIGNED-PAYLOAD` or the like
+		checksum.SHA256 = sum
+	}
+	part, err := f.storage.UploadPart(r.Context(), key, r.URL.Query().Get("uploadId"), partNumber, r.Body, r.ContentLength, checksum)
+	if errors.Is(err, ErrChecksumMismatch) {
+		fakeS3Error(w, http.StatusBadRequest, "BadDigest")
+		return
+	} else if err != nil {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	w.Header().Set("ETag", part.ETag)
+}
+
+func (f *fakeS3Server) listParts(w http.ResponseWriter, r *http.Request, key string) {
+	uploadId := r.URL.Query().Get("uploadId")
+	parts, err := f.storage.ListUploadedParts(r.Context(), key, uploadId)
+	if err != nil {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Bucket      string
+		Key         string
+		UploadId    string
+		IsTruncated bool
+		Part        []fakeS3Part
+	}{
+		Bucket:   f.bucket,
+		Key:      key,
+		UploadId: uploadId,
+	}
+	for _, part := range parts {
+		result.Part = append(result.Part, fakeS3Part{
+			PartNumber:   part.PartNumber,
+			ETag:         part.ETag,
+			Size:         part.Size,
+			LastModified: time.Now(),
+		})
+	}
+	fakeS3Xml(w, result)
+}
+
+func (f *fakeS3Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	var request struct {
+		Part []fakeS3Part
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var parts []UploadedPart
+	for _, part := range request.Part {
+		parts = append(parts, UploadedPart{
+			PartNumber: part.PartNumber,
+			ETag:       fakeS3ETag(part.ETag),
+		})
+	}
+	err := f.storage.CompleteMultipartUpload(r.Context(), key, r.URL.Query().Get("uploadId"), parts)
+	if errors.Is(err, ErrObjectNotFound) {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "InvalidPart")
+		return
+	}
+	fakeS3Xml(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+	}{
+		Bucket: f.bucket,
+		Key:    key,
+	})
+}
+
+func (f *fakeS3Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	if err := f.storage.AbortMultipartUpload(r.Context(), key, r.URL.Query().Get("uploadId")); err != nil {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeS3Server) listMultipartUploads(w http.ResponseWriter, r *http.Request) {
+	uploads, _ := f.storage.ListMultipartUploads(r.Context(), r.URL.Query().Get("prefix"))
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated time.Time
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket      string
+		IsTruncated bool
+		Upload      []upload
+	}{
+		Bucket: f.bucket,
+	}
+	for _, u := range uploads {
+		result.Upload = append(result.Upload, upload{
+			Key:       u.Key,
+			UploadId:  u.UploadId,
+			Initiated: u.Initiated,
+		})
+	}
+	fakeS3Xml(w, result)
+}
+
+func TestS3Storage(t *testing.T) {
+	storage, _ := newFakeS3Storage(t)
+	testStorage(t, storage)
+}
+
+func TestS3StorageSignURL(t *testing.T) {
+	storage, client := newFakeS3Storage(t)
+	ctx := context.Background()
+
+	if err := storage.PutObject(ctx, "signed/a.txt", strings.NewReader("signed content"), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := storage.SignURL(ctx, "signed/a.txt", http.MethodGet, time.Hour, SignOptions{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(link)
+	if u.Path != "/test/signed/a.txt" || u.Query().Get("X-Amz-Signature") == "" || u.Query().Get("response-content-type") != "text/plain" {
+		t.Fatalf("unexpected signed url: %s", link)
+	}
+	res, err := client.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "signed content" {
+		t.Fatalf("unexpected signed download: %d %q", res.StatusCode, body)
+	}
+
+	// parts are uploaded to signed links by the clients
+	uploadId, err := storage.InitMultipartUpload(ctx, "signed/b.bin", PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partMD5 := utils.MD5HashBase64([]byte("part"))
+	link, err = storage.SignURL(ctx, "signed/b.bin", http.MethodPut, time.Hour, SignOptions{UploadId: uploadId, PartNumber: 1, ContentMD5: partMD5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse(link)
+	if !strings.Contains(u.Query().Get("X-Amz-SignedHeaders"), "content-md5") {
+		t.Fatalf("checksum not signed: %s", link)
+	}
+	// the checksum is sent by the client as it is signed, and verified by the storage
+	for i, body := range []string{"tart", "part"} {
+		status := []int{http.StatusBadRequest, http.StatusOK}[i]
+		req, _ := http.NewRequest(http.MethodPut, link, strings.NewReader(body))
+		req.Header.Set("Content-MD5", partMD5)
+		res, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("unexpected status of signed part upload of %q: %d", body, res.StatusCode)
+		}
+	}
+	parts, err := storage.ListUploadedParts(ctx, "signed/b.bin", uploadId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.CompleteMultipartUpload(ctx, "signed/b.bin", uploadId, parts); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := storage.HeadObject(ctx, "signed/b.bin")
+	if err != nil || meta.Size != 4 {
+		t.Fatalf("unexpected object uploaded by parts: %+v %v", meta, err)
+	}
+}
+
+// TestS3StorageServer runs the storage tests against a real S3 compatible server, like MinIO,
+// in a new bucket which is removed afterward. It is skipped unless `S3_TEST_ENDPOINT` is set.
+func TestS3StorageServer(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := minio.New(endpointUrl.Host, &minio.Options{
+		Creds: credentials.NewStaticV4(
+			os.Getenv("S3_TEST_ACCESS_KEY_ID"),
+			os.Getenv("S3_TEST_ACCESS_KEY_SECRET"),
+			"",
+		),
+		Secure:       endpointUrl.Scheme != "http",
+		Region:       os.Getenv("S3_TEST_REGION"),
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	bucket := "simple-share-test-" + uuid.NewString()[:8]
+	if err = client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: os.Getenv("S3_TEST_REGION")}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for object := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true}) {
+			_ = client.RemoveObject(ctx, bucket, object.Key, minio.RemoveObjectOptions{})
+		}
+		for upload := range client.ListIncompleteUploads(ctx, bucket, "", true) {
+			_ = client.RemoveIncompleteUpload(ctx, bucket, upload.Key)
+		}
+		if err := client.RemoveBucket(ctx, bucket); err != nil {
+			t.Log("Failed to remove the test bucket: ", err)
+		}
+	})
+
+	testStorage(t, &s3Storage{
+		bucket: bucket,
+		client: &minio.Core{Client: client},
+		public: client,
+	})
+}
@@ -0,0 +1,471 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/jingbh/simple-share/internal/utils"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStorage runs the behavior every Storage is expected to have against `storage`, which must be empty.
+func testStorage(t *testing.T, storage Storage) {
+	ctx := context.Background()
+
+	t.Run("PutGet", func(t *testing.T) {
+		err := storage.PutObject(ctx, "objects/a.txt", strings.NewReader("0123456789"), PutOptions{
+			ContentType:        "text/plain",
+			ContentDisposition: "attachment; filename=a.txt",
+			Metadata:           map[string]string{"share-type": "text"},
+			Tags:               map[string]string{"period": "7"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := storage.GetObject(ctx, "objects/a.txt", GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readObject(t, res); res.StatusCode != http.StatusOK || body != "0123456789" {
+			t.Fatalf("unexpected object: %d %q", res.StatusCode, body)
+		}
+		if res.Headers.Get("Content-Type") != "text/plain" || res.Headers.Get("Content-Disposition") != "attachment; filename=a.txt" {
+			t.Fatalf("unexpected headers: %v", res.Headers)
+		}
+
+		res, err = storage.GetObject(ctx, "objects/a.txt", GetOptions{Range: "bytes=2-4"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readObject(t, res); res.StatusCode != http.StatusPartialContent || body != "234" || res.Headers.Get("Content-Range") != "bytes 2-4/10" {
+			t.Fatalf("unexpected range: %d %q %q", res.StatusCode, body, res.Headers.Get("Content-Range"))
+		}
+
+		res, err = storage.GetObject(ctx, "objects/a.txt", GetOptions{Range: "bytes=10-"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = readObject(t, res)
+		if res.StatusCode != http.StatusRequestedRangeNotSatisfiable || res.Headers.Get("Content-Range") != "bytes */10" {
+			t.Fatalf("unexpected unsatisfiable range: %d %q", res.StatusCode, res.Headers.Get("Content-Range"))
+		}
+
+		meta, err := storage.HeadObject(ctx, "objects/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Size != 10 || meta.ContentType != "text/plain" || meta.Meta("Share-Type") != "text" || meta.LastModified.IsZero() {
+			t.Fatalf("unexpected meta: %+v", meta)
+		}
+
+		if _, err = storage.GetObject(ctx, "objects/missing", GetOptions{}); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+		if _, err = storage.HeadObject(ctx, "objects/missing"); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	})
+
+	t.Run("ListObjects", func(t *testing.T) {
+		for _, key := range []string{"list/1", "list/2", "list/b/3", "list/c/4", "listing"} {
+			if err := storage.PutObject(ctx, key, strings.NewReader(key), PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var keys, prefixes []string
+		continuationToken := ""
+		for pages := 0; ; pages++ {
+			if pages > 4 {
+				t.Fatal("listing does not end")
+			}
+			res, err := storage.ListObjects(ctx, ListOptions{
+				Prefix:            "list/",
+				Delimiter:         "/",
+				ContinuationToken: continuationToken,
+				MaxKeys:           1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, object := range res.Objects {
+				keys = append(keys, object.Key)
+			}
+			prefixes = append(prefixes, res.CommonPrefixes...)
+			if !res.IsTruncated {
+				break
+			}
+			continuationToken = res.NextContinuationToken
+		}
+		if !reflect.DeepEqual(keys, []string{"list/1", "list/2"}) || !reflect.DeepEqual(prefixes, []string{"list/b/", "list/c/"}) {
+			t.Fatalf("unexpected listing: %v %v", keys, prefixes)
+		}
+
+		objects, err := listAllObjects(ctx, storage, "list")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) != 5 || objects[0].Key != "list/1" || objects[0].Size != 6 {
+			t.Fatalf("unexpected objects: %+v", objects)
+		}
+	})
+
+	t.Run("CopyDelete", func(t *testing.T) {
+		if err := storage.PutObject(ctx, "copy/src", strings.NewReader("content"), PutOptions{Metadata: map[string]string{"Share-Type": "file"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.CopyObject(ctx, "copy/src", "copy/dst", PutOptions{Metadata: map[string]string{"Share-Type": "text"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.CopyObject(ctx, "copy/missing", "copy/dst", PutOptions{}); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+
+		meta, err := storage.HeadObject(ctx, "copy/dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Size != 7 || meta.Meta("Share-Type") != "text" {
+			t.Fatalf("unexpected copy: %+v", meta)
+		}
+		res, err := storage.GetObject(ctx, "copy/dst", GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readObject(t, res); body != "content" {
+			t.Fatalf("unexpected copy content: %q", body)
+		}
+
+		// deleting a missing object is not an error
+		if err = storage.DeleteObjects(ctx, []string{"copy/src", "copy/dst", "copy/missing"}); err != nil {
+			t.Fatal(err)
+		}
+		objects, err := listAllObjects(ctx, storage, "copy/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) != 0 {
+			t.Fatalf("objects left after delete: %+v", objects)
+		}
+	})
+
+	t.Run("Checksum", func(t *testing.T) {
+		key := "checksum/a.txt"
+		err := storage.PutObject(ctx, key, strings.NewReader("changed"), PutOptions{ContentMD5: utils.MD5HashBase64([]byte("content"))})
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("expected checksum mismatch, got %v", err)
+		}
+		if _, err = storage.HeadObject(ctx, key); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("object put with a wrong checksum: %v", err)
+		}
+	})
+
+	t.Run("Conditional", func(t *testing.T) {
+		key := "conditional/counter.json"
+		if err := storage.PutObject(ctx, key, strings.NewReader("1"), PutOptions{IfMatch: `"missing"`}); !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatalf("expected precondition failed for a missing object, got %v", err)
+		}
+		if err := storage.PutObject(ctx, key, strings.NewReader("1"), PutOptions{IfNoneMatch: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.PutObject(ctx, key, strings.NewReader("2"), PutOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatalf("expected precondition failed for an existing object, got %v", err)
+		}
+
+		meta, err := storage.HeadObject(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := storage.GetObject(ctx, key, GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = readObject(t, res)
+		if meta.ETag == "" || res.Headers.Get("ETag") != meta.ETag {
+			t.Fatalf("unexpected etags: %q %q", meta.ETag, res.Headers.Get("ETag"))
+		}
+
+		if err = storage.PutObject(ctx, key, strings.NewReader("2"), PutOptions{IfMatch: meta.ETag}); err != nil {
+			t.Fatal(err)
+		}
+		if err = storage.PutObject(ctx, key, strings.NewReader("3"), PutOptions{IfMatch: meta.ETag}); !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatalf("expected precondition failed for a changed object, got %v", err)
+		}
+		res, err = storage.GetObject(ctx, key, GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readObject(t, res); body != "2" {
+			t.Fatalf("unexpected object after conditional puts: %q", body)
+		}
+		if err = storage.DeleteObjects(ctx, []string{key}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		key := "multipart/file.bin"
+		uploadId, err := storage.InitMultipartUpload(ctx, key, PutOptions{ContentType: "application/zip"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// parts may be uploaded in any order
+		first := bytes.Repeat([]byte("a"), 5*1024*1024)
+		second, err := storage.UploadPart(ctx, key, uploadId, 2, strings.NewReader("tail"), 4, PartChecksum{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := storage.UploadPart(ctx, key, uploadId, 1, bytes.NewReader(first), int64(len(first)), PartChecksum{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.PartNumber != 1 || part.ETag == "" || part.Size != int64(len(first)) {
+			t.Fatalf("unexpected part: %+v", part)
+		}
+
+		// parts not matching their checksums are rejected, and not kept
+		tailSum := sha256.Sum256([]byte("tail"))
+		checksums := []PartChecksum{
+			{MD5: utils.MD5HashBase64([]byte("tail"))},
+			{SHA256: hex.EncodeToString(tailSum[:])},
+		}
+		for _, checksum := range checksums {
+			_, err = storage.UploadPart(ctx, key, uploadId, 3, strings.NewReader("tall"), 4, checksum)
+			if !errors.Is(err, ErrChecksumMismatch) {
+				t.Fatalf("expected checksum mismatch of %+v, got %v", checksum, err)
+			}
+		}
+		if _, err = storage.UploadPart(ctx, key, uploadId, 2, strings.NewReader("tail"), 4, checksums[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		parts, err := storage.ListUploadedParts(ctx, key, uploadId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != 2 || parts[0].PartNumber != 1 || parts[1].PartNumber != 2 || parts[1].ETag != second.ETag || parts[1].Size != 4 {
+			t.Fatalf("unexpected parts: %+v", parts)
+		}
+
+		uploads, err := storage.ListMultipartUploads(ctx, "multipart/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(uploads) != 1 || uploads[0].Key != key || uploads[0].UploadId != uploadId {
+			t.Fatalf("unexpected uploads: %+v", uploads)
+		}
+		if uploads, err = storage.ListMultipartUploads(ctx, "other/"); err != nil || len(uploads) != 0 {
+			t.Fatalf("unexpected uploads of another prefix: %+v %v", uploads, err)
+		}
+
+		if err = storage.CompleteMultipartUpload(ctx, key, uploadId, []UploadedPart{second, part}); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := storage.HeadObject(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Size != int64(len(first))+4 || meta.ContentType != "application/zip" {
+			t.Fatalf("unexpected object: %+v", meta)
+		}
+		res, err := storage.GetObject(ctx, key, GetOptions{Range: "bytes=-5"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readObject(t, res); body != "atail" {
+			t.Fatalf("unexpected end of object: %q", body)
+		}
+
+		uploadId, err = storage.InitMultipartUpload(ctx, key, PutOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = storage.AbortMultipartUpload(ctx, key, uploadId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = storage.UploadPart(ctx, key, uploadId, 1, strings.NewReader("late"), 4, PartChecksum{}); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("expected not found after abort, got %v", err)
+		}
+		if uploads, err = storage.ListMultipartUploads(ctx, "multipart/"); err != nil || len(uploads) != 0 {
+			t.Fatalf("unexpected uploads after abort: %+v %v", uploads, err)
+		}
+	})
+}
+
+// readObject reads and closes the body of the response.
+func readObject(t *testing.T, res *ObjectResponse) string {
+	t.Helper()
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, newMemoryStorage())
+}
+
+func TestLocalStorage(t *testing.T) {
+	storage, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+}
+
+func TestLocalStorageKeys(t *testing.T) {
+	root := t.TempDir()
+	storage, err := newLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, key := range []string{"", "../escape", "..", "/absolute", "a/../b", "a//b", "a/./b", "a/"} {
+		if err := storage.PutObject(ctx, key, strings.NewReader("x"), PutOptions{}); err == nil {
+			t.Fatalf("put of invalid key %q succeeded", key)
+		}
+		if _, err := storage.GetObject(ctx, key, GetOptions{}); err == nil {
+			t.Fatalf("get of invalid key %q succeeded", key)
+		}
+		if _, err := storage.InitMultipartUpload(ctx, key, PutOptions{}); err == nil {
+			t.Fatalf("upload of invalid key %q succeeded", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "escape")); err == nil {
+		t.Fatal("object written outside of the root")
+	}
+	if _, err := storage.UploadPart(ctx, "a", "../../objects", 1, strings.NewReader("x"), 1, PartChecksum{}); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected not found for an invalid upload id, got %v", err)
+	}
+}
+
+func TestLocalStorageLayout(t *testing.T) {
+	root := t.TempDir()
+	storage, err := newLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	err = storage.PutObject(ctx, "shares/a.d/1.bin", strings.NewReader("content"), PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"Share-Type": "file"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar, err := os.ReadFile(filepath.Join(root, "meta", "shares", "a.d", "1.bin.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sidecar), `"Share-Type":"file"`) || !strings.Contains(string(sidecar), `"contentType":"text/plain"`) {
+		t.Fatalf("unexpected sidecar: %s", sidecar)
+	}
+
+	// a checksum mismatch leaves the existing object untouched
+	err = storage.PutObject(ctx, "shares/a.d/1.bin", strings.NewReader("changed"), PutOptions{ContentMD5: "AAAAAAAAAAAAAAAAAAAAAA=="})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "objects", "shares", "a.d", "1.bin")); string(data) != "content" {
+		t.Fatalf("object changed by a failed put: %q", data)
+	}
+
+	// the sidecar and the directories left empty go along with the object
+	if err = storage.DeleteObjects(ctx, []string{"shares/a.d/1.bin"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"objects/shares", "meta/shares"} {
+		if _, err = os.Stat(filepath.Join(root, p)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s is left after delete: %v", p, err)
+		}
+	}
+
+	// parts are assembled in order, then removed
+	uploadId, err := storage.InitMultipartUpload(ctx, "uploads/1.bin", PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []UploadedPart
+	for i, data := range []string{"first ", "second"} {
+		part, err := storage.UploadPart(ctx, "uploads/1.bin", uploadId, i+1, strings.NewReader(data), int64(len(data)), PartChecksum{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part)
+	}
+	if _, err = storage.UploadPart(ctx, "uploads/2.bin", uploadId, 1, strings.NewReader("x"), 1, PartChecksum{}); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected not found for another key, got %v", err)
+	}
+	stale := parts[0]
+	stale.ETag = `"0"`
+	if err = storage.CompleteMultipartUpload(ctx, "uploads/1.bin", uploadId, []UploadedPart{stale, parts[1]}); err == nil {
+		t.Fatal("complete with a wrong etag succeeded")
+	}
+	if err = storage.CompleteMultipartUpload(ctx, "uploads/1.bin", uploadId, parts); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "objects", "uploads", "1.bin")); string(data) != "first second" {
+		t.Fatalf("unexpected assembled object: %q", data)
+	}
+	if _, err = os.Stat(filepath.Join(root, "multipart", uploadId)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("parts are left after complete: %v", err)
+	}
+}
+
+func TestLocalStorageSweepExpired(t *testing.T) {
+	root := t.TempDir()
+	storage, err := newLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for key, period := range map[string]string{"shares/expired": "1", "shares/fresh": "7", "shares/forever": ""} {
+		options := PutOptions{}
+		if period != "" {
+			options.Tags = map[string]string{"period": period}
+		}
+		if err = storage.PutObject(ctx, key, strings.NewReader(key), options); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-48 * time.Hour)
+		if err = os.Chtimes(filepath.Join(root, "objects", "shares", strings.TrimPrefix(key, "shares/")), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := storage.SweepExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 swept object, got %d", n)
+	}
+	objects, err := listAllObjects(ctx, storage, "shares/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "shares/forever" || objects[1].Key != "shares/fresh" {
+		t.Fatalf("unexpected objects after sweep: %+v", objects)
+	}
+	if _, err = os.Stat(filepath.Join(root, "meta", "shares", "expired.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("sidecar is left after sweep: %v", err)
+	}
+}
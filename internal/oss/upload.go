@@ -1,27 +1,135 @@
 package oss
 
 import (
+	"bytes"
 	"context"
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"encoding/json"
+	"errors"
 	"github.com/google/uuid"
-	"github.com/pkg/errors"
+	"github.com/jingbh/simple-share/internal/utils"
 	"io"
-	"sync"
+	"net/http"
+	"slices"
+	"strings"
 	"time"
 )
 
 // UploadPartSize 20MB
 const UploadPartSize = 20 * 1024 * 1024
 
-type uploadInfoRecord struct {
-	mu         sync.RWMutex
-	FileId     string
-	InitResult oss.InitiateMultipartUploadResult
-	PartResult []oss.UploadPart
-	StartedAt  time.Time
+var (
+	// ErrUploadNotFound is returned when the upload does not exist, or is already completed or aborted.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrUploadIncomplete is returned when completing an upload with parts missing.
+	ErrUploadIncomplete = errors.New("upload incomplete")
+)
+
+// uploadMaxAge is how long an upload can take, after which it is aborted.
+const uploadMaxAge = 24 * time.Hour
+
+// uploadSession An upload in progress, kept in the storage beside the file, so any replica can continue it.
+// The parts received are listed from the storage, rather than being tracked here.
+type uploadSession struct {
+	FileId    string    `json:"fileId"`
+	UploadId  string    `json:"uploadId"`
+	StartedAt time.Time `json:"startedAt"`
+	Creator   string    `json:"creator,omitempty"`   // the subject of the user uploading the file, unless it is uploaded through a file request
+	RequestId string    `json:"requestId,omitempty"` // the file request the file is uploaded through, if any
+	Length    int64     `json:"length,omitempty"`    // the size of the file if known, like for stream uploads
+}
+
+func uploadKey(fileId string) string {
+	return "uploads/" + fileId + ".bin"
+}
+
+func uploadSessionKey(fileId string) string {
+	return "uploads/" + fileId + ".json"
+}
+
+func putUploadSession(ctx context.Context, session *uploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	putOptions := PutOptions{
+		ContentType: "application/json",
+		ContentMD5:  utils.MD5HashBase64(data),
+		Metadata:    make(map[string]string),
+	}
+	expiresAt := session.StartedAt.Add(uploadMaxAge)
+	putOptions.setExpiry(&expiresAt)
+	return Client().PutObject(ctx, uploadSessionKey(session.FileId), bytes.NewReader(data), putOptions)
 }
 
-var uploadInfoMap sync.Map
+// uploadPutOptions returns the attributes of an uploaded file, which keeps its creator once the upload is complete.
+func uploadPutOptions(creator string) PutOptions {
+	options := PutOptions{
+		ContentType: "application/octet-stream",
+	}
+	if creator != "" {
+		options.Metadata = map[string]string{"Upload-Creator": creator}
+	}
+	return options
+}
+
+// readUploadSession returns ErrUploadNotFound if the upload does not exist.
+func readUploadSession(ctx context.Context, fileId string) (*uploadSession, error) {
+	if _, err := uuid.Parse(fileId); err != nil {
+		return nil, ErrUploadNotFound
+	}
+	res, err := Client().GetObject(ctx, uploadSessionKey(fileId), GetOptions{})
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	session := new(uploadSession)
+	err = json.NewDecoder(res.Body).Decode(session)
+	return session, err
+}
+
+// getUploadSession returns ErrUploadNotFound if the upload does not exist, or is too old to continue.
+func getUploadSession(ctx context.Context, fileId string) (*uploadSession, error) {
+	session, err := readUploadSession(ctx, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(session.StartedAt) > uploadMaxAge {
+		return nil, ErrUploadNotFound
+	}
+	return session, nil
+}
+
+// CheckUploadOwner returns ErrUploadNotFound unless the file is being uploaded by the user with the subject,
+// so the uploads of others cannot be inspected, changed or completed by their ids.
+func CheckUploadOwner(ctx context.Context, creator string, fileId string) error {
+	session, err := getUploadSession(ctx, fileId)
+	if err == nil && session.Creator != creator {
+		return ErrUploadNotFound
+	}
+	return err
+}
+
+// listUploadedParts returns the parts received by the storage, sorted by part number.
+func listUploadedParts(ctx context.Context, session *uploadSession) ([]UploadedPart, error) {
+	parts, err := Client().ListUploadedParts(ctx, uploadKey(session.FileId), session.UploadId)
+	if errors.Is(err, ErrObjectNotFound) {
+		// completed or aborted by another replica
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(parts, func(a, b UploadedPart) int {
+		return a.PartNumber - b.PartNumber
+	})
+	return parts, nil
+}
 
 // generateFileId generates a UUID as the uploaded file key.
 func generateFileId() (string, error) {
@@ -32,89 +140,225 @@ func generateFileId() (string, error) {
 	return instance.String(), nil
 }
 
-func UploadInit(ctx context.Context) (string, error) {
-	client := Client()
+// UploadInit starts an upload by the user with the subject, of `size` bytes if it is known, and returns the file id.
+func UploadInit(ctx context.Context, creator string, size int64) (string, error) {
+	return uploadInit(ctx, creator, "", size)
+}
 
+func uploadInit(ctx context.Context, creator string, requestId string, size int64) (string, error) {
 	fileId, err := generateFileId()
 	if err != nil {
 		return "", err
 	}
-	key := "uploads/" + fileId + ".bin"
-	ossOptions := []oss.Option{
-		oss.WithContext(ctx),
-		oss.ContentType("application/octet-stream"),
-	}
-	res, err := client.InitiateMultipartUpload(key, ossOptions...)
+	uploadId, err := Client().InitMultipartUpload(ctx, uploadKey(fileId), uploadPutOptions(creator))
 	if err != nil {
 		return "", err
 	}
-	uploadInfoMap.Store(fileId, &uploadInfoRecord{
-		FileId:     fileId,
-		InitResult: res,
-		StartedAt:  time.Now(),
+	err = putUploadSession(ctx, &uploadSession{
+		FileId:    fileId,
+		UploadId:  uploadId,
+		StartedAt: time.Now(),
+		Creator:   creator,
+		RequestId: requestId,
+		Length:    size,
 	})
+	if err != nil {
+		_ = Client().AbortMultipartUpload(context.Background(), uploadKey(fileId), uploadId)
+		return "", err
+	}
 
 	return fileId, nil
 }
 
-func UploadPart(ctx context.Context, fileId string, partNumber int, body io.Reader, size int64) error {
-	client := Client()
-
-	uploadInfoVal, ok := uploadInfoMap.Load(fileId)
-	if !ok {
-		return errors.Errorf("file id not found: %s", fileId)
+// UploadPart uploads a part through the server, which the storage verifies against the checksums given.
+func UploadPart(ctx context.Context, fileId string, partNumber int, body io.Reader, size int64, checksum PartChecksum) error {
+	session, err := getUploadSession(ctx, fileId)
+	if err != nil {
+		return err
 	}
-	uploadInfo := uploadInfoVal.(*uploadInfoRecord)
-	uploadInfo.mu.Lock()
-	defer uploadInfo.mu.Unlock()
+	return uploadPart(ctx, session, partNumber, body, size, checksum)
+}
 
-	ossOptions := []oss.Option{
-		oss.WithContext(ctx),
+// uploadPart uploads a part of `size` bytes, and hashes it if the parts before are hashed.
+func uploadPart(ctx context.Context, session *uploadSession, partNumber int, body io.Reader, size int64, checksum PartChecksum) error {
+	hasher, prevETag, err := partHasher(ctx, session.FileId, partNumber)
+	if err != nil {
+		return err
+	}
+	body = io.LimitReader(body, size)
+	if hasher != nil {
+		body = io.TeeReader(body, hasher)
+	}
+	// a part uploaded again, like when resuming, replaces the previous one in the storage
+	part, err := Client().UploadPart(ctx, uploadKey(session.FileId), session.UploadId, partNumber, body, size, checksum)
+	if errors.Is(err, ErrObjectNotFound) {
+		return ErrUploadNotFound
+	}
+	if err != nil || hasher == nil || part.Size != size {
+		return err
 	}
-	res, err := client.UploadPart(uploadInfo.InitResult, body, size, partNumber, ossOptions...)
+	return putPartHash(ctx, session.FileId, part, prevETag, hasher)
+}
+
+// UploadComplete completes an upload, and keeps the SHA-256 of the file if its parts are all hashed.
+// If `sha256Hex` is set, the file is verified against it, and deleted if it does not match.
+// Files uploaded to the storage directly are not hashed as they pass, so they are read back to be verified.
+func UploadComplete(ctx context.Context, fileId string, sha256Hex string) error {
+	sum, err := uploadComplete(ctx, fileId)
 	if err != nil {
 		return err
 	}
-	uploadInfo.PartResult = append(uploadInfo.PartResult, res)
+	return verifyUpload(ctx, fileId, sum, sha256Hex)
+}
 
-	return nil
+// uploadComplete returns the SHA-256 of the file in hex, or an empty string if it is not hashed.
+func uploadComplete(ctx context.Context, fileId string) (string, error) {
+	session, err := getUploadSession(ctx, fileId)
+	if err != nil {
+		return "", err
+	}
+	parts, err := listUploadedParts(ctx, session)
+	if err != nil {
+		return "", err
+	}
+	// the parts may be uploaded by the client directly, so they are only known by the storage
+	var size int64
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			return "", ErrUploadIncomplete
+		}
+		size += part.Size
+	}
+	if session.Length > 0 && size != session.Length {
+		return "", ErrUploadIncomplete
+	}
+	sum, err := uploadChecksum(ctx, fileId, parts)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) == 0 {
+		// an empty file, but a multipart upload needs at least one part
+		err = Client().PutObject(ctx, uploadKey(fileId), bytes.NewReader(nil), uploadPutOptions(session.Creator))
+		if err != nil {
+			return "", err
+		}
+		return sum, abortUpload(ctx, session)
+	}
+	err = Client().CompleteMultipartUpload(ctx, uploadKey(fileId), session.UploadId, parts)
+	if err != nil {
+		return "", err
+	}
+	// left to the garbage collector if they cannot be deleted
+	_ = deletePartHashes(ctx, fileId)
+	return sum, Client().DeleteObjects(ctx, []string{uploadSessionKey(fileId)})
 }
 
-func UploadComplete(ctx context.Context, fileId string) error {
-	client := Client()
+// UploadDirectSupported reports whether the parts of uploads can be uploaded to the storage directly.
+func UploadDirectSupported(ctx context.Context) bool {
+	_, err := Client().SignURL(ctx, "uploads/", http.MethodPut, time.Minute, SignOptions{})
+	return !errors.Is(err, ErrNotSupported)
+}
 
-	uploadInfoVal, ok := uploadInfoMap.Load(fileId)
-	if !ok {
-		return errors.Errorf("file id not found: %s", fileId)
+// SignUploadPart returns the URL to upload a part directly with a PUT request, which is valid as long as the upload is.
+// The part must be sent with `md5` as its `Content-MD5`, and match it.
+// It returns ErrNotSupported if the storage cannot be accessed directly.
+func SignUploadPart(ctx context.Context, fileId string, partNumber int, md5 string) (string, error) {
+	session, err := getUploadSession(ctx, fileId)
+	if err != nil {
+		return "", err
 	}
-	uploadInfo := uploadInfoVal.(*uploadInfoRecord)
-	uploadInfo.mu.RLock()
+	return Client().SignURL(ctx, uploadKey(fileId), http.MethodPut, time.Until(session.StartedAt.Add(uploadMaxAge)), SignOptions{
+		UploadId:   session.UploadId,
+		PartNumber: partNumber,
+		ContentMD5: md5,
+	})
+}
 
-	ossOptions := []oss.Option{
-		oss.WithContext(ctx),
+// uploadedSize returns the size of the parts uploaded so far, and the file request of the upload.
+func uploadedSize(ctx context.Context, fileId string) (int64, string, error) {
+	session, err := getUploadSession(ctx, fileId)
+	if err != nil {
+		return 0, "", err
 	}
-	_, err := client.CompleteMultipartUpload(uploadInfo.InitResult, uploadInfo.PartResult, ossOptions...)
+	parts, err := listUploadedParts(ctx, session)
+	if err != nil {
+		return 0, "", err
+	}
+	var size int64
+	for _, part := range parts {
+		size += part.Size
+	}
+	return size, session.RequestId, nil
+}
+
+// UploadStatus The progress of an upload, so it can be resumed.
+type UploadStatus struct {
+	FileId    string
+	StartedAt time.Time
+	Parts     []UploadedPart // sorted by part number
+}
+
+// GetUploadStatus returns the parts of an upload which are received by the storage.
+func GetUploadStatus(ctx context.Context, fileId string) (*UploadStatus, error) {
+	session, err := getUploadSession(ctx, fileId)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := listUploadedParts(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadStatus{
+		FileId:    fileId,
+		StartedAt: session.StartedAt,
+		Parts:     parts,
+	}, nil
+}
+
+// UploadAbort cancels an upload, and discards the parts received.
+func UploadAbort(ctx context.Context, fileId string) error {
+	session, err := getUploadSession(ctx, fileId)
 	if err != nil {
 		return err
 	}
+	return abortUpload(ctx, session)
+}
 
-	uploadInfo.mu.RUnlock()
-	uploadInfoMap.Delete(fileId)
-	return nil
+func abortUpload(ctx context.Context, session *uploadSession) error {
+	err := Client().AbortMultipartUpload(ctx, uploadKey(session.FileId), session.UploadId)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	_ = deletePartHashes(ctx, session.FileId)
+	return Client().DeleteObjects(ctx, []string{uploadSessionKey(session.FileId), uploadTailKey(session.FileId)})
 }
 
-func init() {
-	go func() {
-		// Set up a coroutine to clean up upload info older than a day
-		for {
-			uploadInfoMap.Range(func(key, value interface{}) bool {
-				uploadInfo := value.(*uploadInfoRecord)
-				if time.Since(uploadInfo.StartedAt) > 24*time.Hour {
-					uploadInfoMap.Delete(key)
-				}
-				return true
-			})
-			time.Sleep(10 * time.Minute)
+// SweepExpiredUploads aborts every upload which is too old to continue, and returns the number aborted.
+func SweepExpiredUploads(ctx context.Context) (int, error) {
+	objects, err := listAllObjects(ctx, Client(), "uploads/")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		session, err := readUploadSession(ctx, strings.TrimSuffix(strings.TrimPrefix(object.Key, "uploads/"), ".json"))
+		if errors.Is(err, ErrUploadNotFound) {
+			continue
+		}
+		if err != nil {
+			return count, err
 		}
-	}()
+		if time.Since(session.StartedAt) <= uploadMaxAge {
+			continue
+		}
+		if err = abortUpload(ctx, session); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
 }
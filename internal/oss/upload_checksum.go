@@ -0,0 +1,197 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Uploaded files are hashed as their parts pass through the server, so their SHA-256 is known without reading them back.
+// The hash of each part continues from the one of the part before, which is kept in `uploads/<id>.parts/<n>`,
+// so only the parts uploaded in order are hashed. Parts uploaded to the storage directly never pass through the server,
+// so their files are not hashed, though the storage still verifies each part against its checksums.
+// Such files are read back once complete, if the client sends a SHA-256 to verify them against.
+
+// partHash The state of the hash of an upload, after the part it is kept for.
+type partHash struct {
+	ETag     string `json:"etag"`               // of the part hashed
+	PrevETag string `json:"prevEtag,omitempty"` // of the part before, which the hash continues from
+	State    []byte `json:"state"`              // of the SHA-256, as marshaled by the hash
+}
+
+func partHashKey(fileId string, partNumber int) string {
+	return partHashPrefix(fileId) + strconv.Itoa(partNumber)
+}
+
+func partHashPrefix(fileId string) string {
+	return "uploads/" + fileId + ".parts/"
+}
+
+// uploadChecksumKey is where the SHA-256 of an uploaded file is kept, until it is shared.
+func uploadChecksumKey(fileId string) string {
+	return "uploads/" + fileId + ".sha256"
+}
+
+// readPartHash returns ErrObjectNotFound if the part is not hashed.
+func readPartHash(ctx context.Context, fileId string, partNumber int) (*partHash, error) {
+	res, err := Client().GetObject(ctx, partHashKey(fileId, partNumber), GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	h := new(partHash)
+	err = json.NewDecoder(res.Body).Decode(h)
+	return h, err
+}
+
+// resumeHash returns the SHA-256 with the state of `h`.
+func resumeHash(h *partHash) (hash.Hash, error) {
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(h.State); err != nil {
+		return nil, err
+	}
+	return hasher, nil
+}
+
+// partHasher returns the hash to continue with the part, and the ETag of the part before,
+// or nil if the part before is not hashed.
+func partHasher(ctx context.Context, fileId string, partNumber int) (hash.Hash, string, error) {
+	if partNumber == 1 {
+		return sha256.New(), "", nil
+	}
+	prev, err := readPartHash(ctx, fileId, partNumber-1)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	hasher, err := resumeHash(prev)
+	return hasher, prev.ETag, err
+}
+
+func putPartHash(ctx context.Context, fileId string, part UploadedPart, prevETag string, hasher hash.Hash) error {
+	state, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&partHash{
+		ETag:     part.ETag,
+		PrevETag: prevETag,
+		State:    state,
+	})
+	if err != nil {
+		return err
+	}
+	return Client().PutObject(ctx, partHashKey(fileId, part.PartNumber), bytes.NewReader(data), PutOptions{
+		ContentType: "application/json",
+	})
+}
+
+// uploadChecksum returns the SHA-256 of the file uploaded in `parts` in hex,
+// or an empty string if some of them are not hashed, or are uploaded again since.
+func uploadChecksum(ctx context.Context, fileId string, parts []UploadedPart) (string, error) {
+	hasher := sha256.New()
+	prevETag := ""
+	for _, part := range parts {
+		h, err := readPartHash(ctx, fileId, part.PartNumber)
+		if errors.Is(err, ErrObjectNotFound) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if h.ETag != part.ETag || h.PrevETag != prevETag {
+			return "", nil
+		}
+		if hasher, err = resumeHash(h); err != nil {
+			return "", err
+		}
+		prevETag = part.ETag
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// deletePartHashes deletes the hashes of the parts of an upload, which are not needed once it is completed or aborted.
+func deletePartHashes(ctx context.Context, fileId string) error {
+	objects, err := listAllObjects(ctx, Client(), partHashPrefix(fileId))
+	if err != nil || len(objects) == 0 {
+		return err
+	}
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return Client().DeleteObjects(ctx, keys)
+}
+
+// hashUpload reads the uploaded file back, and returns its SHA-256 in hex.
+func hashUpload(ctx context.Context, fileId string) (string, error) {
+	res, err := Client().GetObject(ctx, uploadKey(fileId), GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, res.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// verifyUpload keeps the SHA-256 of an uploaded file, and checks it against `sha256Hex` if set.
+// A file which is not hashed, like one uploaded directly, is only hashed by reading it back if it is to be checked.
+// A file which does not match is deleted, as it is corrupted.
+func verifyUpload(ctx context.Context, fileId string, sum string, sha256Hex string) error {
+	if sum == "" && sha256Hex == "" {
+		return nil
+	}
+	if sum == "" {
+		var err error
+		if sum, err = hashUpload(ctx, fileId); err != nil {
+			return err
+		}
+	}
+	if sha256Hex != "" && !strings.EqualFold(sha256Hex, sum) {
+		_ = Client().DeleteObjects(context.Background(), []string{uploadKey(fileId)})
+		return ErrChecksumMismatch
+	}
+	return Client().PutObject(ctx, uploadChecksumKey(fileId), strings.NewReader(sum), PutOptions{
+		ContentType: "text/plain",
+	})
+}
+
+// GetUploadChecksum returns the SHA-256 of an uploaded file in hex, or an empty string if it is not hashed.
+func GetUploadChecksum(ctx context.Context, fileId string) (string, error) {
+	if _, err := uuid.Parse(fileId); err != nil {
+		return "", nil
+	}
+	res, err := Client().GetObject(ctx, uploadChecksumKey(fileId), GetOptions{})
+	if errors.Is(err, ErrObjectNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(res.Body)
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, sha256.Size*2))
+	return string(data), err
+}
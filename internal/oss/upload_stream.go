@@ -0,0 +1,266 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	ErrUploadTooLarge       = errors.New("upload too large")
+)
+
+// UploadMaxLength is the largest file which can be uploaded in parts of UploadPartSize.
+const UploadMaxLength = 10000 * UploadPartSize
+
+// streamPartBuffers Buffers of a part, reused by the writes of stream uploads as they are large.
+var streamPartBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, UploadPartSize)
+		return &buf
+	},
+}
+
+// uploadTailKey is where the bytes received after the last full part are kept,
+// as the parts of a multipart upload cannot be appended to.
+// The `Upload-Part` metadata is the number of the part they belong to.
+func uploadTailKey(fileId string) string {
+	return "uploads/" + fileId + ".tail"
+}
+
+// StreamUpload An upload of a known length, written from the start to the end in any number of requests.
+type StreamUpload struct {
+	FileId    string
+	Offset    int64
+	Length    int64
+	ExpiresAt *time.Time // nil once the upload is complete
+}
+
+func (s *uploadSession) streamUpload(offset int64) *StreamUpload {
+	upload := &StreamUpload{
+		FileId: s.FileId,
+		Offset: offset,
+		Length: s.Length,
+	}
+	if offset < s.Length {
+		expiresAt := s.StartedAt.Add(uploadMaxAge)
+		upload.ExpiresAt = &expiresAt
+	}
+	return upload
+}
+
+// StreamUploadInit starts an upload of `length` bytes by the user with the subject.
+func StreamUploadInit(ctx context.Context, creator string, length int64) (*StreamUpload, error) {
+	if length > UploadMaxLength {
+		return nil, ErrUploadTooLarge
+	}
+	fileId, err := generateFileId()
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		// a multipart upload needs at least one part
+		err = Client().PutObject(ctx, uploadKey(fileId), bytes.NewReader(nil), uploadPutOptions(creator))
+		return &StreamUpload{FileId: fileId}, err
+	}
+
+	uploadId, err := Client().InitMultipartUpload(ctx, uploadKey(fileId), uploadPutOptions(creator))
+	if err != nil {
+		return nil, err
+	}
+	session := &uploadSession{
+		FileId:    fileId,
+		UploadId:  uploadId,
+		StartedAt: time.Now(),
+		Creator:   creator,
+		Length:    length,
+	}
+	if err = putUploadSession(ctx, session); err != nil {
+		_ = Client().AbortMultipartUpload(context.Background(), uploadKey(fileId), uploadId)
+		return nil, err
+	}
+	return session.streamUpload(0), nil
+}
+
+// streamUploadState is where a stream upload is at: the full parts received, and the tail after them.
+type streamUploadState struct {
+	partsSize int64
+	nextPart  int
+	tailSize  int64
+}
+
+func getStreamUploadState(ctx context.Context, session *uploadSession) (*streamUploadState, error) {
+	parts, err := listUploadedParts(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	state := &streamUploadState{nextPart: 1}
+	for _, part := range parts {
+		if part.PartNumber != state.nextPart {
+			break
+		}
+		state.partsSize += part.Size
+		state.nextPart++
+		if part.Size < UploadPartSize {
+			break
+		}
+	}
+
+	meta, err := Client().HeadObject(ctx, uploadTailKey(session.FileId))
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return nil, err
+	}
+	// a tail left behind by an interrupted write may be in a part already
+	if err == nil && meta.Meta("Upload-Part") == strconv.Itoa(state.nextPart) {
+		state.tailSize = meta.Size
+	}
+	return state, nil
+}
+
+// GetStreamUpload returns the progress of a stream upload by the user with the subject, or of a complete one.
+func GetStreamUpload(ctx context.Context, creator string, fileId string) (*StreamUpload, error) {
+	session, err := getUploadSession(ctx, fileId)
+	if errors.Is(err, ErrUploadNotFound) {
+		return getCompleteStreamUpload(ctx, creator, fileId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.Length == 0 || session.Creator != creator {
+		// uploaded in numbered parts
+		return nil, ErrUploadNotFound
+	}
+
+	state, err := getStreamUploadState(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if state.partsSize == session.Length {
+		// the last part is received, but the upload was not completed
+		if err = completeStreamUpload(ctx, fileId); err != nil {
+			return nil, err
+		}
+	}
+	return session.streamUpload(state.partsSize + state.tailSize), nil
+}
+
+func getCompleteStreamUpload(ctx context.Context, creator string, fileId string) (*StreamUpload, error) {
+	if _, err := uuid.Parse(fileId); err != nil {
+		return nil, ErrUploadNotFound
+	}
+	meta, err := Client().HeadObject(ctx, uploadKey(fileId))
+	if errors.Is(err, ErrObjectNotFound) || (err == nil && meta.Meta("Upload-Creator") != creator) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &StreamUpload{
+		FileId: fileId,
+		Offset: meta.Size,
+		Length: meta.Size,
+	}, nil
+}
+
+func completeStreamUpload(ctx context.Context, fileId string) error {
+	if err := UploadComplete(ctx, fileId, ""); err != nil {
+		return err
+	}
+	return Client().DeleteObjects(ctx, []string{uploadTailKey(fileId)})
+}
+
+// TerminateStreamUpload discards a stream upload by the user with the subject, or the file of a complete one.
+func TerminateStreamUpload(ctx context.Context, creator string, fileId string) error {
+	session, err := getUploadSession(ctx, fileId)
+	if errors.Is(err, ErrUploadNotFound) {
+		if _, err = getCompleteStreamUpload(ctx, creator, fileId); err != nil {
+			return err
+		}
+		return Client().DeleteObjects(ctx, []string{uploadKey(fileId), uploadChecksumKey(fileId)})
+	}
+	if err != nil {
+		return err
+	}
+	if session.Length == 0 || session.Creator != creator {
+		return ErrUploadNotFound
+	}
+	return abortUpload(ctx, session)
+}
+
+// StreamUploadWrite writes the body at `offset` of the upload by the user with the subject,
+// which must be where the upload is at. The upload is completed once all bytes are written.
+// If the body is interrupted, the bytes received are kept, and the error is returned.
+func StreamUploadWrite(ctx context.Context, creator string, fileId string, offset int64, body io.Reader) (*StreamUpload, error) {
+	session, err := getUploadSession(ctx, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if session.Length == 0 || session.Creator != creator {
+		return nil, ErrUploadNotFound
+	}
+	state, err := getStreamUploadState(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if offset != state.partsSize+state.tailSize {
+		return nil, ErrUploadOffsetMismatch
+	}
+
+	reader := io.LimitReader(body, session.Length-offset)
+	if state.tailSize > 0 {
+		res, err := Client().GetObject(ctx, uploadTailKey(fileId), GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		defer func(reader io.ReadCloser) {
+			_ = reader.Close()
+		}(res.Body)
+		reader = io.MultiReader(io.LimitReader(res.Body, state.tailSize), reader)
+	}
+
+	bufPtr := streamPartBuffers.Get().(*[]byte)
+	defer streamPartBuffers.Put(bufPtr)
+	buf := *bufPtr
+	for {
+		n, readErr := io.ReadFull(reader, buf)
+		if n == UploadPartSize || (n > 0 && state.partsSize+int64(n) == session.Length) {
+			err = uploadPart(ctx, session, state.nextPart, bytes.NewReader(buf[:n]), int64(n), PartChecksum{})
+			if err != nil {
+				return session.streamUpload(state.partsSize), err
+			}
+			state.partsSize += int64(n)
+			state.nextPart++
+			if readErr == nil {
+				continue
+			}
+		} else if n > 0 {
+			err = Client().PutObject(ctx, uploadTailKey(fileId), bytes.NewReader(buf[:n]), PutOptions{
+				ContentType: "application/octet-stream",
+				Metadata: map[string]string{
+					"Upload-Part": strconv.Itoa(state.nextPart),
+				},
+			})
+			if err != nil {
+				return session.streamUpload(state.partsSize), err
+			}
+			if readErr == io.ErrUnexpectedEOF {
+				readErr = nil
+			}
+			return session.streamUpload(state.partsSize + int64(n)), readErr
+		}
+
+		if state.partsSize == session.Length {
+			return session.streamUpload(state.partsSize), completeStreamUpload(ctx, fileId)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			readErr = nil
+		}
+		return session.streamUpload(state.partsSize), readErr
+	}
+}
@@ -3,13 +3,14 @@ package internal
 import (
 	"errors"
 	"github.com/jingbh/simple-share/app"
+	"github.com/jingbh/simple-share/internal/oss"
 	"github.com/labstack/echo/v4"
 	"github.com/spf13/viper"
 	"log"
 	"net/http"
 )
 
-func StartServer() {
+func NewServer() *echo.Echo {
 	e := echo.New()
 	e.Debug = viper.GetBool("debug")
 	e.IPExtractor = echo.ExtractIPFromXFFHeader()
@@ -17,6 +18,18 @@ func StartServer() {
 
 	app.RegisterRoutes(e)
 
+	return e
+}
+
+func StartServer() {
+	if err := oss.OpenIndex(); err != nil {
+		log.Fatal("Failed to open index: ", err)
+	}
+	e := NewServer()
+	oss.StartIndexRebuilder()
+	oss.StartShareSweeper()
+	oss.StartGarbageCollector()
+
 	if err := e.Start(viper.GetString("serve.addr")); !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
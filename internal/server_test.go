@@ -0,0 +1,2449 @@
+package internal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/jingbh/simple-share/internal/models"
+	"github.com/jingbh/simple-share/internal/notify"
+	"github.com/jingbh/simple-share/internal/oss"
+	"github.com/spf13/viper"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShareText(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	other := testProvider.Token(t, "bob")
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":        "text",
+			"name":        "texttest",
+			"displayName": "Greeting",
+			"text":        "hello, world",
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	// anyone with the link can read the share
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/texttest"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.Type != "text" || share.DisplayName != "Greeting" || share.Creator == nil || share.Creator.Subject != "alice" {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/texttest/content"})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "hello, world" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+
+	// names are unique
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "texttest", "text": "again"},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	if !strings.Contains(string(res.Body), `"name":"texttest"`) {
+		t.Fatalf("share not listed: %s", res.Body)
+	}
+
+	// only the owner can delete
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/texttest", Token: other})
+	expectStatus(t, res, http.StatusForbidden)
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/texttest"})
+	expectStatus(t, res, http.StatusForbidden)
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/texttest", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/texttest"})
+	expectStatus(t, res, http.StatusNotFound)
+}
+
+func TestShareCreateUnauthenticated(t *testing.T) {
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Json:   map[string]interface{}{"type": "text", "name": "anonymous", "text": "hi"},
+	})
+	expectStatus(t, res, http.StatusForbidden)
+
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload"})
+	expectStatus(t, res, http.StatusForbidden)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares"})
+	expectStatus(t, res, http.StatusForbidden)
+}
+
+func TestSharePassword(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "url", "name": "passwordtest", "text": "https://example.com", "password": "secret"},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/passwordtest"})
+	expectStatus(t, res, http.StatusUnauthorized)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/passwordtest?password=wrong"})
+	expectStatus(t, res, http.StatusUnauthorized)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/passwordtest?password=secret"})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{
+		Method:  http.MethodGet,
+		Path:    "/api/shares/passwordtest/content",
+		Headers: map[string]string{"X-Share-Password": "secret"},
+	})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "https://example.com" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+
+	// the owner does not need the password
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/passwordtest", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+}
+
+func TestShareExpiry(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "expirytest", "text": "soon gone", "expiry": 400},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "expirytest", "text": "soon gone", "expiresAt": "2000-01-01T00:00:00Z"},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "expirytest", "text": "soon gone", "expiry": 1, "expiresIn": 3600},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "expirytest", "text": "soon gone", "expiry": 3},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/expirytest"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.Expiry != 3 || share.CreatedAt == nil || share.ExpiresAt == nil {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	if d := share.ExpiresAt.Sub(*share.CreatedAt); d < 3*24*time.Hour-time.Minute || d > 3*24*time.Hour+time.Minute {
+		t.Fatalf("unexpected expiry: %s", d)
+	}
+
+	// any duration and absolute times are accepted, with the shortest lifecycle period as a backstop
+	expiresAt := time.Now().Add(10 * 24 * time.Hour).UTC().Truncate(time.Second)
+	for name, expiry := range map[string]map[string]interface{}{
+		"expiryhours": {"expiresIn": 2 * 3600},
+		"expirydays":  {"expiry": 30},
+		"expiryat":    {"expiresAt": expiresAt.Format(time.RFC3339)},
+	} {
+		req := map[string]interface{}{"type": "text", "name": name, "text": "soon gone"}
+		for k, v := range expiry {
+			req[k] = v
+		}
+		res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares", Token: owner, Json: req})
+		expectStatus(t, res, http.StatusOK)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/expiryhours"})
+	expectStatus(t, res, http.StatusOK)
+	share = models.Share{}
+	res.Json(t, &share)
+	if d := time.Until(*share.ExpiresAt); share.Expiry != 1 || d < 2*time.Hour-time.Minute || d > 2*time.Hour {
+		t.Fatalf("unexpected expiry: %d, %s", share.Expiry, d)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/expirydays"})
+	expectStatus(t, res, http.StatusOK)
+	share = models.Share{}
+	res.Json(t, &share)
+	if d := time.Until(*share.ExpiresAt); share.Expiry != 0 || d < 30*24*time.Hour-time.Minute || d > 30*24*time.Hour {
+		t.Fatalf("unexpected expiry: %d, %s", share.Expiry, d)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/expiryat"})
+	expectStatus(t, res, http.StatusOK)
+	share = models.Share{}
+	res.Json(t, &share)
+	if !share.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("unexpected expiry: %s", share.ExpiresAt)
+	}
+
+	// expired shares are rejected until they are swept
+	past := time.Now().Add(-time.Minute)
+	err := oss.UpdateShare(context.Background(), oss.UpdateShareOptions{Name: "expiryhours", ExpiresAt: &past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/expiryhours/content", Token: owner})
+	expectStatus(t, res, http.StatusGone)
+	if _, err = oss.SweepExpiredShares(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/expiryhours", Token: owner})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/expiryat"})
+	expectStatus(t, res, http.StatusOK)
+}
+
+func TestShareFile(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	content := []byte(strings.Repeat("0123456789", 100))
+	fileId := uploadFile(t, owner, content, 300)
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":             "file",
+			"nameRandom":       true,
+			"nameRandomLength": 8,
+			"files":            []map[string]string{{"id": fileId, "path": "docs/digits.txt"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+	var created struct {
+		Name string `json:"name"`
+	}
+	res.Json(t, &created)
+	if len(created.Name) != 8 {
+		t.Fatalf("unexpected name: %q", created.Name)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/" + created.Name})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.Type != "file" || share.Size != int64(len(content)) || len(share.Files) != 1 || share.Files[0].Path != "digits.txt" {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/" + created.Name + "/content"})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != string(content) {
+		t.Fatalf("unexpected content of %d bytes", len(res.Body))
+	}
+	if !strings.Contains(res.Header.Get("Content-Disposition"), "digits.txt") {
+		t.Fatalf("unexpected disposition: %q", res.Header.Get("Content-Disposition"))
+	}
+
+	res = doRequest(t, testRequest{
+		Method:  http.MethodGet,
+		Path:    "/api/shares/" + created.Name + "/content",
+		Headers: map[string]string{"Range": "bytes=995-"},
+	})
+	expectStatus(t, res, http.StatusPartialContent)
+	if string(res.Body) != "56789" || res.Header.Get("Content-Range") != "bytes 995-999/1000" {
+		t.Fatalf("unexpected range: %q %q", res.Body, res.Header.Get("Content-Range"))
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/" + created.Name + "/content/type"})
+	expectStatus(t, res, http.StatusOK)
+	if !strings.Contains(string(res.Body), `"type":"text"`) {
+		t.Fatalf("unexpected type: %s", res.Body)
+	}
+}
+
+func TestSharePreview(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	// the storage cannot resize images, so the original is previewed
+	content := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), bytes.Repeat([]byte{0}, 100)...)
+	fileId := uploadFile(t, owner, content, 1024)
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":  "file",
+			"name":  "previewtest",
+			"files": []map[string]string{{"id": fileId, "path": "image.png"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/previewtest/content/preview"})
+	expectStatus(t, res, http.StatusOK)
+	if res.Header.Get("Content-Type") != "image/png" || !bytes.Equal(res.Body, content) {
+		t.Fatalf("unexpected preview of type %q and %d bytes", res.Header.Get("Content-Type"), len(res.Body))
+	}
+}
+
+func TestShareDirectory(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	first := uploadFile(t, owner, []byte("first file"), 1024)
+	second := uploadFile(t, owner, []byte("the second file"), 1024)
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type": "file",
+			"name": "dirtest",
+			"files": []map[string]string{
+				{"id": first, "path": "a/first.txt"},
+				{"id": second, "path": "b/second.txt"},
+			},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/dirtest"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.Type != "directory" || len(share.Files) != 2 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	for _, file := range share.Files {
+		if (file.Id == first && file.Size != 10) || (file.Id == second && file.Size != 15) {
+			t.Fatalf("unexpected file: %+v", file)
+		}
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/dirtest/files/" + second})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "the second file" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/dirtest", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/dirtest/files/" + second})
+	expectStatus(t, res, http.StatusNotFound)
+}
+
+func TestUploadUnknownFile(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/upload/00000000-0000-0000-0000-000000000000/1",
+		Token:  owner,
+		Body:   []byte("data"),
+	})
+	if res.StatusCode < 400 {
+		t.Fatalf("expected an error, got %d", res.StatusCode)
+	}
+}
+
+func TestUploadStatus(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+
+	res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var upload struct {
+		Id string `json:"id"`
+	}
+	res.Json(t, &upload)
+
+	for i, part := range []string{"first part", "second"} {
+		res = doRequest(t, testRequest{
+			Method: http.MethodPost,
+			Path:   "/api/upload/" + upload.Id + "/" + strconv.Itoa(i+1),
+			Token:  owner,
+			Body:   []byte(part),
+		})
+		expectStatus(t, res, http.StatusCreated)
+	}
+	// resuming uploads a part again
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/2", Token: owner, Body: []byte("second part")})
+	expectStatus(t, res, http.StatusCreated)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/upload/" + upload.Id})
+	expectStatus(t, res, http.StatusForbidden)
+
+	// the uploads of others are not found
+	other := testProvider.Token(t, "bob")
+	for _, req := range []testRequest{
+		{Method: http.MethodGet, Path: "/api/upload/" + upload.Id},
+		{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/3", Body: []byte("third")},
+		{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/complete"},
+		{Method: http.MethodDelete, Path: "/api/upload/" + upload.Id},
+	} {
+		req.Token = other
+		res = doRequest(t, req)
+		expectStatus(t, res, http.StatusNotFound)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/upload/" + upload.Id, Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var status struct {
+		Id        string    `json:"id"`
+		PartSize  int64     `json:"partSize"`
+		StartedAt time.Time `json:"startedAt"`
+		Parts     []struct {
+			Number int    `json:"number"`
+			Size   int64  `json:"size"`
+			ETag   string `json:"etag"`
+		} `json:"parts"`
+	}
+	res.Json(t, &status)
+	if status.Id != upload.Id || status.PartSize <= 0 || status.StartedAt.IsZero() {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if len(status.Parts) != 2 || status.Parts[0].Number != 1 || status.Parts[0].Size != 10 ||
+		status.Parts[1].Number != 2 || status.Parts[1].Size != 11 || status.Parts[0].ETag == "" {
+		t.Fatalf("unexpected parts: %+v", status.Parts)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/upload/" + upload.Id, Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/upload/" + upload.Id, Token: owner})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/complete", Token: owner})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/upload/" + upload.Id, Token: owner})
+	expectStatus(t, res, http.StatusNotFound)
+}
+
+func TestUploadSessionStored(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+
+	res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var upload struct {
+		Id string `json:"id"`
+	}
+	res.Json(t, &upload)
+
+	// every replica finds the upload in the storage
+	if _, err := oss.Client().HeadObject(context.Background(), "uploads/"+upload.Id+".json"); err != nil {
+		t.Fatalf("upload session not stored: %v", err)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/1", Token: owner, Body: []byte("content")})
+	expectStatus(t, res, http.StatusCreated)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/complete", Token: owner})
+	expectStatus(t, res, http.StatusCreated)
+
+	if _, err := oss.Client().HeadObject(context.Background(), "uploads/"+upload.Id+".json"); !errors.Is(err, oss.ErrObjectNotFound) {
+		t.Fatalf("upload session not deleted: %v", err)
+	}
+	if _, err := oss.Client().HeadObject(context.Background(), "uploads/"+upload.Id+".parts/1"); !errors.Is(err, oss.ErrObjectNotFound) {
+		t.Fatalf("hash of the part not deleted: %v", err)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/1", Token: owner, Body: []byte("again")})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/upload/" + url.PathEscape("../shares/x"), Token: owner})
+	expectStatus(t, res, http.StatusNotFound)
+}
+
+func TestUploadDirect(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	viper.Set("oss.upload_direct", true)
+	defer viper.Set("oss.upload_direct", false)
+	start := func(size int) string {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: owner, Json: map[string]interface{}{"size": size}})
+		expectStatus(t, res, http.StatusOK)
+		var upload struct {
+			Id     string `json:"id"`
+			Direct bool   `json:"direct"`
+		}
+		res.Json(t, &upload)
+		// the memory storage cannot be accessed directly, so the parts are uploaded through the server
+		if upload.Direct {
+			t.Fatalf("unexpected parts: %s", res.Body)
+		}
+		return upload.Id
+	}
+	part := func(id string, number int, body string) {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + id + "/" + strconv.Itoa(number), Token: owner, Body: []byte(body)})
+		expectStatus(t, res, http.StatusCreated)
+	}
+	complete := func(id string) *testResponse {
+		t.Helper()
+		return doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + id + "/complete", Token: owner})
+	}
+
+	res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: owner, Json: map[string]interface{}{"size": -1}})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	// the memory storage cannot sign the parts
+	md5Sum := md5.Sum([]byte("hello world!"))
+	link := func(id string, sum string) *testResponse {
+		t.Helper()
+		return doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + id + "/1/link", Token: owner, Json: map[string]string{"md5": sum}})
+	}
+	id := start(12)
+	expectStatus(t, link(id, ""), http.StatusUnprocessableEntity)
+	expectStatus(t, link(id, "not a checksum"), http.StatusUnprocessableEntity)
+	expectStatus(t, link(id, base64.StdEncoding.EncodeToString(md5Sum[:])), http.StatusForbidden)
+
+	// the parts received are verified against the size
+	id = start(12)
+	part(id, 1, "hello ")
+	expectStatus(t, complete(id), http.StatusConflict)
+	part(id, 3, "world!")
+	expectStatus(t, complete(id), http.StatusConflict)
+	part(id, 2, "world!")
+	expectStatus(t, complete(id), http.StatusConflict)
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/upload/" + id, Token: owner})
+	expectStatus(t, res, http.StatusOK)
+
+	id = start(12)
+	part(id, 1, "hello ")
+	part(id, 2, "world!")
+	expectStatus(t, complete(id), http.StatusCreated)
+
+	// an empty file has no parts
+	id = start(0)
+	expectStatus(t, complete(id), http.StatusCreated)
+}
+
+func TestUploadChecksum(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	start := func() string {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: owner})
+		expectStatus(t, res, http.StatusOK)
+		var upload struct {
+			Id string `json:"id"`
+		}
+		res.Json(t, &upload)
+		return upload.Id
+	}
+	part := func(id string, number int, body string, headers map[string]string) *testResponse {
+		t.Helper()
+		return doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + id + "/" + strconv.Itoa(number), Token: owner, Body: []byte(body), Headers: headers})
+	}
+	complete := func(id string, sum string) *testResponse {
+		t.Helper()
+		return doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + id + "/complete", Token: owner, Json: map[string]string{"sha256": sum}})
+	}
+	sha256Hex := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	md5Base64 := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	// the parts are checked before they are accepted
+	id := start()
+	expectStatus(t, part(id, 1, "release ", map[string]string{"X-Content-SHA256": sha256Hex("corrupt")}), http.StatusBadRequest)
+	expectStatus(t, part(id, 1, "release ", map[string]string{"X-Content-SHA256": sha256Hex("release ")}), http.StatusCreated)
+	expectStatus(t, part(id, 2, "binary", map[string]string{"Content-MD5": md5Base64("corrupt")}), http.StatusBadRequest)
+	expectStatus(t, part(id, 2, "binary", map[string]string{"Content-MD5": md5Base64("binary")}), http.StatusCreated)
+	res := doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/upload/" + id, Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var status struct {
+		Parts []json.RawMessage `json:"parts"`
+	}
+	res.Json(t, &status)
+	if len(status.Parts) != 2 {
+		t.Fatalf("unexpected status: %s", res.Body)
+	}
+	expectStatus(t, part(id, 3, "", map[string]string{"Content-MD5": "not a checksum"}), http.StatusBadRequest)
+	expectStatus(t, part(id, 3, "s", map[string]string{"Content-MD5": "not a checksum"}), http.StatusBadRequest)
+	expectStatus(t, complete(id, "not a checksum"), http.StatusUnprocessableEntity)
+	// the file is hashed as its parts pass, so a corrupted file is discarded
+	expectStatus(t, complete(id, sha256Hex("release binaries")), http.StatusBadRequest)
+	expectStatus(t, complete(id, sha256Hex("release binary")), http.StatusNotFound)
+
+	content := "release binary"
+	id = start()
+	expectStatus(t, part(id, 1, content, nil), http.StatusCreated)
+	expectStatus(t, complete(id, strings.ToUpper(sha256Hex(content))), http.StatusCreated)
+	// a part uploaded again after the ones following it breaks the hash, so the file is not hashed as it passes
+	unhashed := func() string {
+		t.Helper()
+		id := start()
+		expectStatus(t, part(id, 1, "no", nil), http.StatusCreated)
+		expectStatus(t, part(id, 2, "tes", nil), http.StatusCreated)
+		expectStatus(t, part(id, 1, "No", nil), http.StatusCreated)
+		return id
+	}
+	unverified := unhashed()
+	expectStatus(t, complete(unverified, ""), http.StatusCreated)
+	// but it is read back if it is to be verified, and discarded if corrupted
+	verified := unhashed()
+	expectStatus(t, complete(verified, sha256Hex("notes")), http.StatusBadRequest)
+	expectStatus(t, complete(verified, sha256Hex("Notes")), http.StatusNotFound)
+	verified = unhashed()
+	expectStatus(t, complete(verified, sha256Hex("Notes")), http.StatusCreated)
+	if sum, err := oss.GetUploadChecksum(context.Background(), verified); err != nil || sum != sha256Hex("Notes") {
+		t.Fatalf("unexpected checksum of the file read back: %q %v", sum, err)
+	}
+
+	// so are the parts uploaded to the storage directly, bypassing the server
+	direct := func(content string) string {
+		t.Helper()
+		id := start()
+		res, err := oss.Client().GetObject(context.Background(), "uploads/"+id+".json", oss.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var session struct {
+			UploadId string `json:"uploadId"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&session)
+		_ = res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = oss.Client().UploadPart(context.Background(), "uploads/"+id+".bin", session.UploadId, 1,
+			strings.NewReader(content), int64(len(content)), oss.PartChecksum{MD5: md5Base64(content)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	tampered := direct("tampered")
+	expectStatus(t, complete(tampered, sha256Hex("uploaded")), http.StatusBadRequest)
+	expectStatus(t, complete(tampered, sha256Hex("tampered")), http.StatusNotFound)
+	uploaded := direct("uploaded")
+	expectStatus(t, complete(uploaded, sha256Hex("uploaded")), http.StatusCreated)
+	if sum, err := oss.GetUploadChecksum(context.Background(), uploaded); err != nil || sum != sha256Hex("uploaded") {
+		t.Fatalf("unexpected checksum of the file uploaded directly: %q %v", sum, err)
+	}
+
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":  "file",
+			"name":  "checksumfile",
+			"files": []map[string]string{{"id": id, "path": "app.bin"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/checksumfile"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if len(share.Files) != 1 || share.Files[0].SHA256 != sha256Hex(content) {
+		t.Fatalf("unexpected files: %+v", share.Files)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/checksumfile/content"})
+	expectStatus(t, res, http.StatusOK)
+	sum := sha256.Sum256([]byte(content))
+	if res.Header.Get("Repr-Digest") != "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":" {
+		t.Fatalf("unexpected digest: %q", res.Header.Get("Repr-Digest"))
+	}
+
+	id = start()
+	expectStatus(t, part(id, 1, content, nil), http.StatusCreated)
+	expectStatus(t, complete(id, sha256Hex(content)), http.StatusCreated)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":  "file",
+			"name":  "checksumdir",
+			"files": []map[string]string{{"id": id, "path": "bin/app"}, {"id": unverified, "path": "notes.txt"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/checksumdir"})
+	expectStatus(t, res, http.StatusOK)
+	share = models.Share{}
+	res.Json(t, &share)
+	for _, file := range share.Files {
+		if (file.Id == id) != (file.SHA256 == sha256Hex(content)) || (file.Id == unverified && file.SHA256 != "") {
+			t.Fatalf("unexpected files: %+v", share.Files)
+		}
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/checksumdir/files/" + unverified})
+	expectStatus(t, res, http.StatusOK)
+	if res.Header.Get("Repr-Digest") != "" {
+		t.Fatalf("unexpected digest: %q", res.Header.Get("Repr-Digest"))
+	}
+}
+
+func TestShareDedup(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	viper.Set("storage.dedup", true)
+	defer viper.Set("storage.dedup", false)
+	viper.Set("gc.interval", "6h")
+	defer viper.Set("gc.interval", "")
+
+	content := []byte(strings.Repeat("dataset ", 100))
+	sum := sha256.Sum256(content)
+	sumHex := hex.EncodeToString(sum[:])
+	upload := func(data []byte) string {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: owner})
+		expectStatus(t, res, http.StatusOK)
+		var upload struct {
+			Id string `json:"id"`
+		}
+		res.Json(t, &upload)
+		res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/1", Token: owner, Body: data})
+		expectStatus(t, res, http.StatusCreated)
+		dataSum := sha256.Sum256(data)
+		res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload/" + upload.Id + "/complete", Token: owner, Json: map[string]string{"sha256": hex.EncodeToString(dataSum[:])}})
+		expectStatus(t, res, http.StatusCreated)
+		return upload.Id
+	}
+	create := func(name string, files []map[string]string) {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares", Token: owner, Json: map[string]interface{}{
+			"type":  "file",
+			"name":  name,
+			"files": files,
+		}})
+		expectStatus(t, res, http.StatusOK)
+	}
+	blobExists := func() bool {
+		t.Helper()
+		_, err := oss.Client().HeadObject(context.Background(), "blobs/"+sumHex)
+		if err != nil && !errors.Is(err, oss.ErrObjectNotFound) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	create("dedupfile", []map[string]string{{"id": upload(content), "path": "dataset.bin"}})
+	create("dedupdir", []map[string]string{{"id": upload(content), "path": "data/dataset.bin"}, {"id": upload([]byte("readme")), "path": "README"}})
+	if !blobExists() {
+		t.Fatal("blob not created")
+	}
+	// the shares refer to the blob instead of copying it
+	meta, err := oss.Client().HeadObject(context.Background(), "shares/dedupfile")
+	if err != nil || meta.Size != 0 {
+		t.Fatalf("unexpected share object: %+v, %v", meta, err)
+	}
+
+	// a checksum declared by the client does not skip uploading, as it would give away any file whose checksum is known
+	res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: owner, Json: map[string]interface{}{"sha256": strings.ToUpper(sumHex)}})
+	expectStatus(t, res, http.StatusOK)
+	if strings.Contains(string(res.Body), "complete") {
+		t.Fatalf("unexpected upload: %s", res.Body)
+	}
+	create("dedupagain", []map[string]string{{"id": upload(content), "path": "copy.bin"}})
+	meta, err = oss.Client().HeadObject(context.Background(), "shares/dedupagain")
+	if err != nil || meta.Size != 0 {
+		t.Fatalf("unexpected share object: %+v, %v", meta, err)
+	}
+
+	// without the garbage collector, blobs would never be deleted, so files are copied instead
+	viper.Set("gc.interval", "0")
+	create("dedupoff", []map[string]string{{"id": upload(content), "path": "copy.bin"}})
+	viper.Set("gc.interval", "6h")
+	meta, err = oss.Client().HeadObject(context.Background(), "shares/dedupoff")
+	if err != nil || meta.Size != int64(len(content)) || meta.Meta("Share-Blob") != "" {
+		t.Fatalf("unexpected share object: %+v, %v", meta, err)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/dedupfile"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.Size != int64(len(content)) || share.Files[0].Size != int64(len(content)) {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/dedupagain/content"})
+	expectStatus(t, res, http.StatusOK)
+	if !bytes.Equal(res.Body, content) || !strings.Contains(res.Header.Get("Content-Disposition"), "copy.bin") {
+		t.Fatalf("unexpected content %q: %v", res.Body, res.Header)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/dedupdir"})
+	expectStatus(t, res, http.StatusOK)
+	share = models.Share{}
+	res.Json(t, &share)
+	if share.Size != int64(len(content))+6 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/dedupdir/archive?format=tar"})
+	expectStatus(t, res, http.StatusOK)
+	if !bytes.Contains(res.Body, content) {
+		t.Fatal("the archive misses the content of the blob")
+	}
+
+	// files failed to be added are removed
+	added := upload(content)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares/dedupdir/files", Token: owner, Json: map[string]interface{}{
+		"files": []map[string]string{{"id": added, "path": "data/copy.bin"}, {"id": upload([]byte("readme")), "path": "README"}},
+	}})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	if _, err = oss.Client().HeadObject(context.Background(), "shares/dedupdir.d/"+added+".bin"); !errors.Is(err, oss.ErrObjectNotFound) {
+		t.Fatalf("file left after a failed addition: %v", err)
+	}
+
+	// renaming keeps the references, and the blob is collected as garbage once no share refers to it
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares/dedupfile/rename", Token: owner, Json: map[string]string{"name": "deduprenamed"}})
+	expectStatus(t, res, http.StatusOK)
+	for _, name := range []string{"deduprenamed", "dedupdir"} {
+		res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/" + name, Token: owner})
+		expectStatus(t, res, http.StatusOK)
+	}
+	later := time.Now().Add(25 * time.Hour)
+	if _, err = oss.CollectGarbage(context.Background(), oss.GCOptions{Now: later}); err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists() {
+		t.Fatal("blob deleted while a share refers to it")
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/dedupagain/content"})
+	expectStatus(t, res, http.StatusOK)
+	if !bytes.Equal(res.Body, content) {
+		t.Fatalf("unexpected content %q", res.Body)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/dedupagain", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	if _, err = oss.CollectGarbage(context.Background(), oss.GCOptions{Now: later}); err != nil {
+		t.Fatal(err)
+	}
+	if blobExists() {
+		t.Fatal("blob not deleted")
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	tus := func(req testRequest) *testResponse {
+		t.Helper()
+		req.Token = owner
+		if req.Headers == nil {
+			req.Headers = make(map[string]string)
+		}
+		req.Headers["Tus-Resumable"] = "1.0.0"
+		return doRequest(t, req)
+	}
+	patch := func(location string, offset int, body []byte) *testResponse {
+		t.Helper()
+		return tus(testRequest{Method: http.MethodPatch, Path: location, Body: body, Headers: map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}})
+	}
+
+	res := doRequest(t, testRequest{Method: http.MethodOptions, Path: "/api/tus"})
+	expectStatus(t, res, http.StatusNoContent)
+	if res.Header.Get("Tus-Version") != "1.0.0" || !strings.Contains(res.Header.Get("Tus-Extension"), "termination") {
+		t.Fatalf("unexpected headers: %v", res.Header)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/tus", Token: owner, Headers: map[string]string{"Upload-Length": "1"}})
+	expectStatus(t, res, http.StatusPreconditionFailed)
+
+	// larger than a part, so the bytes after the first write are kept until the part is full
+	content := bytes.Repeat([]byte("0123456789"), oss.UploadPartSize/10+2)
+	res = tus(testRequest{Method: http.MethodPost, Path: "/api/tus", Headers: map[string]string{"Upload-Length": strconv.Itoa(len(content))}})
+	expectStatus(t, res, http.StatusCreated)
+	// the location is absolute, under the base URL the server is reached at
+	location := res.Header.Get("Location")
+	if !strings.HasPrefix(location, viper.GetString("baseurl")+"/api/tus/") || res.Header.Get("Upload-Expires") == "" {
+		t.Fatalf("unexpected headers: %v", res.Header)
+	}
+	location = strings.TrimPrefix(location, viper.GetString("baseurl"))
+
+	res = tus(testRequest{Method: http.MethodPatch, Path: location, Body: content[:10], Headers: map[string]string{"Upload-Offset": "0"}})
+	expectStatus(t, res, http.StatusUnsupportedMediaType)
+	res = patch(location, 0, content[:100])
+	expectStatus(t, res, http.StatusNoContent)
+	if res.Header.Get("Upload-Offset") != "100" {
+		t.Fatalf("unexpected offset: %q", res.Header.Get("Upload-Offset"))
+	}
+	res = patch(location, 0, content[:100])
+	expectStatus(t, res, http.StatusConflict)
+	res = patch(location, 100, content[100:oss.UploadPartSize+5])
+	expectStatus(t, res, http.StatusNoContent)
+
+	res = tus(testRequest{Method: http.MethodHead, Path: location})
+	expectStatus(t, res, http.StatusOK)
+	if res.Header.Get("Upload-Offset") != strconv.Itoa(oss.UploadPartSize+5) || res.Header.Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Fatalf("unexpected headers: %v", res.Header)
+	}
+	// the uploads of others are not found
+	other := testProvider.Token(t, "bob")
+	for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodDelete} {
+		res = doRequest(t, testRequest{Method: method, Path: location, Token: other, Headers: map[string]string{
+			"Tus-Resumable": "1.0.0",
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(oss.UploadPartSize + 5),
+		}})
+		expectStatus(t, res, http.StatusNotFound)
+	}
+	res = patch(location, oss.UploadPartSize+5, content[oss.UploadPartSize+5:])
+	expectStatus(t, res, http.StatusNoContent)
+	res = tus(testRequest{Method: http.MethodHead, Path: location})
+	expectStatus(t, res, http.StatusOK)
+	if res.Header.Get("Upload-Offset") != strconv.Itoa(len(content)) {
+		t.Fatalf("unexpected headers: %v", res.Header)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodHead, Path: location, Token: other, Headers: map[string]string{"Tus-Resumable": "1.0.0"}})
+	expectStatus(t, res, http.StatusNotFound)
+
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":  "file",
+			"name":  "tustest",
+			"files": []map[string]string{{"id": strings.TrimPrefix(location, "/api/tus/"), "path": "digits.txt"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/tustest/content"})
+	expectStatus(t, res, http.StatusOK)
+	if !bytes.Equal(res.Body, content) {
+		t.Fatalf("unexpected content of %d bytes", len(res.Body))
+	}
+
+	// termination, sent as POST like when PATCH and DELETE are blocked
+	res = tus(testRequest{Method: http.MethodPost, Path: "/api/tus", Headers: map[string]string{"Upload-Length": "10"}})
+	expectStatus(t, res, http.StatusCreated)
+	location = strings.TrimPrefix(res.Header.Get("Location"), viper.GetString("baseurl"))
+	res = tus(testRequest{Method: http.MethodPost, Path: location, Headers: map[string]string{"X-HTTP-Method-Override": http.MethodDelete}})
+	expectStatus(t, res, http.StatusNoContent)
+	res = tus(testRequest{Method: http.MethodHead, Path: location})
+	expectStatus(t, res, http.StatusNotFound)
+
+	// finished uploads, and empty ones which are finished as they are created, are terminated as well
+	for _, length := range []string{"0", "10"} {
+		res = tus(testRequest{Method: http.MethodPost, Path: "/api/tus", Headers: map[string]string{"Upload-Length": length}})
+		expectStatus(t, res, http.StatusCreated)
+		location = strings.TrimPrefix(res.Header.Get("Location"), viper.GetString("baseurl"))
+		if length != "0" {
+			res = patch(location, 0, []byte("0123456789"))
+			expectStatus(t, res, http.StatusNoContent)
+		}
+		res = doRequest(t, testRequest{Method: http.MethodDelete, Path: location, Token: other, Headers: map[string]string{"Tus-Resumable": "1.0.0"}})
+		expectStatus(t, res, http.StatusNotFound)
+		res = tus(testRequest{Method: http.MethodDelete, Path: location})
+		expectStatus(t, res, http.StatusNoContent)
+		res = tus(testRequest{Method: http.MethodHead, Path: location})
+		expectStatus(t, res, http.StatusNotFound)
+	}
+}
+
+func TestShareList(t *testing.T) {
+	owner := testProvider.Token(t, "carol")
+	other := testProvider.Token(t, "dave")
+
+	for _, req := range []map[string]interface{}{
+		{"type": "text", "name": "listtesta", "text": "a"},
+		{"type": "text", "name": "listtestb", "text": "bbbbbb", "password": "secret"},
+		{"type": "url", "name": "listtestc", "text": "https://example.com/ccc"},
+		{"type": "text", "name": "otherlist", "text": "other"},
+	} {
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares", Token: owner, Json: req})
+		expectStatus(t, res, http.StatusOK)
+	}
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  other,
+		Json:   map[string]interface{}{"type": "text", "name": "listtestd", "text": "not mine"},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	list := func(query string) []string {
+		t.Helper()
+		var names []string
+		cursor := ""
+		for {
+			res := doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares?" + query + "&cursor=" + cursor, Token: owner})
+			expectStatus(t, res, http.StatusOK)
+			var page struct {
+				Shares []models.Share `json:"data"`
+				Cursor string         `json:"cursor"`
+			}
+			res.Json(t, &page)
+			for _, share := range page.Shares {
+				names = append(names, share.Name)
+			}
+			if page.Cursor == "" {
+				return names
+			}
+			cursor = page.Cursor
+		}
+	}
+
+	tests := []struct {
+		query string
+		names string
+	}{
+		{"prefix=listtest", "listtesta,listtestb,listtestc"},
+		{"", "listtesta,listtestb,listtestc,otherlist"},
+		{"prefix=listtest&type=url", "listtestc"},
+		{"prefix=listtest&protected=true", "listtestb"},
+		{"prefix=listtest&protected=false", "listtesta,listtestc"},
+		{"prefix=listtest&status=expired", ""},
+		{"prefix=listtest&sort=size&order=desc", "listtestc,listtestb,listtesta"},
+	}
+	for _, test := range tests {
+		if names := strings.Join(list(test.query), ","); names != test.names {
+			t.Errorf("%q: expected %q, got %q", test.query, test.names, names)
+		}
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares?sort=owner", Token: owner})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+}
+
+func TestShareIndex(t *testing.T) {
+	if viper.GetString("index.path") == "" {
+		// enabled for this test only, unless it is for every test
+		viper.Set("index.path", filepath.Join(t.TempDir(), "index.db"))
+		if err := oss.OpenIndex(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			viper.Set("index.path", "")
+			oss.CloseIndex()
+		}()
+	}
+	owner := testProvider.Token(t, "ivan")
+	ctx := context.Background()
+
+	list := func() string {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares?sort=name", Token: owner})
+		expectStatus(t, res, http.StatusOK)
+		var page struct {
+			Shares []models.Share `json:"data"`
+		}
+		res.Json(t, &page)
+		var names []string
+		for _, share := range page.Shares {
+			names = append(names, share.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	// putShare writes a share behind the server's back, like another replica would
+	putShare := func(name string) {
+		t.Helper()
+		err := oss.Client().PutObject(ctx, "shares/"+name, strings.NewReader(name), oss.PutOptions{
+			ContentType: "text/plain",
+			Metadata: map[string]string{
+				"Share-Type":    "text",
+				"Share-Creator": `{"subject":"ivan"}`,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleteShare := func(name string) {
+		t.Helper()
+		if err := oss.Client().DeleteObjects(ctx, []string{"shares/" + name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"indextesta", "indextestb"} {
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares", Token: owner, Json: map[string]interface{}{"type": "text", "name": name, "text": name}})
+		expectStatus(t, res, http.StatusOK)
+	}
+	if names := list(); names != "indextesta,indextestb" {
+		t.Fatalf("unexpected shares: %s", names)
+	}
+
+	// a share missing from the index is read from the storage, and indexed
+	putShare("indextestc")
+	if names := list(); names != "indextesta,indextestb" {
+		t.Fatalf("unexpected shares before the miss: %s", names)
+	}
+	res := doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/indextestc"})
+	expectStatus(t, res, http.StatusOK)
+	if names := list(); names != "indextesta,indextestb,indextestc" {
+		t.Fatalf("unexpected shares after the miss: %s", names)
+	}
+
+	// a share deleted behind the server's back is removed once its content is found missing
+	deleteShare("indextestb")
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/indextestb/content"})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/indextestb"})
+	expectStatus(t, res, http.StatusNotFound)
+	if names := list(); names != "indextesta,indextestc" {
+		t.Fatalf("unexpected shares after the deleted hit: %s", names)
+	}
+
+	// or once the index is rebuilt
+	deleteShare("indextesta")
+	putShare("indextestd")
+	if _, err := oss.RebuildIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names := list(); names != "indextestc,indextestd" {
+		t.Fatalf("unexpected shares after the rebuild: %s", names)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/indextestc", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	if names := list(); names != "indextestd" {
+		t.Fatalf("unexpected shares after delete: %s", names)
+	}
+}
+
+func TestShareUpdate(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	other := testProvider.Token(t, "bob")
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "updatetest", "displayName": "Typo", "text": "content", "password": "secret", "expiry": 1},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/updatetest", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var created models.Share
+	res.Json(t, &created)
+
+	res = doRequest(t, testRequest{
+		Method: http.MethodPatch,
+		Path:   "/api/shares/updatetest",
+		Token:  other,
+		Json:   map[string]interface{}{"password": ""},
+	})
+	expectStatus(t, res, http.StatusForbidden)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPatch,
+		Path:   "/api/shares/updatetest",
+		Token:  owner,
+		Json:   map[string]interface{}{"expiry": 400},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+
+	res = doRequest(t, testRequest{
+		Method: http.MethodPatch,
+		Path:   "/api/shares/updatetest",
+		Token:  owner,
+		Json:   map[string]interface{}{"displayName": "Fixed", "password": "", "expiry": 7},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	// the password is removed, and the content is kept
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/updatetest"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.DisplayName != "Fixed" || share.Password != "" || share.Expiry != 7 || share.Creator == nil || share.Creator.Subject != "alice" {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	if share.CreatedAt == nil || !share.CreatedAt.Truncate(time.Second).Equal(created.CreatedAt.Truncate(time.Second)) {
+		t.Fatalf("creation time changed from %v to %v", created.CreatedAt, share.CreatedAt)
+	}
+	if d := time.Until(*share.ExpiresAt); d < 7*24*time.Hour-time.Minute || d > 7*24*time.Hour+time.Minute {
+		t.Fatalf("unexpected expiry: %s", d)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/updatetest/content"})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "content" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+
+	// absent fields are unchanged
+	res = doRequest(t, testRequest{
+		Method: http.MethodPatch,
+		Path:   "/api/shares/updatetest",
+		Token:  owner,
+		Json:   map[string]interface{}{"password": "another"},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/updatetest"})
+	expectStatus(t, res, http.StatusUnauthorized)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/updatetest?password=another"})
+	expectStatus(t, res, http.StatusOK)
+	res.Json(t, &share)
+	if share.DisplayName != "Fixed" || share.Expiry != 7 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "limittest", "text": "twice", "maxDownloads": 2},
+	})
+	expectStatus(t, res, http.StatusOK)
+	// the owner does not use up downloads
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limittest/content", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	for i := 0; i < 2; i++ {
+		res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limittest/content", Headers: map[string]string{"Range": "bytes=1-"}})
+		expectStatus(t, res, http.StatusOK)
+		if string(res.Body) != "twice" {
+			t.Fatalf("unexpected content: %q", res.Body)
+		}
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limittest/content"})
+	expectStatus(t, res, http.StatusGone)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limittest"})
+	expectStatus(t, res, http.StatusGone)
+	// the limit does not apply to the owner, whose downloads are not counted
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limittest/content", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+
+	// the password is checked before the download limit, which it protects as well
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "limitpasswordtest", "text": "once", "maxDownloads": 1, "password": "secret"},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitpasswordtest/content?password=secret"})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitpasswordtest"})
+	expectStatus(t, res, http.StatusUnauthorized)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitpasswordtest?password=secret"})
+	expectStatus(t, res, http.StatusGone)
+
+	// burned shares are deleted
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "burntest", "text": "secret", "burnAfterRead": true},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/burntest"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.MaxDownloads != 1 || !share.BurnAfterRead {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/burntest/content"})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "secret" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/burntest/content"})
+	expectStatus(t, res, http.StatusNotFound)
+
+	// files of a directory share are counted separately
+	first := uploadFile(t, owner, []byte("first file"), 1024)
+	second := uploadFile(t, owner, []byte("second file"), 1024)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":         "file",
+			"name":         "limitdirtest",
+			"maxDownloads": 1,
+			"files":        []map[string]string{{"id": first, "path": "first.txt"}, {"id": second, "path": "second.txt"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitdirtest/files/" + first})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitdirtest/files/" + first})
+	expectStatus(t, res, http.StatusGone)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitdirtest/content"})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitdirtest/files/" + second + "/preview"})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitdirtest"})
+	expectStatus(t, res, http.StatusGone)
+}
+
+func TestShareDownloadLimitConcurrent(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "limitconcurrenttest", "text": "thrice", "maxDownloads": 3},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	// concurrent downloads cannot exceed the limit
+	var wg sync.WaitGroup
+	statuses := make([]int, 8)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitconcurrenttest/content"}).StatusCode
+		}(i)
+	}
+	wg.Wait()
+	ok := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			ok++
+		} else if status != http.StatusGone {
+			t.Fatalf("unexpected status: %d", status)
+		}
+	}
+	if ok != 3 {
+		t.Fatalf("expected 3 downloads, got %d: %v", ok, statuses)
+	}
+
+	// downloads of missing content are not counted
+	first := uploadFile(t, owner, []byte("first file"), 1024)
+	second := uploadFile(t, owner, []byte("second file"), 1024)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":         "file",
+			"name":         "limitmissingtest",
+			"maxDownloads": 1,
+			"files":        []map[string]string{{"id": first, "path": "first.txt"}, {"id": second, "path": "second.txt"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+	err := oss.Client().DeleteObjects(context.Background(), []string{"shares/limitmissingtest.d/" + second + ".bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitmissingtest/files/" + second})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitmissingtest/archive"})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitmissingtest/files/" + first})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "first file" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+
+	// downloads are counted once they start, so one cut off by the client still counts
+	large := uploadFile(t, owner, bytes.Repeat([]byte("large file"), 1<<20), 5<<20)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":         "file",
+			"name":         "limitcuttest",
+			"maxDownloads": 1,
+			"files":        []map[string]string{{"id": large, "path": "large.txt"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+	cut, err := http.Get(testServer.URL + "/api/shares/limitcuttest/content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cut.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", cut.StatusCode)
+	}
+	if _, err = cut.Body.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	_ = cut.Body.Close()
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/limitcuttest/content"})
+	expectStatus(t, res, http.StatusGone)
+}
+
+func TestShareRenameAndAliases(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	other := testProvider.Token(t, "bob")
+	first := uploadFile(t, owner, []byte("first file"), 1024)
+	second := uploadFile(t, owner, []byte("second file"), 1024)
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":  "file",
+			"name":  "renamesrc",
+			"files": []map[string]string{{"id": first, "path": "first.txt"}, {"id": second, "path": "second.txt"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{
+		Method: http.MethodPatch,
+		Path:   "/api/shares/renamesrc",
+		Token:  owner,
+		Json:   map[string]interface{}{"aliases": []string{"renamealias", "renamesrc"}},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPatch,
+		Path:   "/api/shares/renamesrc",
+		Token:  owner,
+		Json:   map[string]interface{}{"aliases": []string{"renamealias"}},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	// aliases resolve to the share, and cannot be taken by other shares
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/renamealias"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.Name != "renamesrc" || len(share.Aliases) != 1 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/renamealias"})
+	expectStatus(t, res, http.StatusFound)
+	if !strings.HasSuffix(res.Header.Get("Location"), "/#/shares/renamesrc") {
+		t.Fatalf("unexpected redirect: %q", res.Header.Get("Location"))
+	}
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "renamealias", "text": "taken"},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+
+	// a share which name is a prefix of another share
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json:   map[string]interface{}{"type": "text", "name": "renamesrcx", "text": "neighbour"},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares/renamesrc/rename", Token: other, Json: map[string]string{"name": "renamedst"}})
+	expectStatus(t, res, http.StatusForbidden)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares/renamesrc/rename", Token: owner, Json: map[string]string{"name": "renamesrcx"}})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares/renamealias/rename", Token: owner, Json: map[string]string{"name": "renamedst"}})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/renamesrc"})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/renamedst/files/" + second})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "second file" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/renamealias"})
+	expectStatus(t, res, http.StatusOK)
+	share = models.Share{}
+	res.Json(t, &share)
+	if share.Name != "renamedst" || share.Type != "directory" || len(share.Files) != 2 || share.Size != 21 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/renamesrcx/content"})
+	expectStatus(t, res, http.StatusOK)
+
+	// deleting removes the aliases, but not the neighbour
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/renamedst", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/renamealias"})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/renamesrc", Token: owner})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/renamesrcx/content"})
+	expectStatus(t, res, http.StatusOK)
+}
+
+func TestShareFiles(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	other := testProvider.Token(t, "bob")
+	first := uploadFile(t, owner, []byte("build 1"), 1024)
+	second := uploadFile(t, owner, []byte("build 2"), 1024)
+	third := uploadFile(t, owner, []byte("build 3"), 1024)
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type":  "file",
+			"name":  "filestest",
+			"files": []map[string]string{{"id": first, "path": "v1/app.bin"}, {"id": second, "path": "v2/app.bin"}},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares/filestest/files",
+		Token:  other,
+		Json:   map[string]interface{}{"files": []map[string]string{{"id": third, "path": "v3/app.bin"}}},
+	})
+	expectStatus(t, res, http.StatusForbidden)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares/filestest/files",
+		Token:  owner,
+		Json:   map[string]interface{}{"files": []map[string]string{{"id": third, "path": "/v2/./app.bin"}}},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares/filestest/files",
+		Token:  owner,
+		Json:   map[string]interface{}{"files": []map[string]string{{"id": third, "path": "v3/app.bin"}}},
+	})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if len(share.Files) != 3 || share.Size != 21 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/filestest/files/" + third})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "build 3" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+
+	res = doRequest(t, testRequest{
+		Method: http.MethodPatch,
+		Path:   "/api/shares/filestest/files/" + third,
+		Token:  owner,
+		Json:   map[string]string{"path": "v1/app.bin"},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPatch,
+		Path:   "/api/shares/filestest/files/" + third,
+		Token:  owner,
+		Json:   map[string]string{"path": "latest/app-v3.bin"},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/filestest/files/" + third})
+	expectStatus(t, res, http.StatusOK)
+	if !strings.Contains(res.Header.Get("Content-Disposition"), "app-v3.bin") {
+		t.Fatalf("unexpected disposition: %q", res.Header.Get("Content-Disposition"))
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/filestest/files/" + first, Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	share = models.Share{}
+	res.Json(t, &share)
+	paths := make([]string, 0, len(share.Files))
+	for _, file := range share.Files {
+		paths = append(paths, file.Path)
+	}
+	if strings.Join(paths, ",") != "v2/app.bin,latest/app-v3.bin" {
+		t.Fatalf("unexpected files: %v", paths)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/filestest/files/" + first})
+	expectStatus(t, res, http.StatusNotFound)
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/shares/filestest/files/" + first, Token: owner})
+	expectStatus(t, res, http.StatusNotFound)
+}
+
+func TestShareArchive(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	first := uploadFile(t, owner, []byte("first file"), 1024)
+	second := uploadFile(t, owner, []byte("second file"), 1024)
+	third := uploadFile(t, owner, []byte("third file"), 1024)
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type": "file",
+			"name": "archivetest",
+			"files": []map[string]string{
+				{"id": first, "path": "docs/first.txt"},
+				{"id": second, "path": "../second.txt"},
+				{"id": third, "path": "docs/sub/third.txt"},
+			},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	entries := func(query string) string {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/archivetest/archive" + query})
+		expectStatus(t, res, http.StatusOK)
+		if res.Header.Get("Content-Type") != "application/zip" {
+			t.Fatalf("unexpected type: %q", res.Header.Get("Content-Type"))
+		}
+		zr, err := zip.NewReader(bytes.NewReader(res.Body), int64(len(res.Body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, file := range zr.File {
+			r, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, file.Name+"="+string(content))
+		}
+		return strings.Join(names, ",")
+	}
+
+	if got := entries(""); got != "docs/first.txt=first file,second.txt=second file,docs/sub/third.txt=third file" {
+		t.Fatalf("unexpected entries: %s", got)
+	}
+	if got := entries("?prefix=docs"); got != "docs/first.txt=first file,docs/sub/third.txt=third file" {
+		t.Fatalf("unexpected entries: %s", got)
+	}
+	if got := entries("?files=" + third + "&files=" + second); got != "second.txt=second file,docs/sub/third.txt=third file" {
+		t.Fatalf("unexpected entries: %s", got)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/archivetest/archive?prefix=doc"})
+	expectStatus(t, res, http.StatusNotFound)
+}
+
+func TestShareArchiveTar(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	first := uploadFile(t, owner, bytes.Repeat([]byte("a"), 700), 1024)
+	second := uploadFile(t, owner, []byte("second file"), 1024)
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type": "file",
+			"name": "tartest",
+			"files": []map[string]string{
+				{"id": first, "path": "docs/first.txt"},
+				{"id": second, "path": "second.txt"},
+			},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	entries := func(r io.Reader) string {
+		t.Helper()
+		tr := tar.NewReader(r)
+		var names []string
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, header.Name+"="+strings.TrimLeft(string(content), "a"))
+		}
+		return strings.Join(names, ",")
+	}
+	const expected = "docs/first.txt=,second.txt=second file"
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/tartest/archive?format=tar"})
+	expectStatus(t, res, http.StatusOK)
+	if res.Header.Get("Content-Length") != strconv.Itoa(len(res.Body)) || res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("unexpected headers: %v", res.Header)
+	}
+	if got := entries(bytes.NewReader(res.Body)); got != expected {
+		t.Fatalf("unexpected entries: %s", got)
+	}
+	whole := res.Body
+
+	// resuming in the middle of the first file
+	res = doRequest(t, testRequest{
+		Method:  http.MethodGet,
+		Path:    "/api/shares/tartest/archive?format=tar",
+		Headers: map[string]string{"Range": "bytes=600-"},
+	})
+	expectStatus(t, res, http.StatusPartialContent)
+	if !bytes.Equal(res.Body, whole[600:]) {
+		t.Fatal("unexpected partial content")
+	}
+	res = doRequest(t, testRequest{
+		Method:  http.MethodGet,
+		Path:    "/api/shares/tartest/archive?format=tar",
+		Headers: map[string]string{"Range": "bytes=" + strconv.Itoa(len(whole)) + "-"},
+	})
+	expectStatus(t, res, http.StatusRequestedRangeNotSatisfiable)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/tartest/archive?format=tar.gz"})
+	expectStatus(t, res, http.StatusOK)
+	if res.Header.Get("Content-Type") != "application/gzip" || !strings.Contains(res.Header.Get("Content-Disposition"), "tartest.tar.gz") {
+		t.Fatalf("unexpected headers: %v", res.Header)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(res.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(gr); got != expected {
+		t.Fatalf("unexpected entries: %s", got)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/tartest/archive?format=rar"})
+	expectStatus(t, res, http.StatusBadRequest)
+}
+
+func TestShareExtract(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+
+	contents := map[string]string{"docs/first.txt": "first file", "second.txt": "second file"}
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for name, content := range contents {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(content))
+	}
+	if _, err := zw.Create("empty/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tarred bytes.Buffer
+	gw := gzip.NewWriter(&tarred)
+	tw := tar.NewWriter(gw)
+	for _, name := range []string{"ok.txt", "../escape.txt"} {
+		_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: 2, Mode: 0o644})
+		_, _ = tw.Write([]byte("hi"))
+	}
+	_ = tw.Close()
+	_ = gw.Close()
+
+	create := func(name string, content []byte) *testResponse {
+		t.Helper()
+		id := uploadFile(t, owner, content, 1024)
+		return doRequest(t, testRequest{
+			Method: http.MethodPost,
+			Path:   "/api/shares",
+			Token:  owner,
+			Json: map[string]interface{}{
+				"type":    "file",
+				"name":    name,
+				"extract": true,
+				"files":   []map[string]string{{"id": id, "path": "archive"}},
+			},
+		})
+	}
+
+	res := create("extracttest", zipped.Bytes())
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/extracttest"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.Type != "directory" || len(share.Files) != 2 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	for _, file := range share.Files {
+		res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/extracttest/files/" + file.Id})
+		expectStatus(t, res, http.StatusOK)
+		if string(res.Body) != contents[file.Path] {
+			t.Fatalf("unexpected file %s: %q", file.Path, res.Body)
+		}
+		// the checksums are computed while extracting
+		if sum := sha256.Sum256(res.Body); file.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("unexpected checksum of %s: %q", file.Path, file.SHA256)
+		}
+	}
+
+	// paths escaping the archive are rejected, and nothing is left behind
+	res = create("extractescape", tarred.Bytes())
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/extractescape"})
+	expectStatus(t, res, http.StatusNotFound)
+
+	res = create("extractinvalid", []byte("not an archive"))
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+}
+
+func TestShareTree(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	first := uploadFile(t, owner, []byte("first file"), 1024)
+	second := uploadFile(t, owner, []byte("second file"), 1024)
+	third := uploadFile(t, owner, []byte("third file"), 1024)
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares",
+		Token:  owner,
+		Json: map[string]interface{}{
+			"type": "file",
+			"name": "treetest",
+			"files": []map[string]string{
+				{"id": first, "path": "manual/index.html"},
+				{"id": second, "path": "manual/images/logo 1.png"},
+				{"id": third, "path": "readme.txt"},
+			},
+		},
+	})
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/treetest/tree"})
+	expectStatus(t, res, http.StatusOK)
+	var tree models.ShareTree
+	res.Json(t, &tree)
+	if len(tree.Directories) != 1 || tree.Directories[0].Path != "manual" || tree.Directories[0].FileCount != 2 || tree.Directories[0].Size != 21 {
+		t.Fatalf("unexpected directories: %+v", tree.Directories)
+	}
+	if len(tree.Files) != 1 || tree.Files[0].Id != third {
+		t.Fatalf("unexpected files: %+v", tree.Files)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/treetest/tree?path=manual/"})
+	expectStatus(t, res, http.StatusOK)
+	tree = models.ShareTree{}
+	res.Json(t, &tree)
+	if tree.Path != "manual" || len(tree.Directories) != 1 || tree.Directories[0].Path != "manual/images" || len(tree.Files) != 1 || tree.Files[0].Id != first {
+		t.Fatalf("unexpected tree: %+v", tree)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/treetest/tree?path=missing"})
+	expectStatus(t, res, http.StatusNotFound)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/treetest/path/manual/images/logo%201.png"})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "second file" {
+		t.Fatalf("unexpected content: %q", res.Body)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/treetest/path/manual"})
+	expectStatus(t, res, http.StatusNotFound)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/treetest/path/manual/index.html"})
+	expectStatus(t, res, http.StatusFound)
+	if !strings.HasSuffix(res.Header.Get("Location"), "/api/shares/treetest/path/manual/index.html") {
+		t.Fatalf("unexpected redirect: %s", res.Header.Get("Location"))
+	}
+}
+
+func TestShareSite(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	index := uploadFile(t, owner, []byte("<h1>home</h1>"), 1024)
+	guide := uploadFile(t, owner, []byte("<h1>guide</h1>"), 1024)
+	style := uploadFile(t, owner, []byte("h1 {}"), 1024)
+
+	create := func(name string, extra map[string]interface{}) *testResponse {
+		t.Helper()
+		req := map[string]interface{}{
+			"type": "file",
+			"name": name,
+			"site": true,
+			"files": []map[string]string{
+				{"id": index, "path": "index.html"},
+				{"id": guide, "path": "guide/index.html"},
+				{"id": style, "path": "assets/style.css"},
+			},
+		}
+		for k, v := range extra {
+			req[k] = v
+		}
+		return doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares", Token: owner, Json: req})
+	}
+	res := create("sitetest", map[string]interface{}{"password": "secret"})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = create("sitetest", nil)
+	expectStatus(t, res, http.StatusOK)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/sitetest/site/"})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "<h1>home</h1>" || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected page: %q %q", res.Body, res.Header.Get("Content-Type"))
+	}
+	if res.Header.Get("Content-Disposition") != "inline" {
+		t.Fatalf("unexpected headers: %v", res.Header)
+	}
+	csp := "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; " +
+		"img-src 'self' data:; connect-src 'none'; form-action 'none'; frame-ancestors 'none'; base-uri 'none'; " +
+		"sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+	if v := res.Header.Get("Content-Security-Policy"); v != csp {
+		t.Fatalf("unexpected Content-Security-Policy: %q", v)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/sitetest/site/assets/style.css"})
+	expectStatus(t, res, http.StatusOK)
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/css") {
+		t.Fatalf("unexpected type: %q", res.Header.Get("Content-Type"))
+	}
+
+	// directories are redirected to their trailing slash, so relative links resolve
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/sitetest/site"})
+	expectStatus(t, res, http.StatusMovedPermanently)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/sitetest/site/guide"})
+	expectStatus(t, res, http.StatusMovedPermanently)
+	if res.Header.Get("Location") != "guide/" {
+		t.Fatalf("unexpected redirect: %s", res.Header.Get("Location"))
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/sitetest/site/guide/"})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "<h1>guide</h1>" {
+		t.Fatalf("unexpected page: %q", res.Body)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/sitetest/site/missing.html"})
+	expectStatus(t, res, http.StatusNotFound)
+
+	// the website can be turned off
+	res = doRequest(t, testRequest{Method: http.MethodPatch, Path: "/api/shares/sitetest", Token: owner, Json: map[string]interface{}{"site": false}})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/s/sitetest/site/"})
+	expectStatus(t, res, http.StatusNotFound)
+}
+
+func TestFileRequest(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	other := testProvider.Token(t, "bob")
+
+	events := make(chan notify.Event, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer webhook.Close()
+	viper.Set("notify.webhook", webhook.URL)
+	defer viper.Set("notify.webhook", "")
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/requests",
+		Token:  owner,
+		Json:   map[string]interface{}{"displayName": "Reports", "password": "secret", "maxFiles": 2},
+	})
+	expectStatus(t, res, http.StatusOK)
+	var created struct {
+		Id    string `json:"id"`
+		Share string `json:"share"`
+	}
+	res.Json(t, &created)
+
+	// anonymous visitors upload with the password
+	upload := func(content []byte, path string, password string) *testResponse {
+		t.Helper()
+		headers := map[string]string{"X-Share-Password": password}
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/requests/" + created.Id + "/upload", Headers: headers})
+		if res.StatusCode != http.StatusOK {
+			return res
+		}
+		var started struct {
+			Id string `json:"id"`
+		}
+		res.Json(t, &started)
+		res = doRequest(t, testRequest{
+			Method:  http.MethodPost,
+			Path:    "/api/requests/" + created.Id + "/upload/" + started.Id + "/1",
+			Headers: headers,
+			Body:    content,
+		})
+		if res.StatusCode != http.StatusCreated {
+			return res
+		}
+		return doRequest(t, testRequest{
+			Method:  http.MethodPost,
+			Path:    "/api/requests/" + created.Id + "/upload/" + started.Id + "/complete",
+			Headers: headers,
+			Json:    map[string]string{"path": path},
+		})
+	}
+	res = upload([]byte("first report"), "report.txt", "wrong")
+	expectStatus(t, res, http.StatusUnauthorized)
+	res = upload([]byte("first report"), "report.txt", "secret")
+	expectStatus(t, res, http.StatusCreated)
+	res = upload([]byte("second report"), "report.txt", "secret")
+	expectStatus(t, res, http.StatusCreated)
+	var file models.ShareFile
+	res.Json(t, &file)
+	if file.Path != "report (1).txt" || file.Size != 13 {
+		t.Fatalf("unexpected file: %+v", file)
+	}
+	res = upload([]byte("third report"), "report.txt", "secret")
+	expectStatus(t, res, http.StatusRequestEntityTooLarge)
+
+	select {
+	case event := <-events:
+		if event.Type != "request.upload" || event.Owner == nil || event.Owner.Subject != "alice" {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("owner not notified")
+	}
+
+	// the files are in the share of the owner
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/" + created.Share, Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if share.Type != "directory" || len(share.Files) != 2 || share.DisplayName != "Reports" {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/requests", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var requests []models.FileRequest
+	res.Json(t, &requests)
+	if len(requests) != 1 || requests[0].FileCount != 2 || requests[0].Size != 25 {
+		t.Fatalf("unexpected requests: %+v", requests)
+	}
+
+	// the total size is limited as well, and only directory shares of the owner can receive files
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/requests",
+		Token:  other,
+		Json:   map[string]interface{}{"share": created.Share},
+	})
+	expectStatus(t, res, http.StatusUnprocessableEntity)
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/requests",
+		Token:  owner,
+		Json:   map[string]interface{}{"share": created.Share, "maxSize": 5},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res.Json(t, &created)
+	res = upload([]byte("too large"), "large.txt", "")
+	expectStatus(t, res, http.StatusRequestEntityTooLarge)
+
+	// the request follows the share when it is renamed
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares/" + created.Share + "/rename", Token: owner, Json: map[string]string{"name": "requestrenamed"}})
+	expectStatus(t, res, http.StatusOK)
+	res = upload([]byte("tiny"), "tiny.txt", "")
+	expectStatus(t, res, http.StatusCreated)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/requests", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	requests = nil
+	res.Json(t, &requests)
+	for _, request := range requests {
+		if request.Id == created.Id && (request.Share != "requestrenamed" || request.FileCount != 1 || request.Size != 4) {
+			t.Fatalf("unexpected request after the share is renamed: %+v", request)
+		}
+	}
+
+	// concurrent uploads cannot exceed the limits
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/requests",
+		Token:  owner,
+		Json:   map[string]interface{}{"share": "requestrenamed", "maxFiles": 2},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res.Json(t, &created)
+	var wg sync.WaitGroup
+	statuses := make([]int, 6)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = upload([]byte("concurrent"), "concurrent.txt", "").StatusCode
+		}(i)
+	}
+	wg.Wait()
+	accepted := 0
+	for _, status := range statuses {
+		if status == http.StatusCreated {
+			accepted++
+		} else if status != http.StatusRequestEntityTooLarge {
+			t.Fatalf("unexpected status: %d", status)
+		}
+	}
+	if accepted != 2 {
+		t.Fatalf("expected 2 files accepted, got %d: %v", accepted, statuses)
+	}
+
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/requests/" + created.Id, Token: other})
+	expectStatus(t, res, http.StatusForbidden)
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: "/api/requests/" + created.Id, Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/requests/" + created.Id})
+	expectStatus(t, res, http.StatusNotFound)
+}
+
+func TestFileRequestReservation(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+
+	res := doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/requests",
+		Token:  owner,
+		Json:   map[string]interface{}{"maxFiles": 2, "maxSize": 10},
+	})
+	expectStatus(t, res, http.StatusOK)
+	var created struct {
+		Id string `json:"id"`
+	}
+	res.Json(t, &created)
+	path := "/api/requests/" + created.Id + "/upload"
+
+	start := func(status int) string {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: path})
+		expectStatus(t, res, status)
+		var started struct {
+			Id string `json:"id"`
+		}
+		if status == http.StatusOK {
+			res.Json(t, &started)
+		}
+		return started.Id
+	}
+
+	// files and sizes are reserved as uploads start and parts are uploaded, before they are complete
+	first := start(http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: path + "/" + first + "/1", Body: []byte("eight by")})
+	expectStatus(t, res, http.StatusCreated)
+	second := start(http.StatusOK)
+	start(http.StatusRequestEntityTooLarge)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: path + "/" + second + "/1", Body: []byte("three")})
+	expectStatus(t, res, http.StatusRequestEntityTooLarge)
+
+	// the ids of the uploads are not shown to those uploading
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/requests/" + created.Id})
+	expectStatus(t, res, http.StatusOK)
+	if strings.Contains(string(res.Body), first) {
+		t.Fatalf("upload ids shown: %s", res.Body)
+	}
+
+	// aborting an upload releases its reservation
+	res = doRequest(t, testRequest{Method: http.MethodDelete, Path: path + "/" + first})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: path + "/" + second + "/1", Body: []byte("three")})
+	expectStatus(t, res, http.StatusCreated)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: path + "/" + second + "/complete", Json: map[string]string{"path": "three.txt"}})
+	expectStatus(t, res, http.StatusCreated)
+	third := start(http.StatusOK)
+
+	// so does an upload which is gone, once the room is needed
+	if err := oss.UploadAbort(context.Background(), third); err != nil {
+		t.Fatal(err)
+	}
+	start(http.StatusOK)
+	start(http.StatusRequestEntityTooLarge)
+
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/requests", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var requests []models.FileRequest
+	res.Json(t, &requests)
+	for _, request := range requests {
+		if request.Id == created.Id && (request.FileCount != 1 || request.Size != 5 || len(request.Uploads) != 1) {
+			t.Fatalf("unexpected request: %+v", request)
+		}
+	}
+}
+
+func TestGarbageCollector(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	ctx := context.Background()
+	client := oss.Client()
+
+	shared := uploadFile(t, owner, []byte("kept"), 1024)
+	res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares", Token: owner, Json: map[string]interface{}{
+		"type":  "file",
+		"name":  "gcfile",
+		"files": []map[string]string{{"id": shared, "path": "kept.txt"}},
+	}})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares", Token: owner, Json: map[string]interface{}{
+		"type": "file",
+		"name": "gcdir",
+		"files": []map[string]string{
+			{"id": uploadFile(t, owner, []byte("one"), 1024), "path": "one.txt"},
+			{"id": uploadFile(t, owner, []byte("two"), 1024), "path": "two.txt"},
+		},
+	}})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/gcdir"})
+	expectStatus(t, res, http.StatusOK)
+	var dir models.Share
+	res.Json(t, &dir)
+
+	// an upload never completed
+	res = doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/upload", Token: owner})
+	expectStatus(t, res, http.StatusOK)
+	var pending struct {
+		Id string `json:"id"`
+	}
+	res.Json(t, &pending)
+
+	// leftovers of failed operations
+	for _, key := range []string{"shares/gcorphan.d/" + shared + ".bin", "downloads/gcgone.json", "aliases/gcalias", "request-shares/gcgone/gcrequest"} {
+		if err := client.PutObject(ctx, key, strings.NewReader("gcorphan"), oss.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a file request not listed under its share, like one created before requests were listed
+	err := client.PutObject(ctx, "requests/gcunlisted", strings.NewReader(`{"id":"gcunlisted","share":"gcdir"}`), oss.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteObjects(ctx, []string{"shares/gcdir.d/" + dir.Files[0].Id + ".bin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// recent objects may be part of operations in progress
+	report, err := oss.CollectGarbage(ctx, oss.GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range report.Actions {
+		if action.Action != "repair" && action.Action != "report" {
+			t.Fatalf("unexpected action: %+v", action)
+		}
+	}
+
+	// multipart uploads outside of `uploads/` may belong to others sharing the bucket
+	otherUpload, err := client.InitMultipartUpload(ctx, "other/gc.bin", oss.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(25 * time.Hour)
+	report, err = oss.CollectGarbage(ctx, oss.GCOptions{DryRun: true, Now: later})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"uploads/" + pending.Id + ".bin":       "abort",
+		"uploads/" + pending.Id + ".json":      "delete",
+		"uploads/" + shared + ".bin":           "delete",
+		"shares/gcorphan.d/" + shared + ".bin": "delete",
+		"downloads/gcgone.json":                "delete",
+		"aliases/gcalias":                      "delete",
+		"request-shares/gcgone/gcrequest":      "delete",
+		"request-shares/gcdir/gcunlisted":      "repair",
+		"shares/gcdir":                         "repair",
+	}
+	for key, action := range expected {
+		found := false
+		for _, a := range report.Actions {
+			found = found || a.Key == key && a.Action == action
+		}
+		if !found {
+			t.Fatalf("expected %s %s in %+v", action, key, report.Actions)
+		}
+	}
+	// nothing is changed by a dry run
+	if _, err = client.HeadObject(ctx, "aliases/gcalias"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = oss.CollectGarbage(ctx, oss.GCOptions{Now: later}); err != nil {
+		t.Fatal(err)
+	}
+	for key, action := range expected {
+		if action == "repair" {
+			continue
+		}
+		if _, err = client.HeadObject(ctx, key); !errors.Is(err, oss.ErrObjectNotFound) {
+			t.Fatalf("expected %s to be collected: %v", key, err)
+		}
+	}
+	if _, err = client.HeadObject(ctx, "request-shares/gcdir/gcunlisted"); err != nil {
+		t.Fatalf("file request not listed under its share: %v", err)
+	}
+	uploads, err := client.ListMultipartUploads(ctx, "uploads/"+pending.Id)
+	if err != nil || len(uploads) != 0 {
+		t.Fatalf("unexpected multipart uploads: %+v, %v", uploads, err)
+	}
+	uploads, err = client.ListMultipartUploads(ctx, "other/")
+	if err != nil || len(uploads) != 1 || uploads[0].UploadId != otherUpload {
+		t.Fatalf("unexpected multipart uploads of others: %+v, %v", uploads, err)
+	}
+	if err = client.AbortMultipartUpload(ctx, "other/gc.bin", otherUpload); err != nil {
+		t.Fatal(err)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/gcdir"})
+	expectStatus(t, res, http.StatusOK)
+	dir = models.Share{}
+	res.Json(t, &dir)
+	if len(dir.Files) != 1 || dir.Files[0].Path != "two.txt" {
+		t.Fatalf("unexpected share: %+v", dir)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/gcfile/content"})
+	expectStatus(t, res, http.StatusOK)
+	if string(res.Body) != "kept" {
+		t.Fatalf("unexpected content: %s", res.Body)
+	}
+
+	report, err = oss.CollectGarbage(ctx, oss.GCOptions{Now: later})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := report.Count("abort") + report.Count("delete") + report.Count("repair"); n > 0 {
+		t.Fatalf("unexpected actions: %+v", report.Actions)
+	}
+}
+
+func TestShareEncryption(t *testing.T) {
+	owner := testProvider.Token(t, "alice")
+	ctx := context.Background()
+	viper.Set("encryption.master_key", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	defer viper.Set("encryption.master_key", "")
+
+	// spans several chunks, the last of which is partial
+	content := make([]byte, 150000)
+	for i := range content {
+		content[i] = byte(i * 7 % 251)
+	}
+	create := func(name string, password string, files []map[string]string) {
+		t.Helper()
+		res := doRequest(t, testRequest{Method: http.MethodPost, Path: "/api/shares", Token: owner, Json: map[string]interface{}{
+			"type":     "file",
+			"name":     name,
+			"password": password,
+			"files":    files,
+		}})
+		expectStatus(t, res, http.StatusOK)
+	}
+	stored := func(key string) (*oss.ObjectMeta, []byte) {
+		t.Helper()
+		meta, err := oss.Client().HeadObject(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := oss.Client().GetObject(ctx, key, oss.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func(reader io.ReadCloser) {
+			_ = reader.Close()
+		}(res.Body)
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta, data
+	}
+
+	create("encfile", "", []map[string]string{{"id": uploadFile(t, owner, content, 1<<20), "path": "data.bin"}})
+	meta, data := stored("shares/encfile")
+	if !strings.HasPrefix(meta.Meta("Share-Key"), "master:") || bytes.Contains(data, content[:1000]) {
+		t.Fatalf("unexpected stored share: %+v", meta.Metadata)
+	}
+	res := doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encfile"})
+	expectStatus(t, res, http.StatusOK)
+	var share models.Share
+	res.Json(t, &share)
+	if !share.Encrypted || share.Size != int64(len(content)) {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encfile/content"})
+	expectStatus(t, res, http.StatusOK)
+	if !bytes.Equal(res.Body, content) {
+		t.Fatal("unexpected content")
+	}
+	// ranges across the chunks are decrypted
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encfile/content", Headers: map[string]string{"Range": "bytes=65000-140000"}})
+	expectStatus(t, res, http.StatusPartialContent)
+	if !bytes.Equal(res.Body, content[65000:140001]) || res.Header.Get("Content-Range") != "bytes 65000-140000/150000" {
+		t.Fatalf("unexpected range: %q", res.Header.Get("Content-Range"))
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encfile/content", Headers: map[string]string{"Range": "bytes=-10"}})
+	expectStatus(t, res, http.StatusPartialContent)
+	if !bytes.Equal(res.Body, content[len(content)-10:]) {
+		t.Fatal("unexpected suffix range")
+	}
+
+	// the key of a share with a password is wrapped by the password
+	create("encsecret", "hunter2", []map[string]string{{"id": uploadFile(t, owner, content, 1<<20), "path": "data.bin"}})
+	meta, _ = stored("shares/encsecret")
+	if !strings.HasPrefix(meta.Meta("Share-Key"), "password:") {
+		t.Fatalf("unexpected stored share: %+v", meta.Metadata)
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encsecret/content", Token: owner})
+	expectStatus(t, res, http.StatusUnauthorized)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encsecret/content", Headers: map[string]string{"X-Share-Password": "hunter2"}})
+	expectStatus(t, res, http.StatusOK)
+	if !bytes.Equal(res.Body, content) {
+		t.Fatal("unexpected content")
+	}
+	res = doRequest(t, testRequest{Method: http.MethodPatch, Path: "/api/shares/encsecret", Token: owner, Json: map[string]string{"password": "swordfish"}})
+	expectStatus(t, res, http.StatusUnauthorized)
+	res = doRequest(t, testRequest{
+		Method:  http.MethodPatch,
+		Path:    "/api/shares/encsecret",
+		Token:   owner,
+		Json:    map[string]string{"password": "swordfish"},
+		Headers: map[string]string{"X-Share-Password": "hunter2"},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encsecret/content", Token: owner, Headers: map[string]string{"X-Share-Password": "swordfish"}})
+	expectStatus(t, res, http.StatusOK)
+	if !bytes.Equal(res.Body, content) {
+		t.Fatal("unexpected content")
+	}
+
+	// files of directory shares, including those added later, share the key
+	create("encdir", "", []map[string]string{
+		{"id": uploadFile(t, owner, content, 1<<20), "path": "a.bin"},
+		{"id": uploadFile(t, owner, []byte("small"), 1024), "path": "b.txt"},
+	})
+	res = doRequest(t, testRequest{
+		Method: http.MethodPost,
+		Path:   "/api/shares/encdir/files",
+		Token:  owner,
+		Json:   map[string]interface{}{"files": []map[string]string{{"id": uploadFile(t, owner, []byte{}, 1024), "path": "empty"}}},
+	})
+	expectStatus(t, res, http.StatusOK)
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encdir"})
+	expectStatus(t, res, http.StatusOK)
+	share = models.Share{}
+	res.Json(t, &share)
+	if share.Size != int64(len(content)+5) || len(share.Files) != 3 {
+		t.Fatalf("unexpected share: %+v", share)
+	}
+	for _, file := range share.Files {
+		meta, _ = stored("shares/encdir.d/" + file.Id + ".bin")
+		if meta.Meta("Share-Nonce") == "" {
+			t.Fatalf("file not encrypted: %s", file.Path)
+		}
+	}
+	res = doRequest(t, testRequest{Method: http.MethodGet, Path: "/api/shares/encdir/archive?format=tar"})
+	expectStatus(t, res, http.StatusOK)
+	tr := tar.NewReader(bytes.NewReader(res.Body))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string][]byte{"a.bin": content, "b.txt": []byte("small"), "empty": {}}[header.Name]
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("unexpected archive entry: %s", header.Name)
+		}
+	}
+}
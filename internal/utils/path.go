@@ -1,6 +1,9 @@
 package utils
 
-import "strings"
+import (
+	"net/url"
+	"strings"
+)
 
 func ExtractFilename(path string) string {
 	path = strings.TrimSpace(path)
@@ -8,3 +11,9 @@ func ExtractFilename(path string) string {
 	parts := strings.SplitAfter(path, "/")
 	return parts[len(parts)-1]
 }
+
+// AttachmentDisposition returns the Content-Disposition header to download a file with the name.
+func AttachmentDisposition(filename string) string {
+	nameEncoded := url.PathEscape(filename)
+	return "attachment; filename=\"" + nameEncoded + "\"; filename*=UTF-8''" + nameEncoded
+}
@@ -1,14 +1,59 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/jingbh/simple-share/internal"
 	"github.com/jingbh/simple-share/internal/oidc"
+	"github.com/jingbh/simple-share/internal/oss"
+	"os"
 )
 
 func main() {
 	internal.InitConfig()
+
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	go func() {
 		oidc.InitOIDC()
 	}()
 	internal.StartServer()
 }
+
+// runCommand runs a maintenance command instead of the server, and returns the exit code.
+func runCommand(args []string) int {
+	switch {
+	case len(args) == 2 && args[0] == "index" && args[1] == "rebuild":
+		if err := oss.OpenIndex(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open index:", err)
+			return 1
+		}
+		count, err := oss.RebuildIndex(context.Background())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to rebuild index:", err)
+			return 1
+		}
+		fmt.Printf("Indexed %d shares\n", count)
+		return 0
+	case args[0] == "gc" && (len(args) == 1 || len(args) == 2 && args[1] == "--dry-run"):
+		report, err := oss.CollectGarbage(context.Background(), oss.GCOptions{DryRun: len(args) == 2})
+		for _, action := range report.Actions {
+			fmt.Printf("%s %s: %s\n", action.Action, action.Key, action.Reason)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to collect garbage:", err)
+			return 1
+		}
+		if report.DryRun {
+			fmt.Print("Dry run, nothing changed. ")
+		}
+		fmt.Printf("Aborted %d uploads, deleted %d objects, repaired %d and reported %d problems\n",
+			report.Count("abort"), report.Count("delete"), report.Count("repair"), report.Count("report"))
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: simple-share [index rebuild | gc [--dry-run]]")
+		return 2
+	}
+}
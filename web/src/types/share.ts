@@ -5,12 +5,14 @@ export interface Share {
   name: string
   displayName?: string
   password?: string
-  expiry?: number
+  expiry?: number // lifecycle period in days, use expiresAt instead
   size: number
   createdAt?: string
   expiresAt?: string
   files?: ShareFile[]
   creator?: ShareCreator
+  site?: boolean // served as a static website at /s/:name/site/
+  encrypted?: boolean // content encrypted in the storage, with the password if the share has one
 }
 
 export interface ShareSettings {
@@ -35,6 +37,7 @@ export interface ShareFile {
   id: string
   path: string
   size?: number
+  sha256?: string // in hex, if hashed when uploaded
 }
 
 export interface ShareFileUpload {
@@ -0,0 +1,49 @@
+// MD5 is not provided by Web Crypto, but the storage only verifies directly uploaded parts by their `Content-MD5`
+
+const shifts = [7, 12, 17, 22, 5, 9, 14, 20, 4, 11, 16, 23, 6, 10, 15, 21]
+const constants = Array.from({ length: 64 }, (_, i) => Math.floor(Math.abs(Math.sin(i + 1)) * 2 ** 32) | 0)
+
+// md5Base64 returns the MD5 of the data in base64, like `Content-MD5`
+export const md5Base64 = (data: Uint8Array): string => {
+  const padded = new Uint8Array(Math.ceil((data.length + 9) / 64) * 64)
+  padded.set(data)
+  padded[data.length] = 0x80
+  const view = new DataView(padded.buffer)
+  view.setUint32(padded.length - 8, (data.length * 8) >>> 0, true)
+  view.setUint32(padded.length - 4, Math.floor(data.length / 2 ** 29), true)
+
+  const state = [0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476]
+  for (let offset = 0; offset < padded.length; offset += 64) {
+    let [a, b, c, d] = state
+    for (let i = 0; i < 64; i++) {
+      let f: number, g: number
+      if (i < 16) {
+        f = (b & c) | (~b & d)
+        g = i
+      } else if (i < 32) {
+        f = (d & b) | (~d & c)
+        g = (5 * i + 1) % 16
+      } else if (i < 48) {
+        f = b ^ c ^ d
+        g = (3 * i + 5) % 16
+      } else {
+        f = c ^ (b | ~d)
+        g = (7 * i) % 16
+      }
+      const s = shifts[(i >> 4) * 4 + (i % 4)]
+      const x = (a + f + constants[i] + view.getUint32(offset + g * 4, true)) | 0
+      a = d
+      d = c
+      c = b
+      b = (b + ((x << s) | (x >>> (32 - s)))) | 0
+    }
+    state[0] = (state[0] + a) | 0
+    state[1] = (state[1] + b) | 0
+    state[2] = (state[2] + c) | 0
+    state[3] = (state[3] + d) | 0
+  }
+
+  const digest = new DataView(new ArrayBuffer(16))
+  state.forEach((v, i) => digest.setUint32(i * 4, v, true))
+  return btoa(String.fromCharCode(...new Uint8Array(digest.buffer)))
+}